@@ -0,0 +1,179 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const bucketsPrefix = "PULLEY_BUCKETS_"
+
+// fileBuckets is the bucket layout of a histogram, either the explicit upper
+// bounds of the buckets, or a generator of them.
+type fileBuckets struct {
+	Explicit    []float64        `yaml:"explicit"`
+	Exponential *fileExponential `yaml:"exponential"`
+	Linear      *fileLinear      `yaml:"linear"`
+}
+
+type fileExponential struct {
+	Start  float64 `yaml:"start"`
+	Factor float64 `yaml:"factor"`
+	Count  int     `yaml:"count"`
+}
+
+type fileLinear struct {
+	Start float64 `yaml:"start"`
+	Width float64 `yaml:"width"`
+	Count int     `yaml:"count"`
+}
+
+// explicitBuckets checks that the upper bounds of the buckets are increasing.
+func explicitBuckets(bounds []float64) ([]float64, error) {
+	if len(bounds) == 0 {
+		return nil, fmt.Errorf("no buckets given")
+	}
+
+	for i := 1; i < len(bounds); i++ {
+		if bounds[i] <= bounds[i-1] {
+			return nil, fmt.Errorf("bucket bounds must be increasing, got %v after %v", bounds[i], bounds[i-1])
+		}
+	}
+
+	return bounds, nil
+}
+
+// exponentialBuckets returns count buckets, the first one having start as its
+// upper bound, and each next one factor times the previous one.
+func exponentialBuckets(start, factor float64, count int) ([]float64, error) {
+	if start <= 0 || factor <= 1 || count < 1 {
+		return nil, fmt.Errorf("exponential buckets need a positive start, a factor greater than 1, and a positive count, got %v, %v, and %d", start, factor, count)
+	}
+
+	buckets := make([]float64, count)
+	for i := range buckets {
+		buckets[i] = start
+		start *= factor
+	}
+
+	return buckets, nil
+}
+
+// linearBuckets returns count buckets, the first one having start as its upper
+// bound, and each next one being width wider than the previous one.
+func linearBuckets(start, width float64, count int) ([]float64, error) {
+	if width <= 0 || count < 1 {
+		return nil, fmt.Errorf("linear buckets need a positive width and a positive count, got %v and %d", width, count)
+	}
+
+	buckets := make([]float64, count)
+	for i := range buckets {
+		buckets[i] = start
+		start += width
+	}
+
+	return buckets, nil
+}
+
+// parseBuckets parses a bucket layout, either explicit upper bounds, as in
+// "1,5,10", or a generator, as in "exponential:1,2,14" (start, factor, count),
+// or "linear:0,60,10" (start, width, count).
+func parseBuckets(in string) ([]float64, error) {
+	generator, args := "", in
+	if i := strings.Index(in, ":"); i >= 0 {
+		generator, args = in[:i], in[i+1:]
+	}
+
+	var values []float64
+
+	for _, s := range strings.Split(args, ",") {
+		v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse '%s' as a number", s)
+		}
+
+		values = append(values, v)
+	}
+
+	switch generator {
+	case "":
+		return explicitBuckets(values)
+	case "exponential", "linear":
+		if len(values) != 3 || values[2] != float64(int(values[2])) {
+			return nil, fmt.Errorf("%s buckets need three numbers, a start, a step, and a whole count", generator)
+		}
+
+		if generator == "exponential" {
+			return exponentialBuckets(values[0], values[1], int(values[2]))
+		}
+
+		return linearBuckets(values[0], values[1], int(values[2]))
+	}
+
+	return nil, fmt.Errorf("unknown bucket generator '%s', expected 'exponential' or 'linear'", generator)
+}
+
+// processBuckets collects the bucket layouts from the PULLEY_BUCKETS_<name>
+// variables, where the name is the one of the histogram, in upper case.
+func processBuckets() (map[string][]float64, error) {
+	buckets := make(map[string][]float64)
+
+	for _, e := range os.Environ() {
+		pair := strings.SplitN(e, "=", 2)
+		if !strings.HasPrefix(pair[0], bucketsPrefix) {
+			continue
+		}
+
+		name := strings.ToLower(strings.TrimPrefix(pair[0], bucketsPrefix))
+
+		layout, err := parseBuckets(pair[1])
+		if err != nil {
+			return nil, fmt.Errorf("could not parse the buckets '%s' passed via %s, %v", pair[1], pair[0], err)
+		}
+
+		buckets[name] = layout
+	}
+
+	return buckets, nil
+}
+
+// fileBucketLayouts translates the bucket layouts of the configuration file.
+func fileBucketLayouts(layouts map[string]fileBuckets) (map[string][]float64, error) {
+	buckets := make(map[string][]float64)
+
+	for name, layout := range layouts {
+		var (
+			bounds     []float64
+			err        error
+			generators int
+		)
+
+		if layout.Explicit != nil {
+			bounds, err = explicitBuckets(layout.Explicit)
+			generators++
+		}
+
+		if layout.Exponential != nil {
+			bounds, err = exponentialBuckets(layout.Exponential.Start, layout.Exponential.Factor, layout.Exponential.Count)
+			generators++
+		}
+
+		if layout.Linear != nil {
+			bounds, err = linearBuckets(layout.Linear.Start, layout.Linear.Width, layout.Linear.Count)
+			generators++
+		}
+
+		if generators != 1 {
+			return nil, fmt.Errorf("buckets of %s in the configuration file need exactly one of 'explicit', 'exponential', or 'linear'", name)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("buckets of %s in the configuration file are invalid, %v", name, err)
+		}
+
+		buckets[name] = bounds
+	}
+
+	return buckets, nil
+}
@@ -10,11 +10,17 @@ import (
 	"strconv"
 	"strings"
 	"text/template"
+	"time"
+
+	"github.com/knl/pulley/internal/metrics"
 )
 
 type contextDescriptor struct {
-	Repo    *regexp.Regexp
-	Context *regexp.Regexp
+	Repo     *regexp.Regexp
+	Strategy TimingStrategy
+	Context  *regexp.Regexp // Used iff the strategy is 'aggregate'
+	Contexts []string       // Used iff the strategy is 'required'
+	After    time.Duration  // Used iff the rule is for stuck builds
 }
 
 type TimingStrategy int
@@ -22,10 +28,14 @@ type TimingStrategy int
 const (
 	_ TimingStrategy = iota
 	AggregateStrategy
+	RequiredStrategy
+	ProtectionStrategy
 )
 
 var strategyToString = map[TimingStrategy]string{
-	AggregateStrategy: "aggregate",
+	AggregateStrategy:  "aggregate",
+	RequiredStrategy:   "required",
+	ProtectionStrategy: "protection",
 }
 
 func (ts TimingStrategy) String() string {
@@ -47,42 +57,287 @@ func parseStrategy(in string) (TimingStrategy, error) {
 	return 0, fmt.Errorf("could not translate '%s' into an appropriate strategy (allowed values: %v)", in, allowed)
 }
 
+// OverflowPolicy decides what happens with a webhook when the queue of
+// updates waiting to be processed is full.
+type OverflowPolicy int
+
+const (
+	_ OverflowPolicy = iota
+	BlockPolicy
+	DropNewestPolicy
+	DropOldestPolicy
+	SpillPolicy
+)
+
+var policyToString = map[OverflowPolicy]string{
+	BlockPolicy:      "block",
+	DropNewestPolicy: "drop-newest",
+	DropOldestPolicy: "drop-oldest",
+	SpillPolicy:      "spill",
+}
+
+func (op OverflowPolicy) String() string {
+	return policyToString[op]
+}
+
+func parsePolicy(in string) (OverflowPolicy, error) {
+	for p, ps := range policyToString {
+		if in == ps {
+			return p, nil
+		}
+	}
+
+	allowed := make([]string, 0, len(policyToString))
+	for _, p := range policyToString {
+		allowed = append(allowed, p)
+	}
+
+	return 0, fmt.Errorf("could not translate '%s' into an appropriate overflow policy (allowed values: %v)", in, allowed)
+}
+
+// HistogramType decides which buckets the histograms have, the classic ones
+// with fixed bounds, the native ones that Prometheus scrapes via protobuf, or
+// both.
+type HistogramType int
+
+const (
+	_ HistogramType = iota
+	ClassicHistograms
+	NativeHistograms
+	BothHistograms
+)
+
+var histogramTypeToString = map[HistogramType]string{
+	ClassicHistograms: "classic",
+	NativeHistograms:  "native",
+	BothHistograms:    "both",
+}
+
+func (ht HistogramType) String() string {
+	return histogramTypeToString[ht]
+}
+
+// Classic returns true if the histograms have the classic buckets.
+func (ht HistogramType) Classic() bool {
+	return ht == ClassicHistograms || ht == BothHistograms
+}
+
+// Native returns true if the histograms have the native buckets.
+func (ht HistogramType) Native() bool {
+	return ht == NativeHistograms || ht == BothHistograms
+}
+
+func parseHistogramType(in string) (HistogramType, error) {
+	for ht, hts := range histogramTypeToString {
+		if in == hts {
+			return ht, nil
+		}
+	}
+
+	allowed := make([]string, 0, len(histogramTypeToString))
+	for _, ht := range histogramTypeToString {
+		allowed = append(allowed, ht)
+	}
+
+	return 0, fmt.Errorf("could not translate '%s' into an appropriate histogram type (allowed values: %v)", in, allowed)
+}
+
 type Config struct {
+	File            string         // PULLEY_CONFIG
 	Host            string         // PULLEY_HOST
 	Port            string         // PULLEY_PORT
 	WebhookPath     string         // PULLEY_WEBHOOK_PATH
-	WebhookToken    []byte         // PULLEY_WEBHOOK_TOKEN
+	WebhookTokens   [][]byte       // PULLEY_WEBHOOK_TOKEN, PULLEY_WEBHOOK_TOKEN_<int>, and PULLEY_WEBHOOK_TOKEN_FILE
 	Strategy        TimingStrategy // PULLEY_PR_TIMING_STRATEGY
 	MetricsPath     string         // PULLEY_METRICS_PATH
 	TrackBuildTimes bool           // PULLEY_TRACK_BUILD_TIMES
-	// Used iff the strategy is 'aggregate'
-	AggregateStrategyContexts []contextDescriptor // PULLEY_STRATEGY_AGGREGATE_REPO_REGEX_<int> = repo_regex && PULLEY_STRATEGY_AGGREGATE_CONTEXT_REGEX_<int> = regex
+	SHATTL          time.Duration  // PULLEY_SHA_TTL
+	MaxSHAs         int            // PULLEY_MAX_SHAS
+	// Where and how often the state gets persisted
+	SnapshotPath     string        // PULLEY_SNAPSHOT_PATH
+	SnapshotInterval time.Duration // PULLEY_SNAPSHOT_INTERVAL
+	ShutdownTimeout  time.Duration // PULLEY_SHUTDOWN_TIMEOUT
+	// How webhooks are queued for processing
+	QueueSize      int            // PULLEY_QUEUE_SIZE
+	QueuePolicy    OverflowPolicy // PULLEY_QUEUE_POLICY
+	QueueTimeout   time.Duration  // PULLEY_QUEUE_TIMEOUT
+	QueueSpillPath string         // PULLEY_QUEUE_SPILL_PATH
+	// How long, and how many, webhook deliveries are remembered to ignore redeliveries
+	DedupWindow time.Duration // PULLEY_DEDUP_WINDOW
+	DedupSize   int           // PULLEY_DEDUP_SIZE
+	// Where validated webhooks are archived, and how large an archive file can grow
+	ArchivePath    string // PULLEY_ARCHIVE_PATH
+	ArchiveMaxSize int    // PULLEY_ARCHIVE_MAX_SIZE
+	// Where the configuration can be reloaded, authenticated with a bearer token
+	AdminPath  string // PULLEY_ADMIN_PATH
+	AdminToken string // PULLEY_ADMIN_TOKEN
+	// How to query GitHub's API, for the protection strategy
+	GithubAPIURL      string        // PULLEY_GITHUB_API_URL
+	GithubAPIToken    string        // PULLEY_GITHUB_API_TOKEN
+	ProtectionRefresh time.Duration // PULLEY_PROTECTION_REFRESH
+	// Which status checks tell that a PR is broken, per repository
+	FailFastRules []contextDescriptor // PULLEY_FAIL_FAST_REPO_REGEX_<int> = repo_regex && PULLEY_FAIL_FAST_CONTEXT_REGEX_<int> = regex
+	// When pending status checks are stuck, per repository and status check
+	StuckRules    []contextDescriptor // PULLEY_STUCK_REPO_REGEX_<int> = repo_regex && PULLEY_STUCK_CONTEXT_REGEX_<int> = regex && PULLEY_STUCK_AFTER_<int> = duration
+	StuckInterval time.Duration       // PULLEY_STUCK_INTERVAL
+	StuckLog      bool                // PULLEY_STUCK_LOG
+	// The upper bounds of the buckets, per histogram name, the rest keep theirs
+	Buckets map[string][]float64 // PULLEY_BUCKETS_<upper case histogram name> = bounds, or exponential:start,factor,count, or linear:start,width,count
+	// Whether the histograms have the classic buckets, the native ones, or both
+	HistogramType      HistogramType // PULLEY_HISTOGRAMS
+	NativeBucketFactor float64       // PULLEY_NATIVE_BUCKET_FACTOR
+	NativeMaxBuckets   int           // PULLEY_NATIVE_MAX_BUCKETS
+	// How many distinct repositories and builds get their own series, the rest
+	// are reported as "other"
+	MaxRepositories int               // PULLEY_MAX_REPOSITORIES
+	MaxBuilds       int               // PULLEY_MAX_BUILDS
+	BuildRewrites   []metrics.Rewrite // PULLEY_BUILD_REWRITE_REGEX_<int> = regex && PULLEY_BUILD_REWRITE_REPLACEMENT_<int> = replacement
+	// Which status checks validate a PR, per repository
+	Rules []contextDescriptor // PULLEY_STRATEGY_AGGREGATE_REPO_REGEX_<int> = repo_regex && PULLEY_STRATEGY_AGGREGATE_CONTEXT_REGEX_<int> = regex, or PULLEY_STRATEGY_REQUIRED_REPO_REGEX_<int> = repo_regex && PULLEY_STRATEGY_REQUIRED_CONTEXTS_<int> = context,...
 }
 
 func DefaultConfig() *Config {
 	var descriptors []contextDescriptor
 	descriptors = append(descriptors, contextDescriptor{
+		Repo:     regexp.MustCompile(".*"),
+		Strategy: AggregateStrategy,
+		Context:  regexp.MustCompile(":all-jobs$"),
+	})
+
+	// Any failure breaks a PR
+	var failFast []contextDescriptor
+	failFast = append(failFast, contextDescriptor{
 		Repo:    regexp.MustCompile(".*"),
-		Context: regexp.MustCompile(":all-jobs$"),
+		Context: regexp.MustCompile(".*"),
 	})
 
 	return &Config{
-		Host:                      "localhost",
-		Port:                      "1701",
-		WebhookPath:               "",
-		WebhookToken:              make([]byte, 0),
-		Strategy:                  AggregateStrategy,
-		AggregateStrategyContexts: descriptors,
-		MetricsPath:               "metrics",
-		TrackBuildTimes:           false,
+		Host:             "localhost",
+		Port:             "1701",
+		WebhookPath:      "",
+		WebhookTokens:    make([][]byte, 0),
+		Strategy:         AggregateStrategy,
+		Rules:            descriptors,
+		FailFastRules:    failFast,
+		MetricsPath:      "metrics",
+		TrackBuildTimes:  false,
+		SHATTL:           0,
+		MaxSHAs:          0,
+		SnapshotPath:     "",
+		SnapshotInterval: time.Minute,
+		ShutdownTimeout:  30 * time.Second,
+		QueueSize:        100,
+		QueuePolicy:      BlockPolicy,
+		QueueTimeout:     0,
+		QueueSpillPath:   "",
+		DedupWindow:      72 * time.Hour,
+		DedupSize:        100000,
+		ArchivePath:      "",
+		ArchiveMaxSize:   100 * 1024 * 1024,
+		AdminPath:        "admin",
+		AdminToken:       "",
+
+		GithubAPIURL:      "",
+		GithubAPIToken:    "",
+		ProtectionRefresh: 10 * time.Minute,
+
+		StuckRules:    nil,
+		StuckInterval: time.Minute,
+		StuckLog:      false,
+
+		Buckets: nil,
+
+		HistogramType:      ClassicHistograms,
+		NativeBucketFactor: 1.1,
+		NativeMaxBuckets:   160,
+
+		MaxRepositories: 0,
+		MaxBuilds:       0,
+		BuildRewrites:   nil,
 	}
 }
 
+// ContextChecker tells if the status check alone validates PRs in the
+// repository.
 type ContextChecker func(repo, context string) bool
 
+// RequiredContexts returns the status checks that all need to finish to
+// validate PRs into the branch of the repository, or nil if that is not how
+// they are validated. The branch is empty if not known.
+type RequiredContexts func(repo, branch string) []string
+
+// StuckThreshold returns how long the status check can be pending in the
+// repository, before it is stuck, or 0 if it is never stuck.
+type StuckThreshold func(repo, context string) time.Duration
+
+// Checkers tell the MetricsProcessor which status checks validate a PR.
+type Checkers struct {
+	Aggregate ContextChecker
+	Required  RequiredContexts
+	FailFast  ContextChecker // Whether a failure of the status check breaks the PR
+	Stuck     StuckThreshold
+}
+
+// rule returns the first rule matching the repository.
+func (config *Config) rule(repo string) (contextDescriptor, bool) {
+	for _, entry := range config.Rules {
+		if entry.Repo.MatchString(repo) {
+			return entry, true
+		}
+	}
+
+	return contextDescriptor{}, false
+}
+
+func (config *Config) hasRule(strategy TimingStrategy) bool {
+	for _, entry := range config.Rules {
+		if entry.Strategy == strategy {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (config *Config) DefaultContextChecker() ContextChecker {
 	return func(repo, context string) bool {
-		for _, entry := range config.AggregateStrategyContexts {
+		entry, ok := config.rule(repo)
+		if !ok || entry.Strategy != AggregateStrategy {
+			return false
+		}
+
+		return entry.Context.MatchString(context)
+	}
+}
+
+// DefaultRequiredContexts uses protected to look up the status checks required
+// by the branch protection, for the repositories using the protection
+// strategy.
+func (config *Config) DefaultRequiredContexts(protected RequiredContexts) RequiredContexts {
+	return func(repo, branch string) []string {
+		entry, ok := config.rule(repo)
+		if !ok {
+			return nil
+		}
+
+		switch entry.Strategy {
+		case RequiredStrategy:
+			return entry.Contexts
+		case ProtectionStrategy:
+			if protected == nil {
+				return nil
+			}
+
+			return protected(repo, branch)
+		default:
+			return nil
+		}
+	}
+}
+
+func (config *Config) DefaultFailFastChecker() ContextChecker {
+	return func(repo, context string) bool {
+		for _, entry := range config.FailFastRules {
 			if entry.Repo.MatchString(repo) {
 				return entry.Context.MatchString(context)
 			}
@@ -92,63 +347,345 @@ func (config *Config) DefaultContextChecker() ContextChecker {
 	}
 }
 
+// GithubWebURL returns the address of GitHub's web UI, for the API used.
+func (config *Config) GithubWebURL() string {
+	if config.GithubAPIURL == "" {
+		return "https://github.com/"
+	}
+
+	// GitHub Enterprise serves the API under /api/v3/
+	return strings.TrimSuffix(strings.TrimSuffix(config.GithubAPIURL, "/"), "/api/v3") + "/"
+}
+
+// DefaultStuckThreshold uses the first stuck rule matching both the repository
+// and the status check.
+func (config *Config) DefaultStuckThreshold() StuckThreshold {
+	return func(repo, context string) time.Duration {
+		for _, entry := range config.StuckRules {
+			if entry.Repo.MatchString(repo) && entry.Context.MatchString(context) {
+				return entry.After
+			}
+		}
+
+		return 0
+	}
+}
+
+func (config *Config) DefaultCheckers(protected RequiredContexts) Checkers {
+	return Checkers{
+		Aggregate: config.DefaultContextChecker(),
+		Required:  config.DefaultRequiredContexts(protected),
+		FailFast:  config.DefaultFailFastChecker(),
+		Stuck:     config.DefaultStuckThreshold(),
+	}
+}
+
 const (
+	tokenPrefix   = "PULLEY_WEBHOOK_TOKEN_"
+	tokenFileEnv  = "PULLEY_WEBHOOK_TOKEN_FILE"
 	repoPrefix    = "PULLEY_STRATEGY_AGGREGATE_REPO_REGEX_"
 	contextPrefix = "PULLEY_STRATEGY_AGGREGATE_CONTEXT_REGEX_"
+
+	requiredRepoPrefix     = "PULLEY_STRATEGY_REQUIRED_REPO_REGEX_"
+	requiredContextsPrefix = "PULLEY_STRATEGY_REQUIRED_CONTEXTS_"
+
+	failFastRepoPrefix    = "PULLEY_FAIL_FAST_REPO_REGEX_"
+	failFastContextPrefix = "PULLEY_FAIL_FAST_CONTEXT_REGEX_"
+
+	stuckRepoPrefix    = "PULLEY_STUCK_REPO_REGEX_"
+	stuckContextPrefix = "PULLEY_STUCK_CONTEXT_REGEX_"
+	stuckAfterPrefix   = "PULLEY_STUCK_AFTER_"
+
+	buildRewriteRegexPrefix       = "PULLEY_BUILD_REWRITE_REGEX_"
+	buildRewriteReplacementPrefix = "PULLEY_BUILD_REWRITE_REPLACEMENT_"
 )
 
-func processAggregateStrategyContexts() ([]contextDescriptor, error) {
-	// Process all PULLEY_REGEX_TIMING_<int> fields
-	aggregateStrategyContexts := make(map[uint64]contextDescriptor)
+// processWebhookTokens collects all the accepted webhook secret tokens. The
+// token from PULLEY_WEBHOOK_TOKEN comes first, followed by the ones from
+// PULLEY_WEBHOOK_TOKEN_<int>, in order, and the ones from the file
+// PULLEY_WEBHOOK_TOKEN_FILE, one per line.
+func processWebhookTokens() ([][]byte, error) {
+	webhookTokens := make([][]byte, 0)
 
-	for _, e := range os.Environ() {
-		pair := strings.SplitN(e, "=", 2)
-		if strings.HasPrefix(pair[0], repoPrefix) {
-			entryID, err := strconv.ParseUint(strings.TrimPrefix(pair[0], repoPrefix), 10, 64)
-			if err != nil {
-				return nil, fmt.Errorf("environment variable '%s' is not properly formatted, doesn't end with a positive integer, err=%v", pair[0], err)
-			}
+	webhookToken, err := base64.StdEncoding.DecodeString(os.Getenv("PULLEY_WEBHOOK_TOKEN"))
+	if err != nil {
+		return nil, fmt.Errorf("could not decode the webhook secret token from PULLEY_WEBHOOK_TOKEN, %v", err)
+	}
 
-			contextEnvName := fmt.Sprintf("%s%d", contextPrefix, entryID)
+	if len(webhookToken) != 0 {
+		webhookTokens = append(webhookTokens, webhookToken)
+	}
 
-			contextEnv := os.Getenv(contextEnvName)
-			if contextEnv == "" {
-				return nil, fmt.Errorf("variable '%s' empty or unset", contextEnvName)
-			}
+	numbered := make(map[uint64][]byte)
 
-			repoRegexp, err := regexp.Compile(pair[1])
-			if err != nil {
-				return nil, fmt.Errorf("could not compile the repository name regex '%s' passed via %s, err=%v", repoRegexp, pair[0], err)
-			}
+	for _, e := range os.Environ() {
+		pair := strings.SplitN(e, "=", 2)
+		if !strings.HasPrefix(pair[0], tokenPrefix) || pair[0] == tokenFileEnv {
+			continue
+		}
 
-			contextRegexp, err := regexp.Compile(contextEnv)
-			if err != nil {
-				return nil, fmt.Errorf("could not compile the status check name regex '%s' passed via %s, err=%v", contextRegexp, contextEnv, err)
-			}
+		entryID, err := strconv.ParseUint(strings.TrimPrefix(pair[0], tokenPrefix), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("environment variable '%s' is not properly formatted, doesn't end with a positive integer, err=%v", pair[0], err)
+		}
 
-			aggregateStrategyContexts[entryID] = contextDescriptor{
-				Repo:    repoRegexp,
-				Context: contextRegexp,
-			}
+		token, err := base64.StdEncoding.DecodeString(pair[1])
+		if err != nil {
+			return nil, fmt.Errorf("could not decode the webhook secret token from %s, %v", pair[0], err)
 		}
+
+		numbered[entryID] = token
 	}
 
-	// Sort them by priority
 	var keys []uint64
-	for k := range aggregateStrategyContexts {
+	for k := range numbered {
 		keys = append(keys, k)
 	}
 
 	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
 
-	var descriptors []contextDescriptor
 	for _, k := range keys {
-		descriptors = append(descriptors, aggregateStrategyContexts[k])
+		if len(numbered[k]) != 0 {
+			webhookTokens = append(webhookTokens, numbered[k])
+		}
+	}
+
+	tokenFile, ok := os.LookupEnv(tokenFileEnv)
+	if !ok {
+		return webhookTokens, nil
+	}
+
+	fileTokens, err := readTokenFile(tokenFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(webhookTokens, fileTokens...), nil
+}
+
+// readTokenFile reads base64 encoded webhook secret tokens from path, one per
+// line.
+func readTokenFile(path string) ([][]byte, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the webhook secret tokens from %s, %v", path, err)
+	}
+
+	var webhookTokens [][]byte
+
+	// Empty lines and comments are allowed, to ease managing the file
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		token, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			return nil, fmt.Errorf("could not decode the webhook secret token on line %d of %s, %v", i+1, path, err)
+		}
+
+		webhookTokens = append(webhookTokens, token)
+	}
+
+	return webhookTokens, nil
+}
+
+func processAggregateStrategyContexts(strategy TimingStrategy) ([]contextDescriptor, error) {
+	return processContextRegexes(repoPrefix, contextPrefix, strategy)
+}
+
+// numberedVariable is a variable whose name ends with an <int>, which gives
+// its priority.
+type numberedVariable struct {
+	ID    uint64
+	Name  string
+	Value string
+}
+
+// numberedVariables returns the <prefix><int> variables, sorted by priority.
+func numberedVariables(prefix string) ([]numberedVariable, error) {
+	var variables []numberedVariable
+
+	for _, e := range os.Environ() {
+		pair := strings.SplitN(e, "=", 2)
+		if !strings.HasPrefix(pair[0], prefix) {
+			continue
+		}
+
+		entryID, err := strconv.ParseUint(strings.TrimPrefix(pair[0], prefix), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("environment variable '%s' is not properly formatted, doesn't end with a positive integer, err=%v", pair[0], err)
+		}
+
+		variables = append(variables, numberedVariable{entryID, pair[0], pair[1]})
+	}
+
+	// Sort them by priority
+	sort.Slice(variables, func(i, j int) bool { return variables[i].ID < variables[j].ID })
+
+	return variables, nil
+}
+
+// processContextRegexes processes all the <repoPrefix><int> and
+// <contextPrefix><int> pairs of regexes, in order of priority.
+func processContextRegexes(repoPrefix, contextPrefix string, strategy TimingStrategy) ([]contextDescriptor, error) {
+	repos, err := numberedVariables(repoPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var descriptors []contextDescriptor
+
+	for _, repo := range repos {
+		contextEnvName := fmt.Sprintf("%s%d", contextPrefix, repo.ID)
+
+		contextEnv := os.Getenv(contextEnvName)
+		if contextEnv == "" {
+			return nil, fmt.Errorf("variable '%s' empty or unset", contextEnvName)
+		}
+
+		repoRegexp, err := regexp.Compile(repo.Value)
+		if err != nil {
+			return nil, fmt.Errorf("could not compile the repository name regex '%s' passed via %s, err=%v", repo.Value, repo.Name, err)
+		}
+
+		contextRegexp, err := regexp.Compile(contextEnv)
+		if err != nil {
+			return nil, fmt.Errorf("could not compile the status check name regex '%s' passed via %s, err=%v", contextEnv, contextEnvName, err)
+		}
+
+		descriptors = append(descriptors, contextDescriptor{
+			Repo:     repoRegexp,
+			Strategy: strategy,
+			Context:  contextRegexp,
+		})
 	}
 
 	return descriptors, nil
 }
 
+// splitContexts splits a comma separated list of status check names.
+func splitContexts(in string) []string {
+	var contexts []string
+
+	for _, context := range strings.Split(in, ",") {
+		if context = strings.TrimSpace(context); context != "" {
+			contexts = append(contexts, context)
+		}
+	}
+
+	return contexts
+}
+
+func processRequiredStrategyContexts() ([]contextDescriptor, error) {
+	// Process all PULLEY_STRATEGY_REQUIRED_REPO_REGEX_<int> fields
+	repos, err := numberedVariables(requiredRepoPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var descriptors []contextDescriptor
+
+	for _, repo := range repos {
+		contextsEnvName := fmt.Sprintf("%s%d", requiredContextsPrefix, repo.ID)
+
+		contexts := splitContexts(os.Getenv(contextsEnvName))
+		if len(contexts) == 0 {
+			return nil, fmt.Errorf("variable '%s' empty or unset", contextsEnvName)
+		}
+
+		repoRegexp, err := regexp.Compile(repo.Value)
+		if err != nil {
+			return nil, fmt.Errorf("could not compile the repository name regex '%s' passed via %s, err=%v", repo.Value, repo.Name, err)
+		}
+
+		descriptors = append(descriptors, contextDescriptor{
+			Repo:     repoRegexp,
+			Strategy: RequiredStrategy,
+			Contexts: contexts,
+		})
+	}
+
+	return descriptors, nil
+}
+
+func processStuckRules() ([]contextDescriptor, error) {
+	// Process all PULLEY_STUCK_REPO_REGEX_<int> fields
+	repos, err := numberedVariables(stuckRepoPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var descriptors []contextDescriptor
+
+	for _, repo := range repos {
+		contextEnvName := fmt.Sprintf("%s%d", stuckContextPrefix, repo.ID)
+
+		contextEnv := os.Getenv(contextEnvName)
+		if contextEnv == "" {
+			return nil, fmt.Errorf("variable '%s' empty or unset", contextEnvName)
+		}
+
+		afterEnvName := fmt.Sprintf("%s%d", stuckAfterPrefix, repo.ID)
+
+		after, err := time.ParseDuration(os.Getenv(afterEnvName))
+		if err != nil || after <= 0 {
+			return nil, fmt.Errorf("variable '%s' is not a positive duration, got '%s'", afterEnvName, os.Getenv(afterEnvName))
+		}
+
+		repoRegexp, err := regexp.Compile(repo.Value)
+		if err != nil {
+			return nil, fmt.Errorf("could not compile the repository name regex '%s' passed via %s, err=%v", repo.Value, repo.Name, err)
+		}
+
+		contextRegexp, err := regexp.Compile(contextEnv)
+		if err != nil {
+			return nil, fmt.Errorf("could not compile the status check name regex '%s' passed via %s, err=%v", contextEnv, contextEnvName, err)
+		}
+
+		descriptors = append(descriptors, contextDescriptor{
+			Repo:    repoRegexp,
+			Context: contextRegexp,
+			After:   after,
+		})
+	}
+
+	return descriptors, nil
+}
+
+func processBuildRewrites() ([]metrics.Rewrite, error) {
+	// Process all PULLEY_BUILD_REWRITE_REGEX_<int> fields
+	regexes, err := numberedVariables(buildRewriteRegexPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var rewrites []metrics.Rewrite
+
+	for _, regex := range regexes {
+		// The replacement can be empty, to drop the match
+		replacementEnvName := fmt.Sprintf("%s%d", buildRewriteReplacementPrefix, regex.ID)
+
+		replacement, ok := os.LookupEnv(replacementEnvName)
+		if !ok {
+			return nil, fmt.Errorf("variable '%s' unset", replacementEnvName)
+		}
+
+		compiled, err := regexp.Compile(regex.Value)
+		if err != nil {
+			return nil, fmt.Errorf("could not compile the build name regex '%s' passed via %s, err=%v", regex.Value, regex.Name, err)
+		}
+
+		rewrites = append(rewrites, metrics.Rewrite{
+			Regex:       compiled,
+			Replacement: replacement,
+		})
+	}
+
+	return rewrites, nil
+}
+
 func configStrategies(config *Config) (*Config, error) {
 	strategyString, ok := os.LookupEnv("PULLEY_PR_TIMING_STRATEGY")
 	if ok {
@@ -158,31 +695,112 @@ func configStrategies(config *Config) (*Config, error) {
 		}
 
 		config.Strategy = s
-	} else {
-		config.Strategy = AggregateStrategy
 	}
 
 	switch config.Strategy {
 	case AggregateStrategy:
-		aggregateStrategyContexts, err := processAggregateStrategyContexts()
+		aggregateStrategyContexts, err := processAggregateStrategyContexts(config.Strategy)
 		if err != nil {
 			return nil, err
 		}
 
 		if len(aggregateStrategyContexts) != 0 {
-			config.AggregateStrategyContexts = aggregateStrategyContexts
+			config.Rules = aggregateStrategyContexts
+		}
+	case RequiredStrategy:
+		requiredStrategyContexts, err := processRequiredStrategyContexts()
+		if err != nil {
+			return nil, err
+		}
+
+		if len(requiredStrategyContexts) != 0 {
+			config.Rules = requiredStrategyContexts
+		}
+
+		// The default rule only makes sense for the aggregate strategy
+		if !config.hasRule(RequiredStrategy) {
+			return nil, fmt.Errorf("the '%s' strategy needs %s<int> and %s<int> to be set", RequiredStrategy, requiredRepoPrefix, requiredContextsPrefix)
+		}
+	case ProtectionStrategy:
+		// Unless the configuration file says otherwise, all repositories are protected
+		if !config.hasRule(ProtectionStrategy) {
+			config.Rules = []contextDescriptor{{
+				Repo:     regexp.MustCompile(".*"),
+				Strategy: ProtectionStrategy,
+			}}
 		}
 	default:
 		return nil, fmt.Errorf("broken configuration, unrecognized strategy '%s'", config.Strategy.String())
 	}
 
+	if config.hasRule(ProtectionStrategy) && config.GithubAPIToken == "" {
+		return nil, fmt.Errorf("the '%s' strategy needs PULLEY_GITHUB_API_TOKEN to be set", ProtectionStrategy)
+	}
+
 	return config, nil
 }
 
-// Setup configurations with environment variables.
+// lookupDuration sets target to the non-negative duration from the environment
+// variable name, if it is set.
+func lookupDuration(name string, target *time.Duration) error {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("could not parse %s '%s' as a duration, %v", name, value, err)
+	}
+
+	if d < 0 {
+		return fmt.Errorf("%s must not be negative, got '%s'", name, value)
+	}
+
+	*target = d
+
+	return nil
+}
+
+// lookupCount sets target to the non-negative integer from the environment
+// variable name, if it is set.
+func lookupCount(name string, target *int) error {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("could not parse %s '%s' as an integer, %v", name, value, err)
+	}
+
+	if n < 0 {
+		return fmt.Errorf("%s must not be negative, got '%s'", name, value)
+	}
+
+	*target = n
+
+	return nil
+}
+
+// Setup configurations with the file from PULLEY_CONFIG, if set, and
+// environment variables.
 func Setup() (*Config, error) {
+	return Load(os.Getenv("PULLEY_CONFIG"))
+}
+
+// Load configurations with the file at path, if not empty, and environment
+// variables, which override the values from the file.
+func Load(path string) (*Config, error) {
 	config := DefaultConfig()
 
+	if path != "" {
+		if err := applyFile(config, path); err != nil {
+			return nil, err
+		}
+	}
+
 	host, ok := os.LookupEnv("PULLEY_HOST")
 	if ok {
 		config.Host = host
@@ -198,12 +816,14 @@ func Setup() (*Config, error) {
 		config.WebhookPath = webhookPath
 	}
 
-	webhookToken, err := base64.StdEncoding.DecodeString(os.Getenv("PULLEY_WEBHOOK_TOKEN"))
+	webhookTokens, err := processWebhookTokens()
 	if err != nil {
-		return nil, fmt.Errorf("could not decode the webhook secret token from PULLEY_WEBHOOK_TOKEN, %v", err)
+		return nil, err
 	}
 
-	config.WebhookToken = webhookToken
+	if len(webhookTokens) != 0 {
+		config.WebhookTokens = webhookTokens
+	}
 
 	metricsPath, ok := os.LookupEnv("PULLEY_METRICS_PATH")
 	if ok {
@@ -214,25 +834,274 @@ func Setup() (*Config, error) {
 		config.TrackBuildTimes = b
 	}
 
+	if err := lookupDuration("PULLEY_SHA_TTL", &config.SHATTL); err != nil {
+		return nil, err
+	}
+
+	if err := lookupCount("PULLEY_MAX_SHAS", &config.MaxSHAs); err != nil {
+		return nil, err
+	}
+
+	snapshotPath, ok := os.LookupEnv("PULLEY_SNAPSHOT_PATH")
+	if ok {
+		config.SnapshotPath = snapshotPath
+	}
+
+	if err := lookupDuration("PULLEY_SNAPSHOT_INTERVAL", &config.SnapshotInterval); err != nil {
+		return nil, err
+	}
+
+	if err := lookupDuration("PULLEY_SHUTDOWN_TIMEOUT", &config.ShutdownTimeout); err != nil {
+		return nil, err
+	}
+
+	if err := configQueue(config); err != nil {
+		return nil, err
+	}
+
+	if err := lookupDuration("PULLEY_DEDUP_WINDOW", &config.DedupWindow); err != nil {
+		return nil, err
+	}
+
+	if err := lookupCount("PULLEY_DEDUP_SIZE", &config.DedupSize); err != nil {
+		return nil, err
+	}
+
+	archivePath, ok := os.LookupEnv("PULLEY_ARCHIVE_PATH")
+	if ok {
+		config.ArchivePath = archivePath
+	}
+
+	if err := lookupCount("PULLEY_ARCHIVE_MAX_SIZE", &config.ArchiveMaxSize); err != nil {
+		return nil, err
+	}
+
+	adminPath, ok := os.LookupEnv("PULLEY_ADMIN_PATH")
+	if ok {
+		config.AdminPath = adminPath
+	}
+
+	adminToken, ok := os.LookupEnv("PULLEY_ADMIN_TOKEN")
+	if ok {
+		config.AdminToken = adminToken
+	}
+
+	githubAPIURL, ok := os.LookupEnv("PULLEY_GITHUB_API_URL")
+	if ok {
+		config.GithubAPIURL = githubAPIURL
+	}
+
+	githubAPIToken, ok := os.LookupEnv("PULLEY_GITHUB_API_TOKEN")
+	if ok {
+		config.GithubAPIToken = githubAPIToken
+	}
+
+	if err := lookupDuration("PULLEY_PROTECTION_REFRESH", &config.ProtectionRefresh); err != nil {
+		return nil, err
+	}
+
+	// Otherwise, every lookup of the required status checks calls the API again
+	if config.ProtectionRefresh <= 0 {
+		return nil, fmt.Errorf("PULLEY_PROTECTION_REFRESH needs to be positive, got %s", config.ProtectionRefresh)
+	}
+
+	failFastRules, err := processContextRegexes(failFastRepoPrefix, failFastContextPrefix, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(failFastRules) != 0 {
+		config.FailFastRules = failFastRules
+	}
+
+	if err := configStuck(config); err != nil {
+		return nil, err
+	}
+
+	buckets, err := processBuckets()
+	if err != nil {
+		return nil, err
+	}
+
+	// Each histogram is overridden on its own
+	for name, bounds := range buckets {
+		if config.Buckets == nil {
+			config.Buckets = make(map[string][]float64)
+		}
+
+		config.Buckets[name] = bounds
+	}
+
+	if err := configHistograms(config); err != nil {
+		return nil, err
+	}
+
+	if err := configLabels(config); err != nil {
+		return nil, err
+	}
+
 	return configStrategies(config)
 }
 
+func configStuck(config *Config) error {
+	stuckRules, err := processStuckRules()
+	if err != nil {
+		return err
+	}
+
+	if len(stuckRules) != 0 {
+		config.StuckRules = stuckRules
+	}
+
+	if err := lookupDuration("PULLEY_STUCK_INTERVAL", &config.StuckInterval); err != nil {
+		return err
+	}
+
+	if b, err := strconv.ParseBool(os.Getenv("PULLEY_STUCK_LOG")); err == nil {
+		config.StuckLog = b
+	}
+
+	return nil
+}
+
+func configHistograms(config *Config) error {
+	histogramsString, ok := os.LookupEnv("PULLEY_HISTOGRAMS")
+	if ok {
+		ht, err := parseHistogramType(histogramsString)
+		if err != nil {
+			return err
+		}
+
+		config.HistogramType = ht
+	}
+
+	factorString, ok := os.LookupEnv("PULLEY_NATIVE_BUCKET_FACTOR")
+	if ok {
+		factor, err := strconv.ParseFloat(factorString, 64)
+		if err != nil {
+			return fmt.Errorf("could not parse PULLEY_NATIVE_BUCKET_FACTOR '%s' as a number, %v", factorString, err)
+		}
+
+		config.NativeBucketFactor = factor
+	}
+
+	if err := lookupCount("PULLEY_NATIVE_MAX_BUCKETS", &config.NativeMaxBuckets); err != nil {
+		return err
+	}
+
+	if config.HistogramType.Native() && config.NativeBucketFactor <= 1 {
+		return fmt.Errorf("the native histograms need a bucket factor greater than 1, got %v", config.NativeBucketFactor)
+	}
+
+	if !config.HistogramType.Classic() && len(config.Buckets) != 0 {
+		return fmt.Errorf("buckets are given, but the '%s' histograms have no classic buckets", config.HistogramType)
+	}
+
+	return nil
+}
+
+func configLabels(config *Config) error {
+	if err := lookupCount("PULLEY_MAX_REPOSITORIES", &config.MaxRepositories); err != nil {
+		return err
+	}
+
+	if err := lookupCount("PULLEY_MAX_BUILDS", &config.MaxBuilds); err != nil {
+		return err
+	}
+
+	buildRewrites, err := processBuildRewrites()
+	if err != nil {
+		return err
+	}
+
+	if len(buildRewrites) != 0 {
+		config.BuildRewrites = buildRewrites
+	}
+
+	return nil
+}
+
+func configQueue(config *Config) error {
+	if err := lookupCount("PULLEY_QUEUE_SIZE", &config.QueueSize); err != nil {
+		return err
+	}
+
+	policyString, ok := os.LookupEnv("PULLEY_QUEUE_POLICY")
+	if ok {
+		p, err := parsePolicy(policyString)
+		if err != nil {
+			return err
+		}
+
+		config.QueuePolicy = p
+	}
+
+	if err := lookupDuration("PULLEY_QUEUE_TIMEOUT", &config.QueueTimeout); err != nil {
+		return err
+	}
+
+	spillPath, ok := os.LookupEnv("PULLEY_QUEUE_SPILL_PATH")
+	if ok {
+		config.QueueSpillPath = spillPath
+	}
+
+	if config.QueuePolicy == SpillPolicy && config.QueueSpillPath == "" {
+		return fmt.Errorf("the '%s' queue policy needs PULLEY_QUEUE_SPILL_PATH to be set", SpillPolicy)
+	}
+
+	// Without a queue, there is never an oldest update to drop to make room
+	if config.QueuePolicy == DropOldestPolicy && config.QueueSize == 0 {
+		return fmt.Errorf("the '%s' queue policy needs PULLEY_QUEUE_SIZE to be positive", DropOldestPolicy)
+	}
+
+	return nil
+}
+
 var configOutputTmpl = `
 pulley is starting with the following configuration:
+  File:            {{with .File}}{{.}}{{else}}<none>{{end}}
   Host:            {{.Host}}
   Port:            {{.Port}}
   MetricsPath:     /{{.MetricsPath}}
   WebhookPath:     /{{.WebhookPath}}
-  WebhookToken:    {{with .WebhookToken}}{{printf "%+.4q" .| dequote}}...{{else}}<empty>{{end}}
+  WebhookTokens:   {{range $i, $t := .WebhookTokens}}{{if $i}}, {{end}}#{{$i}} {{printf "%+.4q" $t | dequote}}...{{else}}<empty>{{end}}
   TrackBuildTimes: {{.TrackBuildTimes}}
+  SHATTL:          {{with .SHATTL}}{{.}}{{else}}<disabled>{{end}}
+  MaxSHAs:         {{with .MaxSHAs}}{{.}}{{else}}<unlimited>{{end}}
+  Snapshot:        {{with .SnapshotPath}}{{.}} every {{$.SnapshotInterval}}{{else}}<disabled>{{end}}
+  ShutdownTimeout: {{.ShutdownTimeout}}
+  Deduplication:   {{if and .DedupWindow .DedupSize}}up to {{.DedupSize}} deliveries within {{.DedupWindow}}{{else}}<disabled>{{end}}
+  Archive:         {{with .ArchivePath}}{{.}}{{with $.ArchiveMaxSize}}, rotated at {{.}} bytes{{end}}{{else}}<disabled>{{end}}
+  Reload:          {{if .AdminToken}}SIGHUP and POST /{{.AdminPath}}/reload{{else}}SIGHUP{{end}}
+  Queue:           {{.QueueSize}} updates, {{.QueuePolicy}}{{if eq .QueuePolicy.String "block"}}{{with .QueueTimeout}} for up to {{.}}{{end}}{{end}}{{if eq .QueuePolicy.String "spill"}} to {{.QueueSpillPath}}{{end}}
+  GitHubAPI:       {{with .GithubAPIURL}}{{.}}{{else}}https://api.github.com/{{end}}{{if .GithubAPIToken}} (authenticated){{end}}, protection refreshed every {{.ProtectionRefresh}}
+  Histograms:      {{.HistogramType}}{{if .HistogramType.Native}}, native buckets growing by {{.NativeBucketFactor}}{{with .NativeMaxBuckets}}, up to {{.}} of them{{end}}{{end}}
+  Labels:          {{with .MaxRepositories}}up to {{.}}{{else}}unlimited{{end}} repositories, {{with .MaxBuilds}}up to {{.}}{{else}}unlimited{{end}} builds{{range .BuildRewrites}}
+   - build:    {{.Regex}} -> {{printf "%q" .Replacement}}{{end}}
+  Buckets:{{range $name, $bounds := .Buckets}}
+   - {{$name}}: {{$bounds}}{{else}}         <default>{{end}}
   Strategy:        {{.Strategy}}
-  {{template "aggregate" .AggregateStrategyContexts}}
+  {{template "rules" .Rules}}  {{template "failfast" .FailFastRules}}  {{template "stuck" .}}
 `
 
-var aggregateOutputTmpl = `
-{{define "aggregate"}}Aggregate Strategy configuration:{{range .}}
-   - repo:    {{.Repo}}
-     context: {{.Context}}
+var rulesOutputTmpl = `
+{{define "failfast"}}Fail-fast rules:{{range .}}
+   - repo:     {{.Repo}}
+     context:  {{.Context}}
+  {{end}}
+{{end}}
+{{define "stuck"}}Stuck rules:{{range .StuckRules}}
+   - repo:     {{.Repo}}
+     context:  {{.Context}}
+     after:    {{.After}}
+  {{else}} <disabled>
+  {{end}}{{if .StuckRules}}  swept every {{.StuckInterval}}{{if .StuckLog}}, logged{{end}}
+{{end}}
+{{end}}
+{{define "rules"}}Repository rules:{{range .}}
+   - repo:     {{.Repo}}
+     strategy: {{.Strategy}}
+     {{if .Context}}context:  {{.Context}}{{else if .Contexts}}contexts: {{join .Contexts ", "}}{{else}}contexts: <from the branch protection>{{end}}
   {{end}}
 {{end}}
 `
@@ -243,11 +1112,12 @@ func (config *Config) Print() (string, error) {
 		"dequote": func(s string) string {
 			return strings.Trim(s, `"`)
 		},
+		"join": strings.Join,
 	}).Parse(configOutputTmpl))
 
-	_, err := t.Parse(aggregateOutputTmpl)
+	_, err := t.Parse(rulesOutputTmpl)
 	if err != nil {
-		return "", fmt.Errorf("problem parsing aggregate configuration: %s", err)
+		return "", fmt.Errorf("problem parsing the rules configuration: %s", err)
 	}
 
 	var buf bytes.Buffer
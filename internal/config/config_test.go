@@ -3,8 +3,11 @@ package config
 import (
 	"encoding/base64"
 	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -31,6 +34,7 @@ func TestChangeDefaults(t *testing.T) {
 	os.Setenv("PULLEY_METRICS_PATH", "metrics")
 	os.Setenv("PULLEY_WEBHOOK_TOKEN", base64.StdEncoding.EncodeToString(zero))
 	os.Setenv("PULLEY_TRACK_BUILD_TIMES", "true")
+	os.Setenv("PULLEY_SHUTDOWN_TIMEOUT", "5s")
 
 	actual, err := Setup()
 	assert.NoError(t, err)
@@ -40,12 +44,813 @@ func TestChangeDefaults(t *testing.T) {
 	expected.Port = "1337"
 	expected.WebhookPath = "webhooks"
 	expected.MetricsPath = "metrics"
-	expected.WebhookToken = zero
+	expected.WebhookTokens = [][]byte{zero}
 	expected.TrackBuildTimes = true
+	expected.ShutdownTimeout = 5 * time.Second
 
 	assert.Equal(t, expected, actual)
 }
 
+func TestEviction(t *testing.T) {
+	// Needed to ensure the test is correct
+	os.Clearenv()
+
+	os.Setenv("PULLEY_SHA_TTL", "336h")
+	os.Setenv("PULLEY_MAX_SHAS", "10000")
+
+	actual, err := Setup()
+	assert.NoError(t, err)
+
+	expected := DefaultConfig()
+	expected.SHATTL = 14 * 24 * time.Hour
+	expected.MaxSHAs = 10000
+
+	assert.Equal(t, expected, actual)
+}
+
+var badEvictionTests = []struct {
+	name  string
+	key   string
+	value string
+}{
+	{"TTLNotDuration", "PULLEY_SHA_TTL", "14"},
+	{"TTLNegative", "PULLEY_SHA_TTL", "-1h"},
+	{"MaxNotNumber", "PULLEY_MAX_SHAS", "many"},
+	{"MaxNegative", "PULLEY_MAX_SHAS", "-1"},
+}
+
+func TestBadEviction(t *testing.T) {
+	for _, tt := range badEvictionTests {
+		tt := tt // see: https://github.com/kyoh86/scopelint/issues/4
+		t.Run(tt.name, func(t *testing.T) {
+			// Needed to ensure the test is correct
+			os.Clearenv()
+
+			os.Setenv(tt.key, tt.value)
+
+			_, err := Setup()
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	// Needed to ensure the test is correct
+	os.Clearenv()
+
+	os.Setenv("PULLEY_SNAPSHOT_PATH", "/var/lib/pulley/state.json")
+	os.Setenv("PULLEY_SNAPSHOT_INTERVAL", "30s")
+
+	assert := assert.New(t)
+
+	actual, err := Setup()
+	assert.NoError(err)
+
+	expected := DefaultConfig()
+	expected.SnapshotPath = "/var/lib/pulley/state.json"
+	expected.SnapshotInterval = 30 * time.Second
+
+	assert.Equal(expected, actual)
+
+	printout, err := actual.Print()
+	assert.NoError(err)
+	assert.Contains(printout, "/var/lib/pulley/state.json every 30s")
+}
+
+func TestQueue(t *testing.T) {
+	// Needed to ensure the test is correct
+	os.Clearenv()
+
+	os.Setenv("PULLEY_QUEUE_SIZE", "1000")
+	os.Setenv("PULLEY_QUEUE_POLICY", "spill")
+	os.Setenv("PULLEY_QUEUE_SPILL_PATH", "/var/lib/pulley/spill.jsonl")
+
+	actual, err := Setup()
+	assert.NoError(t, err)
+
+	expected := DefaultConfig()
+	expected.QueueSize = 1000
+	expected.QueuePolicy = SpillPolicy
+	expected.QueueSpillPath = "/var/lib/pulley/spill.jsonl"
+
+	assert.Equal(t, expected, actual)
+}
+
+func TestArchive(t *testing.T) {
+	// Needed to ensure the test is correct
+	os.Clearenv()
+
+	os.Setenv("PULLEY_ARCHIVE_PATH", "/var/lib/pulley/archive")
+	os.Setenv("PULLEY_ARCHIVE_MAX_SIZE", "1048576")
+
+	assert := assert.New(t)
+
+	actual, err := Setup()
+	assert.NoError(err)
+
+	expected := DefaultConfig()
+	expected.ArchivePath = "/var/lib/pulley/archive"
+	expected.ArchiveMaxSize = 1048576
+
+	assert.Equal(expected, actual)
+
+	printout, err := actual.Print()
+	assert.NoError(err)
+	assert.Contains(printout, "/var/lib/pulley/archive, rotated at 1048576 bytes")
+}
+
+func TestAdmin(t *testing.T) {
+	// Needed to ensure the test is correct
+	os.Clearenv()
+
+	os.Setenv("PULLEY_ADMIN_PATH", "internal")
+	os.Setenv("PULLEY_ADMIN_TOKEN", "admin token should not be shown")
+
+	assert := assert.New(t)
+
+	actual, err := Setup()
+	assert.NoError(err)
+
+	expected := DefaultConfig()
+	expected.AdminPath = "internal"
+	expected.AdminToken = "admin token should not be shown"
+
+	assert.Equal(expected, actual)
+
+	printout, err := actual.Print()
+	assert.NoError(err)
+	assert.Contains(printout, "/internal/reload")
+	assert.NotContains(printout, "admin token should not be shown")
+}
+
+var badQueueTests = []struct {
+	name    string
+	envVars []string
+}{
+	{"SizeNotNumber", []string{"PULLEY_QUEUE_SIZE=lots"}},
+	{"UnknownPolicy", []string{"PULLEY_QUEUE_POLICY=drop-random"}},
+	{"BadTimeout", []string{"PULLEY_QUEUE_TIMEOUT=5"}},
+	{"SpillWithoutPath", []string{"PULLEY_QUEUE_POLICY=spill"}},
+	{"DropOldestWithoutQueue", []string{"PULLEY_QUEUE_POLICY=drop-oldest", "PULLEY_QUEUE_SIZE=0"}},
+}
+
+func TestBadQueue(t *testing.T) {
+	for _, tt := range badQueueTests {
+		tt := tt // see: https://github.com/kyoh86/scopelint/issues/4
+		t.Run(tt.name, func(t *testing.T) {
+			// Needed to ensure the test is correct
+			os.Clearenv()
+
+			for _, e := range tt.envVars {
+				pair := strings.SplitN(e, "=", 2)
+				os.Setenv(pair[0], pair[1])
+			}
+
+			_, err := Setup()
+			assert.Error(t, err)
+		})
+	}
+}
+
+const configFile = `
+host: 0.0.0.0
+port: 1337
+webhook_path: webhooks
+webhook_tokens:
+  - value: Zmlyc3Q=
+track_build_times: true
+sha_ttl: 336h
+queue:
+  size: 1000
+  policy: drop-oldest
+repositories:
+  - repo: -deployment$
+    context: ^terraform-validate
+  - repo: .*
+    strategy: aggregate
+    context: :all-jobs$
+`
+
+func writeConfigFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "pulley.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+
+	return path
+}
+
+func TestConfigFile(t *testing.T) {
+	// Needed to ensure the test is correct
+	os.Clearenv()
+
+	path := writeConfigFile(t, configFile)
+
+	os.Setenv("PULLEY_CONFIG", path)
+	os.Setenv("PULLEY_PORT", "1701")
+	os.Setenv("PULLEY_QUEUE_SIZE", "500")
+
+	assert := assert.New(t)
+
+	actual, err := Setup()
+	assert.NoError(err)
+
+	expected := DefaultConfig()
+	expected.File = path
+	expected.Host = "0.0.0.0"
+	expected.Port = "1701"
+	expected.WebhookPath = "webhooks"
+	expected.WebhookTokens = [][]byte{[]byte("first")}
+	expected.TrackBuildTimes = true
+	expected.SHATTL = 14 * 24 * time.Hour
+	expected.QueueSize = 500
+	expected.QueuePolicy = DropOldestPolicy
+	expected.Rules = []contextDescriptor{
+		{Repo: regexp.MustCompile("-deployment$"), Strategy: AggregateStrategy, Context: regexp.MustCompile("^terraform-validate")},
+		{Repo: regexp.MustCompile(".*"), Strategy: AggregateStrategy, Context: regexp.MustCompile(":all-jobs$")},
+	}
+
+	assert.Equal(expected, actual)
+
+	printout, err := actual.Print()
+	assert.NoError(err)
+	assert.Contains(printout, path)
+	assert.Contains(printout, "^terraform-validate")
+}
+
+// Rules from the environment variables replace the ones from the file.
+func TestConfigFileRulesOverridden(t *testing.T) {
+	// Needed to ensure the test is correct
+	os.Clearenv()
+
+	os.Setenv("PULLEY_STRATEGY_AGGREGATE_REPO_REGEX_0", "^knl/pulley$")
+	os.Setenv("PULLEY_STRATEGY_AGGREGATE_CONTEXT_REGEX_0", "build")
+
+	actual, err := Load(writeConfigFile(t, configFile))
+
+	assert := assert.New(t)
+	assert.NoError(err)
+	assert.Equal([]contextDescriptor{
+		{Repo: regexp.MustCompile("^knl/pulley$"), Strategy: AggregateStrategy, Context: regexp.MustCompile("build")},
+	}, actual.Rules)
+}
+
+func TestRequiredStrategy(t *testing.T) {
+	// Needed to ensure the test is correct
+	os.Clearenv()
+
+	os.Setenv("PULLEY_PR_TIMING_STRATEGY", "required")
+	os.Setenv("PULLEY_STRATEGY_REQUIRED_REPO_REGEX_0", "^knl/pulley$")
+	os.Setenv("PULLEY_STRATEGY_REQUIRED_CONTEXTS_0", "lint, test,build")
+
+	assert := assert.New(t)
+
+	actual, err := Setup()
+	assert.NoError(err)
+
+	expected := DefaultConfig()
+	expected.Strategy = RequiredStrategy
+	expected.Rules = []contextDescriptor{
+		{Repo: regexp.MustCompile("^knl/pulley$"), Strategy: RequiredStrategy, Contexts: []string{"lint", "test", "build"}},
+	}
+
+	assert.Equal(expected, actual)
+
+	checkers := actual.DefaultCheckers(nil)
+	assert.Equal([]string{"lint", "test", "build"}, checkers.Required("knl/pulley", "master"))
+	assert.Nil(checkers.Required("knl/other", "master"))
+	assert.False(checkers.Aggregate("knl/pulley", "build"))
+
+	printout, err := actual.Print()
+	assert.NoError(err)
+	assert.Contains(printout, "contexts: lint, test, build")
+}
+
+// Rules for different strategies can be mixed in the configuration file.
+func TestConfigFileMixedRules(t *testing.T) {
+	// Needed to ensure the test is correct
+	os.Clearenv()
+
+	content := `
+repositories:
+  - repo: ^knl/pulley$
+    strategy: required
+    contexts: [lint, test]
+  - repo: .*
+    context: :all-jobs$
+`
+
+	actual, err := Load(writeConfigFile(t, content))
+
+	assert := assert.New(t)
+	assert.NoError(err)
+
+	checkers := actual.DefaultCheckers(nil)
+	assert.Equal([]string{"lint", "test"}, checkers.Required("knl/pulley", "master"))
+	assert.False(checkers.Aggregate("knl/pulley", "ci:all-jobs"))
+	assert.Nil(checkers.Required("knl/other", "master"))
+	assert.True(checkers.Aggregate("knl/other", "ci:all-jobs"))
+}
+
+var badRequiredTests = []struct {
+	name    string
+	envVars []string
+}{
+	{"NoRules", []string{"PULLEY_PR_TIMING_STRATEGY=required"}},
+	{"MissingContexts", []string{"PULLEY_PR_TIMING_STRATEGY=required", "PULLEY_STRATEGY_REQUIRED_REPO_REGEX_0=.*"}},
+	{"EmptyContexts", []string{"PULLEY_PR_TIMING_STRATEGY=required", "PULLEY_STRATEGY_REQUIRED_REPO_REGEX_0=.*", "PULLEY_STRATEGY_REQUIRED_CONTEXTS_0=,"}},
+	{"BrokenRepoRegex", []string{"PULLEY_PR_TIMING_STRATEGY=required", "PULLEY_STRATEGY_REQUIRED_REPO_REGEX_0=*", "PULLEY_STRATEGY_REQUIRED_CONTEXTS_0=build"}},
+}
+
+func TestBadRequired(t *testing.T) {
+	for _, tt := range badRequiredTests {
+		tt := tt // see: https://github.com/kyoh86/scopelint/issues/4
+		t.Run(tt.name, func(t *testing.T) {
+			// Needed to ensure the test is correct
+			os.Clearenv()
+
+			for _, e := range tt.envVars {
+				pair := strings.SplitN(e, "=", 2)
+				os.Setenv(pair[0], pair[1])
+			}
+
+			_, err := Setup()
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestProtectionStrategy(t *testing.T) {
+	// Needed to ensure the test is correct
+	os.Clearenv()
+
+	os.Setenv("PULLEY_PR_TIMING_STRATEGY", "protection")
+	os.Setenv("PULLEY_GITHUB_API_TOKEN", "ghp_secret")
+	os.Setenv("PULLEY_GITHUB_API_URL", "https://github.example.com/api/v3/")
+	os.Setenv("PULLEY_PROTECTION_REFRESH", "1m")
+
+	assert := assert.New(t)
+
+	actual, err := Setup()
+	assert.NoError(err)
+
+	expected := DefaultConfig()
+	expected.Strategy = ProtectionStrategy
+	expected.GithubAPIToken = "ghp_secret"
+	expected.GithubAPIURL = "https://github.example.com/api/v3/"
+	expected.ProtectionRefresh = time.Minute
+	expected.Rules = []contextDescriptor{
+		{Repo: regexp.MustCompile(".*"), Strategy: ProtectionStrategy},
+	}
+
+	assert.Equal(expected, actual)
+
+	var asked []string
+
+	checkers := actual.DefaultCheckers(func(repo, branch string) []string {
+		asked = append(asked, repo+"@"+branch)
+		return []string{"build"}
+	})
+	assert.Equal([]string{"build"}, checkers.Required("knl/pulley", "main"))
+	assert.Equal([]string{"knl/pulley@main"}, asked)
+
+	// Without a lookup, nothing is required
+	assert.Nil(actual.DefaultCheckers(nil).Required("knl/pulley", "main"))
+
+	printout, err := actual.Print()
+	assert.NoError(err)
+	assert.Contains(printout, "contexts: <from the branch protection>")
+	assert.NotContains(printout, "ghp_secret")
+}
+
+// The protection strategy can be used only for some repositories.
+func TestConfigFileProtectionRules(t *testing.T) {
+	// Needed to ensure the test is correct
+	os.Clearenv()
+
+	content := `
+github_api:
+  token: ghp_secret
+  refresh: 30m
+repositories:
+  - repo: ^knl/pulley$
+    strategy: protection
+  - repo: .*
+    context: :all-jobs$
+`
+
+	actual, err := Load(writeConfigFile(t, content))
+
+	assert := assert.New(t)
+	assert.NoError(err)
+	assert.Equal(30*time.Minute, actual.ProtectionRefresh)
+
+	checkers := actual.DefaultCheckers(func(repo, branch string) []string {
+		return []string{"lint"}
+	})
+	assert.Equal([]string{"lint"}, checkers.Required("knl/pulley", ""))
+	assert.Nil(checkers.Required("knl/other", ""))
+	assert.True(checkers.Aggregate("knl/other", "ci:all-jobs"))
+}
+
+func TestProtectionNeedsToken(t *testing.T) {
+	// Needed to ensure the test is correct
+	os.Clearenv()
+
+	os.Setenv("PULLEY_PR_TIMING_STRATEGY", "protection")
+
+	_, err := Setup()
+	assert.Error(t, err)
+
+	os.Clearenv()
+
+	_, err = Load(writeConfigFile(t, "repositories:\n  - repo: .*\n    strategy: protection"))
+	assert.Error(t, err)
+}
+
+func TestBadProtectionRefresh(t *testing.T) {
+	// Needed to ensure the test is correct
+	os.Clearenv()
+
+	os.Setenv("PULLEY_PROTECTION_REFRESH", "0s")
+
+	_, err := Setup()
+	assert.Error(t, err)
+
+	os.Clearenv()
+
+	_, err = Load(writeConfigFile(t, "github_api:\n  refresh: 0s"))
+	assert.Error(t, err)
+}
+
+func TestFailFast(t *testing.T) {
+	// Needed to ensure the test is correct
+	os.Clearenv()
+
+	os.Setenv("PULLEY_FAIL_FAST_REPO_REGEX_0", "^knl/pulley$")
+	os.Setenv("PULLEY_FAIL_FAST_CONTEXT_REGEX_0", "^(lint|test)$")
+
+	assert := assert.New(t)
+
+	actual, err := Setup()
+	assert.NoError(err)
+
+	checkers := actual.DefaultCheckers(nil)
+	assert.True(checkers.FailFast("knl/pulley", "lint"))
+	assert.False(checkers.FailFast("knl/pulley", "deploy"))
+	assert.False(checkers.FailFast("knl/other", "lint"))
+
+	actual, err = Load(writeConfigFile(t, "fail_fast:\n  - repo: .*\n    context: ^deploy$"))
+	assert.NoError(err)
+
+	// The environment variables override the file
+	checkers = actual.DefaultCheckers(nil)
+	assert.True(checkers.FailFast("knl/pulley", "lint"))
+	assert.False(checkers.FailFast("knl/pulley", "deploy"))
+	assert.False(checkers.FailFast("knl/other", "deploy"))
+
+	os.Clearenv()
+
+	actual, err = Load(writeConfigFile(t, "fail_fast:\n  - repo: .*\n    context: ^deploy$"))
+	assert.NoError(err)
+
+	checkers = actual.DefaultCheckers(nil)
+	assert.True(checkers.FailFast("knl/other", "deploy"))
+	assert.False(checkers.FailFast("knl/other", "lint"))
+}
+
+func TestFailFastDefault(t *testing.T) {
+	// Needed to ensure the test is correct
+	os.Clearenv()
+
+	actual, err := Setup()
+	assert.NoError(t, err)
+	assert.True(t, actual.DefaultCheckers(nil).FailFast("knl/pulley", "anything"))
+}
+
+func TestStuck(t *testing.T) {
+	// Needed to ensure the test is correct
+	os.Clearenv()
+
+	os.Setenv("PULLEY_STUCK_REPO_REGEX_1", ".*")
+	os.Setenv("PULLEY_STUCK_CONTEXT_REGEX_1", ".*")
+	os.Setenv("PULLEY_STUCK_AFTER_1", "1h")
+	os.Setenv("PULLEY_STUCK_REPO_REGEX_0", "^knl/pulley$")
+	os.Setenv("PULLEY_STUCK_CONTEXT_REGEX_0", "^deploy$")
+	os.Setenv("PULLEY_STUCK_AFTER_0", "3h")
+	os.Setenv("PULLEY_STUCK_INTERVAL", "30s")
+	os.Setenv("PULLEY_STUCK_LOG", "true")
+
+	assert := assert.New(t)
+
+	actual, err := Setup()
+	assert.NoError(err)
+	assert.Equal(30*time.Second, actual.StuckInterval)
+	assert.True(actual.StuckLog)
+
+	checkers := actual.DefaultCheckers(nil)
+	assert.Equal(3*time.Hour, checkers.Stuck("knl/pulley", "deploy"))
+	assert.Equal(time.Hour, checkers.Stuck("knl/pulley", "test"))
+	assert.Equal(time.Hour, checkers.Stuck("knl/other", "deploy"))
+
+	os.Clearenv()
+
+	actual, err = Load(writeConfigFile(t, "stuck:\n  interval: 5m\n  rules:\n    - repo: ^knl/\n      context: ^test$\n      after: 2h"))
+	assert.NoError(err)
+	assert.Equal(5*time.Minute, actual.StuckInterval)
+	assert.False(actual.StuckLog)
+
+	checkers = actual.DefaultCheckers(nil)
+	assert.Equal(2*time.Hour, checkers.Stuck("knl/pulley", "test"))
+	assert.Equal(time.Duration(0), checkers.Stuck("knl/pulley", "lint"))
+	assert.Equal(time.Duration(0), checkers.Stuck("other/pulley", "test"))
+}
+
+func TestStuckDefault(t *testing.T) {
+	// Needed to ensure the test is correct
+	os.Clearenv()
+
+	actual, err := Setup()
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), actual.DefaultCheckers(nil).Stuck("knl/pulley", "anything"))
+}
+
+var badStuckTests = []struct {
+	name    string
+	envVars []string
+}{
+	{"MissingContext", []string{"PULLEY_STUCK_REPO_REGEX_0=.*", "PULLEY_STUCK_AFTER_0=1h"}},
+	{"MissingAfter", []string{"PULLEY_STUCK_REPO_REGEX_0=.*", "PULLEY_STUCK_CONTEXT_REGEX_0=.*"}},
+	{"NegativeAfter", []string{"PULLEY_STUCK_REPO_REGEX_0=.*", "PULLEY_STUCK_CONTEXT_REGEX_0=.*", "PULLEY_STUCK_AFTER_0=-1h"}},
+	{"BrokenContextRegex", []string{"PULLEY_STUCK_REPO_REGEX_0=.*", "PULLEY_STUCK_CONTEXT_REGEX_0=*", "PULLEY_STUCK_AFTER_0=1h"}},
+	{"BadInterval", []string{"PULLEY_STUCK_INTERVAL=often"}},
+}
+
+func TestBadStuck(t *testing.T) {
+	for _, tt := range badStuckTests {
+		tt := tt // see: https://github.com/kyoh86/scopelint/issues/4
+		t.Run(tt.name, func(t *testing.T) {
+			// Needed to ensure the test is correct
+			os.Clearenv()
+
+			for _, e := range tt.envVars {
+				pair := strings.SplitN(e, "=", 2)
+				os.Setenv(pair[0], pair[1])
+			}
+
+			_, err := Setup()
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestGithubWebURL(t *testing.T) {
+	config := DefaultConfig()
+	assert.Equal(t, "https://github.com/", config.GithubWebURL())
+
+	config.GithubAPIURL = "https://github.example.com/api/v3/"
+	assert.Equal(t, "https://github.example.com/", config.GithubWebURL())
+}
+
+func TestBuckets(t *testing.T) {
+	// Needed to ensure the test is correct
+	os.Clearenv()
+
+	os.Setenv("PULLEY_BUCKETS_GITHUB_CI_BUILD_DURATION_SECONDS", "exponential:60,2,4")
+	os.Setenv("PULLEY_BUCKETS_GITHUB_PULL_REQUEST_MERGED_PUSHES", "0, 1, 5")
+
+	assert := assert.New(t)
+
+	actual, err := Load(writeConfigFile(t, `buckets:
+  github_ci_build_duration_seconds:
+    explicit: [1, 2]
+  github_ci_noticed_duration_seconds:
+    linear: {start: 0, width: 30, count: 3}`))
+	assert.NoError(err)
+
+	// The environment variables override the file, per histogram
+	assert.Equal(map[string][]float64{
+		"github_ci_build_duration_seconds":   {60, 120, 240, 480},
+		"github_pull_request_merged_pushes":  {0, 1, 5},
+		"github_ci_noticed_duration_seconds": {0, 30, 60},
+	}, actual.Buckets)
+
+	printout, err := actual.Print()
+	assert.NoError(err)
+	assert.Contains(printout, "github_ci_build_duration_seconds: [60 120 240 480]")
+}
+
+func TestBucketsDefault(t *testing.T) {
+	// Needed to ensure the test is correct
+	os.Clearenv()
+
+	actual, err := Setup()
+	assert.NoError(t, err)
+	assert.Nil(t, actual.Buckets)
+}
+
+func TestHistograms(t *testing.T) {
+	// Needed to ensure the test is correct
+	os.Clearenv()
+
+	assert := assert.New(t)
+
+	actual, err := Setup()
+	assert.NoError(err)
+	assert.Equal(ClassicHistograms, actual.HistogramType)
+	assert.True(actual.HistogramType.Classic())
+	assert.False(actual.HistogramType.Native())
+
+	os.Setenv("PULLEY_HISTOGRAMS", "both")
+	os.Setenv("PULLEY_NATIVE_BUCKET_FACTOR", "1.05")
+
+	actual, err = Load(writeConfigFile(t, "histograms:\n  type: native\n  native_bucket_factor: 2\n  native_max_buckets: 80"))
+	assert.NoError(err)
+	assert.Equal(BothHistograms, actual.HistogramType)
+	assert.Equal(1.05, actual.NativeBucketFactor)
+	assert.Equal(80, actual.NativeMaxBuckets)
+
+	printout, err := actual.Print()
+	assert.NoError(err)
+	assert.Contains(printout, "both, native buckets growing by 1.05, up to 80 of them")
+}
+
+var badHistogramsTests = []struct {
+	name    string
+	envVars []string
+}{
+	{"UnknownType", []string{"PULLEY_HISTOGRAMS=sparse"}},
+	{"FactorNotNumber", []string{"PULLEY_NATIVE_BUCKET_FACTOR=fine"}},
+	{"FactorTooSmall", []string{"PULLEY_HISTOGRAMS=native", "PULLEY_NATIVE_BUCKET_FACTOR=1"}},
+	{"NegativeMaxBuckets", []string{"PULLEY_NATIVE_MAX_BUCKETS=-1"}},
+	{"NativeWithBuckets", []string{"PULLEY_HISTOGRAMS=native", "PULLEY_BUCKETS_GITHUB_CI_BUILD_DURATION_SECONDS=1,2"}},
+}
+
+func TestBadHistograms(t *testing.T) {
+	for _, tt := range badHistogramsTests {
+		tt := tt // see: https://github.com/kyoh86/scopelint/issues/4
+		t.Run(tt.name, func(t *testing.T) {
+			// Needed to ensure the test is correct
+			os.Clearenv()
+
+			for _, e := range tt.envVars {
+				pair := strings.SplitN(e, "=", 2)
+				os.Setenv(pair[0], pair[1])
+			}
+
+			_, err := Setup()
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestLabels(t *testing.T) {
+	// Needed to ensure the test is correct
+	os.Clearenv()
+
+	os.Setenv("PULLEY_MAX_BUILDS", "200")
+	os.Setenv("PULLEY_BUILD_REWRITE_REGEX_1", "^(.*)-[0-9]+$")
+	os.Setenv("PULLEY_BUILD_REWRITE_REPLACEMENT_1", "$1")
+	os.Setenv("PULLEY_BUILD_REWRITE_REGEX_0", " \\(.*\\)$")
+	os.Setenv("PULLEY_BUILD_REWRITE_REPLACEMENT_0", "")
+
+	assert := assert.New(t)
+
+	actual, err := Load(writeConfigFile(t, `labels:
+  max_repositories: 50
+  max_builds: 100
+  build_rewrites:
+    - regex: ^ci/.*$
+      replacement: ci`))
+	assert.NoError(err)
+	assert.Equal(50, actual.MaxRepositories)
+	assert.Equal(200, actual.MaxBuilds)
+
+	// The environment variables replace the rewrites of the file
+	assert.Len(actual.BuildRewrites, 2)
+	assert.Equal(" \\(.*\\)$", actual.BuildRewrites[0].Regex.String())
+	assert.Equal("", actual.BuildRewrites[0].Replacement)
+	assert.Equal("$1", actual.BuildRewrites[1].Replacement)
+
+	printout, err := actual.Print()
+	assert.NoError(err)
+	assert.Contains(printout, "up to 50 repositories, up to 200 builds")
+}
+
+var badLabelsTests = []struct {
+	name    string
+	envVars []string
+}{
+	{"NegativeMaxRepositories", []string{"PULLEY_MAX_REPOSITORIES=-1"}},
+	{"MaxBuildsNotNumber", []string{"PULLEY_MAX_BUILDS=many"}},
+	{"MissingReplacement", []string{"PULLEY_BUILD_REWRITE_REGEX_0=.*"}},
+	{"BrokenRegex", []string{"PULLEY_BUILD_REWRITE_REGEX_0=*", "PULLEY_BUILD_REWRITE_REPLACEMENT_0=build"}},
+	{"BadIndex", []string{"PULLEY_BUILD_REWRITE_REGEX_first=.*", "PULLEY_BUILD_REWRITE_REPLACEMENT_first=build"}},
+}
+
+func TestBadLabels(t *testing.T) {
+	for _, tt := range badLabelsTests {
+		tt := tt // see: https://github.com/kyoh86/scopelint/issues/4
+		t.Run(tt.name, func(t *testing.T) {
+			// Needed to ensure the test is correct
+			os.Clearenv()
+
+			for _, e := range tt.envVars {
+				pair := strings.SplitN(e, "=", 2)
+				os.Setenv(pair[0], pair[1])
+			}
+
+			_, err := Setup()
+			assert.Error(t, err)
+		})
+	}
+}
+
+var badBucketsTests = []struct {
+	name   string
+	layout string
+}{
+	{"Empty", ""},
+	{"NotNumbers", "1,2,many"},
+	{"Decreasing", "1,5,2"},
+	{"Repeated", "1,1"},
+	{"UnknownGenerator", "fibonacci:1,2,10"},
+	{"ExponentialTooFewArgs", "exponential:1,2"},
+	{"ExponentialFactorOne", "exponential:1,1,10"},
+	{"ExponentialZeroStart", "exponential:0,2,10"},
+	{"ExponentialFractionalCount", "exponential:1,2,2.5"},
+	{"LinearZeroWidth", "linear:0,0,10"},
+	{"LinearNoCount", "linear:0,10,0"},
+}
+
+func TestBadBuckets(t *testing.T) {
+	for _, tt := range badBucketsTests {
+		tt := tt // see: https://github.com/kyoh86/scopelint/issues/4
+		t.Run(tt.name, func(t *testing.T) {
+			// Needed to ensure the test is correct
+			os.Clearenv()
+
+			os.Setenv("PULLEY_BUCKETS_GITHUB_CI_BUILD_DURATION_SECONDS", tt.layout)
+
+			_, err := Setup()
+			assert.Error(t, err)
+		})
+	}
+}
+
+var badConfigFileTests = []struct {
+	name    string
+	content string
+}{
+	{"RequiredWithContext", "repositories:\n  - repo: .*\n    strategy: required\n    context: build"},
+	{"AggregateWithContexts", "repositories:\n  - repo: .*\n    context: build\n    contexts: [test]"},
+	{"NotYAML", "host: [localhost"},
+	{"UnknownKey", "hots: localhost"},
+	{"BadDuration", "sha_ttl: 14"},
+	{"NegativeCount", "max_shas: -1"},
+	{"UnknownPolicy", "queue:\n  policy: drop-random"},
+	{"UnknownStrategy", "strategy: random"},
+	{"TokenNotBase64", "webhook_tokens:\n  - value: '123'"},
+	{"TokenBothSources", "webhook_tokens:\n  - value: MTIz\n    file: /run/secrets/tokens"},
+	{"RuleWithoutContext", "repositories:\n  - repo: .*"},
+	{"RuleUnknownStrategy", "repositories:\n  - repo: .*\n    strategy: random\n    context: build"},
+	{"FailFastWithoutContext", "fail_fast:\n  - repo: .*"},
+	{"FailFastBrokenRegex", "fail_fast:\n  - repo: .*\n    context: '*'"},
+	{"RuleBrokenRegex", "repositories:\n  - repo: '*'\n    context: build"},
+	{"StuckWithoutAfter", "stuck:\n  rules:\n    - repo: .*\n      context: .*"},
+	{"BucketsTwoLayouts", "buckets:\n  github_ci_build_duration_seconds:\n    explicit: [1]\n    linear: {start: 0, width: 1, count: 2}"},
+	{"BucketsNoLayout", "buckets:\n  github_ci_build_duration_seconds: {}"},
+	{"BucketsDecreasing", "buckets:\n  github_ci_build_duration_seconds:\n    explicit: [2, 1]"},
+	{"BucketsBadExponential", "buckets:\n  github_ci_build_duration_seconds:\n    exponential: {start: 1, factor: 0.5, count: 10}"},
+	{"HistogramsUnknownType", "histograms:\n  type: sparse"},
+	{"HistogramsNegativeMaxBuckets", "histograms:\n  native_max_buckets: -1"},
+	{"LabelsRewriteWithoutRegex", "labels:\n  build_rewrites:\n    - replacement: build"},
+	{"LabelsRewriteBrokenRegex", "labels:\n  build_rewrites:\n    - regex: '*'"},
+	{"LabelsNegativeMaxBuilds", "labels:\n  max_builds: -5"},
+	{"StuckBadAfter", "stuck:\n  rules:\n    - repo: .*\n      context: .*\n      after: soon"},
+}
+
+func TestBadConfigFile(t *testing.T) {
+	for _, tt := range badConfigFileTests {
+		tt := tt // see: https://github.com/kyoh86/scopelint/issues/4
+		t.Run(tt.name, func(t *testing.T) {
+			// Needed to ensure the test is correct
+			os.Clearenv()
+
+			_, err := Load(writeConfigFile(t, tt.content))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestMissingConfigFile(t *testing.T) {
+	// Needed to ensure the test is correct
+	os.Clearenv()
+
+	os.Setenv("PULLEY_CONFIG", "/nonexistent/pulley.yaml")
+
+	_, err := Setup()
+	assert.Error(t, err)
+}
+
 func TestBadToken(t *testing.T) {
 	// Needed to ensure the test is correct
 	os.Clearenv()
@@ -56,6 +861,62 @@ func TestBadToken(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestMultipleTokens(t *testing.T) {
+	// Needed to ensure the test is correct
+	os.Clearenv()
+
+	path := filepath.Join(t.TempDir(), "tokens")
+	content := "# rotated on 2020-05-01\n" + base64.StdEncoding.EncodeToString([]byte("fourth")) + "\n\n"
+
+	assert := assert.New(t)
+	assert.NoError(os.WriteFile(path, []byte(content), 0o600))
+
+	os.Setenv("PULLEY_WEBHOOK_TOKEN", base64.StdEncoding.EncodeToString([]byte("first")))
+	os.Setenv("PULLEY_WEBHOOK_TOKEN_10", base64.StdEncoding.EncodeToString([]byte("third")))
+	os.Setenv("PULLEY_WEBHOOK_TOKEN_2", base64.StdEncoding.EncodeToString([]byte("second")))
+	os.Setenv("PULLEY_WEBHOOK_TOKEN_FILE", path)
+
+	actual, err := Setup()
+	assert.NoError(err)
+
+	expected := DefaultConfig()
+	expected.WebhookTokens = [][]byte{
+		[]byte("first"),
+		[]byte("second"),
+		[]byte("third"),
+		[]byte("fourth"),
+	}
+
+	assert.Equal(expected, actual)
+}
+
+var badTokenTests = []struct {
+	name    string
+	envVars []string
+}{
+	{"NotBase64", []string{"PULLEY_WEBHOOK_TOKEN_0=123"}},
+	{"MissingNumber", []string{"PULLEY_WEBHOOK_TOKEN_=MTIz"}},
+	{"MissingFile", []string{"PULLEY_WEBHOOK_TOKEN_FILE=/nonexistent/tokens"}},
+}
+
+func TestBadTokens(t *testing.T) {
+	for _, tt := range badTokenTests {
+		tt := tt // see: https://github.com/kyoh86/scopelint/issues/4
+		t.Run(tt.name, func(t *testing.T) {
+			// Needed to ensure the test is correct
+			os.Clearenv()
+
+			for _, e := range tt.envVars {
+				pair := strings.SplitN(e, "=", 2)
+				os.Setenv(pair[0], pair[1])
+			}
+
+			_, err := Setup()
+			assert.Error(t, err)
+		})
+	}
+}
+
 var contextErrorDetectingTests = []struct {
 	name    string
 	envVars []string
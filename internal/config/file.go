@@ -0,0 +1,500 @@
+package config
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"regexp"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/knl/pulley/internal/metrics"
+)
+
+// fileConfig mirrors the configuration file. Fields left out of the file are
+// nil, so that they do not override the defaults.
+type fileConfig struct {
+	Host            *string                `yaml:"host"`
+	Port            *string                `yaml:"port"`
+	WebhookPath     *string                `yaml:"webhook_path"`
+	WebhookTokens   []fileTokens           `yaml:"webhook_tokens"`
+	MetricsPath     *string                `yaml:"metrics_path"`
+	Strategy        *string                `yaml:"strategy"`
+	TrackBuildTimes *bool                  `yaml:"track_build_times"`
+	SHATTL          *string                `yaml:"sha_ttl"`
+	MaxSHAs         *int                   `yaml:"max_shas"`
+	ShutdownTimeout *string                `yaml:"shutdown_timeout"`
+	Snapshot        fileSnapshot           `yaml:"snapshot"`
+	Queue           fileQueue              `yaml:"queue"`
+	Dedup           fileDedup              `yaml:"dedup"`
+	Archive         fileArchive            `yaml:"archive"`
+	Admin           fileAdmin              `yaml:"admin"`
+	Repositories    []fileRepository       `yaml:"repositories"`
+	FailFast        []fileFailFast         `yaml:"fail_fast"`
+	GithubAPI       fileGithubAPI          `yaml:"github_api"`
+	Stuck           fileStuck              `yaml:"stuck"`
+	Buckets         map[string]fileBuckets `yaml:"buckets"`
+	Histograms      fileHistograms         `yaml:"histograms"`
+	Labels          fileLabels             `yaml:"labels"`
+}
+
+// fileTokens is a source of webhook secret tokens, either a single base64
+// encoded token, or a file with one token per line.
+type fileTokens struct {
+	Value string `yaml:"value"`
+	File  string `yaml:"file"`
+}
+
+type fileSnapshot struct {
+	Path     *string `yaml:"path"`
+	Interval *string `yaml:"interval"`
+}
+
+type fileQueue struct {
+	Size      *int    `yaml:"size"`
+	Policy    *string `yaml:"policy"`
+	Timeout   *string `yaml:"timeout"`
+	SpillPath *string `yaml:"spill_path"`
+}
+
+type fileDedup struct {
+	Window *string `yaml:"window"`
+	Size   *int    `yaml:"size"`
+}
+
+type fileArchive struct {
+	Path    *string `yaml:"path"`
+	MaxSize *int    `yaml:"max_size"`
+}
+
+type fileGithubAPI struct {
+	URL     *string `yaml:"url"`
+	Token   *string `yaml:"token"`
+	Refresh *string `yaml:"refresh"`
+}
+
+type fileAdmin struct {
+	Path  *string `yaml:"path"`
+	Token *string `yaml:"token"`
+}
+
+// fileRepository is a rule for the repositories whose full name matches Repo,
+// listed in the order of priority.
+type fileRepository struct {
+	Repo     string   `yaml:"repo"`
+	Strategy string   `yaml:"strategy"`
+	Context  string   `yaml:"context"`  // For the aggregate strategy
+	Contexts []string `yaml:"contexts"` // For the required strategy, the protection strategy asks GitHub
+}
+
+// fileFailFast is a rule for which status checks tell that a PR is broken, in
+// the repositories whose full name matches Repo, listed in the order of
+// priority.
+type fileFailFast struct {
+	Repo    string `yaml:"repo"`
+	Context string `yaml:"context"`
+}
+
+type fileHistograms struct {
+	Type               *string  `yaml:"type"`
+	NativeBucketFactor *float64 `yaml:"native_bucket_factor"`
+	NativeMaxBuckets   *int     `yaml:"native_max_buckets"`
+}
+
+type fileLabels struct {
+	MaxRepositories *int               `yaml:"max_repositories"`
+	MaxBuilds       *int               `yaml:"max_builds"`
+	BuildRewrites   []fileLabelRewrite `yaml:"build_rewrites"`
+}
+
+// fileLabelRewrite replaces the matches of Regex in a label value with
+// Replacement, listed in the order of priority.
+type fileLabelRewrite struct {
+	Regex       string `yaml:"regex"`
+	Replacement string `yaml:"replacement"`
+}
+
+type fileStuck struct {
+	Interval *string         `yaml:"interval"`
+	Log      *bool           `yaml:"log"`
+	Rules    []fileStuckRule `yaml:"rules"`
+}
+
+// fileStuckRule tells after how long the pending status checks matching Context
+// are stuck, in the repositories whose full name matches Repo, listed in the
+// order of priority.
+type fileStuckRule struct {
+	Repo    string `yaml:"repo"`
+	Context string `yaml:"context"`
+	After   string `yaml:"after"`
+}
+
+func setString(target *string, value *string) {
+	if value != nil {
+		*target = *value
+	}
+}
+
+// setDuration parses durations in Go's format. A bare number is an error,
+// rather than being taken as nanoseconds.
+func setDuration(target *time.Duration, value *string, name string) error {
+	if value == nil {
+		return nil
+	}
+
+	d, err := time.ParseDuration(*value)
+	if err != nil {
+		return fmt.Errorf("could not parse %s '%s' as a duration, %v", name, *value, err)
+	}
+
+	if d < 0 {
+		return fmt.Errorf("%s must not be negative, got '%s'", name, *value)
+	}
+
+	*target = d
+
+	return nil
+}
+
+func setCount(target *int, value *int, name string) error {
+	if value == nil {
+		return nil
+	}
+
+	if *value < 0 {
+		return fmt.Errorf("%s must not be negative, got '%d'", name, *value)
+	}
+
+	*target = *value
+
+	return nil
+}
+
+// applyFile sets the configuration from the YAML file at path, overriding the
+// defaults. Unknown keys are rejected, to catch typos.
+func applyFile(config *Config, path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("could not read the configuration file, %v", err)
+	}
+
+	var file fileConfig
+	if err := yaml.UnmarshalStrict(content, &file); err != nil {
+		return fmt.Errorf("could not parse the configuration file %s, %v", path, err)
+	}
+
+	config.File = path
+
+	setString(&config.Host, file.Host)
+	setString(&config.Port, file.Port)
+	setString(&config.WebhookPath, file.WebhookPath)
+	setString(&config.MetricsPath, file.MetricsPath)
+	setString(&config.SnapshotPath, file.Snapshot.Path)
+	setString(&config.QueueSpillPath, file.Queue.SpillPath)
+	setString(&config.ArchivePath, file.Archive.Path)
+	setString(&config.AdminPath, file.Admin.Path)
+	setString(&config.AdminToken, file.Admin.Token)
+	setString(&config.GithubAPIURL, file.GithubAPI.URL)
+	setString(&config.GithubAPIToken, file.GithubAPI.Token)
+
+	if file.TrackBuildTimes != nil {
+		config.TrackBuildTimes = *file.TrackBuildTimes
+	}
+
+	if file.Stuck.Log != nil {
+		config.StuckLog = *file.Stuck.Log
+	}
+
+	durations := []struct {
+		target *time.Duration
+		value  *string
+		name   string
+	}{
+		{&config.SHATTL, file.SHATTL, "sha_ttl"},
+		{&config.ShutdownTimeout, file.ShutdownTimeout, "shutdown_timeout"},
+		{&config.SnapshotInterval, file.Snapshot.Interval, "snapshot.interval"},
+		{&config.QueueTimeout, file.Queue.Timeout, "queue.timeout"},
+		{&config.DedupWindow, file.Dedup.Window, "dedup.window"},
+		{&config.ProtectionRefresh, file.GithubAPI.Refresh, "github_api.refresh"},
+		{&config.StuckInterval, file.Stuck.Interval, "stuck.interval"},
+	}
+
+	for _, d := range durations {
+		if err := setDuration(d.target, d.value, d.name); err != nil {
+			return err
+		}
+	}
+
+	counts := []struct {
+		target *int
+		value  *int
+		name   string
+	}{
+		{&config.MaxSHAs, file.MaxSHAs, "max_shas"},
+		{&config.QueueSize, file.Queue.Size, "queue.size"},
+		{&config.DedupSize, file.Dedup.Size, "dedup.size"},
+		{&config.ArchiveMaxSize, file.Archive.MaxSize, "archive.max_size"},
+		{&config.NativeMaxBuckets, file.Histograms.NativeMaxBuckets, "histograms.native_max_buckets"},
+		{&config.MaxRepositories, file.Labels.MaxRepositories, "labels.max_repositories"},
+		{&config.MaxBuilds, file.Labels.MaxBuilds, "labels.max_builds"},
+	}
+
+	for _, c := range counts {
+		if err := setCount(c.target, c.value, c.name); err != nil {
+			return err
+		}
+	}
+
+	if file.Queue.Policy != nil {
+		p, err := parsePolicy(*file.Queue.Policy)
+		if err != nil {
+			return err
+		}
+
+		config.QueuePolicy = p
+	}
+
+	if file.Histograms.Type != nil {
+		ht, err := parseHistogramType(*file.Histograms.Type)
+		if err != nil {
+			return err
+		}
+
+		config.HistogramType = ht
+	}
+
+	if file.Histograms.NativeBucketFactor != nil {
+		config.NativeBucketFactor = *file.Histograms.NativeBucketFactor
+	}
+
+	if file.Strategy != nil {
+		s, err := parseStrategy(*file.Strategy)
+		if err != nil {
+			return err
+		}
+
+		config.Strategy = s
+	}
+
+	webhookTokens, err := fileWebhookTokens(file.WebhookTokens)
+	if err != nil {
+		return err
+	}
+
+	if len(webhookTokens) != 0 {
+		config.WebhookTokens = webhookTokens
+	}
+
+	descriptors, err := fileRepositories(file.Repositories, config.Strategy)
+	if err != nil {
+		return err
+	}
+
+	if len(descriptors) != 0 {
+		config.Rules = descriptors
+	}
+
+	failFastRules, err := fileFailFastRules(file.FailFast)
+	if err != nil {
+		return err
+	}
+
+	if len(failFastRules) != 0 {
+		config.FailFastRules = failFastRules
+	}
+
+	stuckRules, err := fileStuckRules(file.Stuck.Rules)
+	if err != nil {
+		return err
+	}
+
+	if len(stuckRules) != 0 {
+		config.StuckRules = stuckRules
+	}
+
+	buildRewrites, err := fileLabelRewrites(file.Labels.BuildRewrites)
+	if err != nil {
+		return err
+	}
+
+	if len(buildRewrites) != 0 {
+		config.BuildRewrites = buildRewrites
+	}
+
+	buckets, err := fileBucketLayouts(file.Buckets)
+	if err != nil {
+		return err
+	}
+
+	if len(buckets) != 0 {
+		config.Buckets = buckets
+	}
+
+	return nil
+}
+
+func fileWebhookTokens(sources []fileTokens) ([][]byte, error) {
+	webhookTokens := make([][]byte, 0)
+
+	for i, source := range sources {
+		switch {
+		case source.Value != "" && source.File == "":
+			token, err := base64.StdEncoding.DecodeString(source.Value)
+			if err != nil {
+				return nil, fmt.Errorf("could not decode the webhook secret token #%d from the configuration file, %v", i, err)
+			}
+
+			webhookTokens = append(webhookTokens, token)
+		case source.Value == "" && source.File != "":
+			tokens, err := readTokenFile(source.File)
+			if err != nil {
+				return nil, err
+			}
+
+			webhookTokens = append(webhookTokens, tokens...)
+		default:
+			return nil, fmt.Errorf("webhook secret token #%d in the configuration file needs exactly one of 'value' or 'file'", i)
+		}
+	}
+
+	return webhookTokens, nil
+}
+
+// fileRepositories turns the repository rules into context descriptors. Rules
+// without a strategy use the global one.
+func fileRepositories(rules []fileRepository, strategy TimingStrategy) ([]contextDescriptor, error) {
+	descriptors := make([]contextDescriptor, 0, len(rules))
+
+	for i, rule := range rules {
+		if rule.Repo == "" {
+			return nil, fmt.Errorf("repository rule #%d in the configuration file needs 'repo'", i)
+		}
+
+		s := strategy
+		if rule.Strategy != "" {
+			var err error
+			if s, err = parseStrategy(rule.Strategy); err != nil {
+				return nil, fmt.Errorf("repository rule #%d in the configuration file is broken, %v", i, err)
+			}
+		}
+
+		repoRegexp, err := regexp.Compile(rule.Repo)
+		if err != nil {
+			return nil, fmt.Errorf("could not compile the repository name regex '%s' of repository rule #%d, err=%v", rule.Repo, i, err)
+		}
+
+		descriptor := contextDescriptor{
+			Repo:     repoRegexp,
+			Strategy: s,
+		}
+
+		switch s {
+		case AggregateStrategy:
+			if rule.Context == "" || len(rule.Contexts) != 0 {
+				return nil, fmt.Errorf("repository rule #%d in the configuration file needs 'context', and no 'contexts', for the '%s' strategy", i, s)
+			}
+
+			descriptor.Context, err = regexp.Compile(rule.Context)
+			if err != nil {
+				return nil, fmt.Errorf("could not compile the status check name regex '%s' of repository rule #%d, err=%v", rule.Context, i, err)
+			}
+		case RequiredStrategy:
+			if rule.Context != "" || len(rule.Contexts) == 0 {
+				return nil, fmt.Errorf("repository rule #%d in the configuration file needs 'contexts', and no 'context', for the '%s' strategy", i, s)
+			}
+
+			descriptor.Contexts = rule.Contexts
+		case ProtectionStrategy:
+			if rule.Context != "" || len(rule.Contexts) != 0 {
+				return nil, fmt.Errorf("repository rule #%d in the configuration file needs neither 'context' nor 'contexts' for the '%s' strategy", i, s)
+			}
+		}
+
+		descriptors = append(descriptors, descriptor)
+	}
+
+	return descriptors, nil
+}
+
+func fileFailFastRules(rules []fileFailFast) ([]contextDescriptor, error) {
+	descriptors := make([]contextDescriptor, 0, len(rules))
+
+	for i, rule := range rules {
+		if rule.Repo == "" || rule.Context == "" {
+			return nil, fmt.Errorf("fail-fast rule #%d in the configuration file needs both 'repo' and 'context'", i)
+		}
+
+		repoRegexp, err := regexp.Compile(rule.Repo)
+		if err != nil {
+			return nil, fmt.Errorf("could not compile the repository name regex '%s' of fail-fast rule #%d, err=%v", rule.Repo, i, err)
+		}
+
+		contextRegexp, err := regexp.Compile(rule.Context)
+		if err != nil {
+			return nil, fmt.Errorf("could not compile the status check name regex '%s' of fail-fast rule #%d, err=%v", rule.Context, i, err)
+		}
+
+		descriptors = append(descriptors, contextDescriptor{
+			Repo:    repoRegexp,
+			Context: contextRegexp,
+		})
+	}
+
+	return descriptors, nil
+}
+
+func fileStuckRules(rules []fileStuckRule) ([]contextDescriptor, error) {
+	descriptors := make([]contextDescriptor, 0, len(rules))
+
+	for i, rule := range rules {
+		if rule.Repo == "" || rule.Context == "" || rule.After == "" {
+			return nil, fmt.Errorf("stuck rule #%d in the configuration file needs 'repo', 'context', and 'after'", i)
+		}
+
+		after, err := time.ParseDuration(rule.After)
+		if err != nil || after <= 0 {
+			return nil, fmt.Errorf("stuck rule #%d in the configuration file has 'after' '%s', which is not a positive duration", i, rule.After)
+		}
+
+		repoRegexp, err := regexp.Compile(rule.Repo)
+		if err != nil {
+			return nil, fmt.Errorf("could not compile the repository name regex '%s' of stuck rule #%d, err=%v", rule.Repo, i, err)
+		}
+
+		contextRegexp, err := regexp.Compile(rule.Context)
+		if err != nil {
+			return nil, fmt.Errorf("could not compile the status check name regex '%s' of stuck rule #%d, err=%v", rule.Context, i, err)
+		}
+
+		descriptors = append(descriptors, contextDescriptor{
+			Repo:    repoRegexp,
+			Context: contextRegexp,
+			After:   after,
+		})
+	}
+
+	return descriptors, nil
+}
+
+func fileLabelRewrites(rewrites []fileLabelRewrite) ([]metrics.Rewrite, error) {
+	labelRewrites := make([]metrics.Rewrite, 0, len(rewrites))
+
+	for i, rewrite := range rewrites {
+		if rewrite.Regex == "" {
+			return nil, fmt.Errorf("build rewrite #%d in the configuration file needs 'regex'", i)
+		}
+
+		regex, err := regexp.Compile(rewrite.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("could not compile the build name regex '%s' of build rewrite #%d, err=%v", rewrite.Regex, i, err)
+		}
+
+		labelRewrites = append(labelRewrites, metrics.Rewrite{
+			Regex:       regex,
+			Replacement: rewrite.Replacement,
+		})
+	}
+
+	return labelRewrites, nil
+}
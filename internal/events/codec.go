@@ -0,0 +1,93 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// envelope wraps an update with its kind, so it can be decoded into the right type.
+type envelope struct {
+	Kind   string          `json:"kind"`
+	Update json.RawMessage `json:"update"`
+}
+
+const (
+	pullKind     = "pull"
+	branchKind   = "branch"
+	commitKind   = "commit"
+	reviewKind   = "review"
+	jobKind      = "job"
+	workflowKind = "workflow"
+)
+
+// Encode serializes any of the updates into JSON, such that Decode can restore it.
+func Encode(update interface{}) ([]byte, error) {
+	var kind string
+
+	switch update.(type) {
+	case PullUpdate:
+		kind = pullKind
+	case BranchUpdate:
+		kind = branchKind
+	case CommitUpdate:
+		kind = commitKind
+	case ReviewUpdate:
+		kind = reviewKind
+	case JobUpdate:
+		kind = jobKind
+	case WorkflowUpdate:
+		kind = workflowKind
+	default:
+		return nil, fmt.Errorf("could not encode an update of type %T", update)
+	}
+
+	raw, err := json.Marshal(update)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(envelope{Kind: kind, Update: raw})
+}
+
+// Decode restores an update serialized by Encode.
+func Decode(data []byte) (interface{}, error) {
+	var env envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, err
+	}
+
+	switch env.Kind {
+	case pullKind:
+		var up PullUpdate
+		err := json.Unmarshal(env.Update, &up)
+
+		return up, err
+	case branchKind:
+		var up BranchUpdate
+		err := json.Unmarshal(env.Update, &up)
+
+		return up, err
+	case commitKind:
+		var up CommitUpdate
+		err := json.Unmarshal(env.Update, &up)
+
+		return up, err
+	case reviewKind:
+		var up ReviewUpdate
+		err := json.Unmarshal(env.Update, &up)
+
+		return up, err
+	case jobKind:
+		var up JobUpdate
+		err := json.Unmarshal(env.Update, &up)
+
+		return up, err
+	case workflowKind:
+		var up WorkflowUpdate
+		err := json.Unmarshal(env.Update, &up)
+
+		return up, err
+	}
+
+	return nil, fmt.Errorf("could not decode an update of kind '%s'", env.Kind)
+}
@@ -22,6 +22,14 @@ const (
 	Locked
 	Unlocked
 	Reopened
+	Synchronize
+	ConvertedToDraft
+	AutoMergeEnabled
+	AutoMergeDisabled
+	Enqueued
+	Dequeued
+	Milestoned
+	Demilestoned
 )
 
 var prToString = map[PREvent]string{
@@ -38,6 +46,14 @@ var prToString = map[PREvent]string{
 	Locked:               "locked",
 	Unlocked:             "unlocked",
 	Reopened:             "reopened",
+	Synchronize:          "synchronize",
+	ConvertedToDraft:     "converted_to_draft",
+	AutoMergeEnabled:     "auto_merge_enabled",
+	AutoMergeDisabled:    "auto_merge_disabled",
+	Enqueued:             "enqueued",
+	Dequeued:             "dequeued",
+	Milestoned:           "milestoned",
+	Demilestoned:         "demilestoned",
 }
 
 func (pre PREvent) String() string {
@@ -72,6 +88,35 @@ func (be BranchEvent) String() string {
 	return beToString[be]
 }
 
+type ReviewState int
+
+const (
+	_ ReviewState = iota
+	Commented
+	Approved
+	ChangesRequested
+)
+
+var reviewToString = map[ReviewState]string{
+	Commented:        "commented",
+	Approved:         "approved",
+	ChangesRequested: "changes_requested",
+}
+
+func (rs ReviewState) String() string {
+	return reviewToString[rs]
+}
+
+func ParseReviewState(in string) (ReviewState, error) {
+	for rs, ss := range reviewToString {
+		if in == ss {
+			return rs, nil
+		}
+	}
+
+	return 0, fmt.Errorf("could not translate '%s' into a ReviewState", in)
+}
+
 type Status int
 
 const (
@@ -80,22 +125,62 @@ const (
 	Success
 	Failure
 	Error
+	// The following are only reported by the Checks API
+	Neutral
+	Skipped
+	Cancelled
+	TimedOut
+	ActionRequired
+	Stale
 )
 
 var statusToString = map[Status]string{
-	Pending: "pending",
-	Success: "success",
-	Failure: "failure",
-	Error:   "error",
+	Pending:        "pending",
+	Success:        "success",
+	Failure:        "failure",
+	Error:          "error",
+	Neutral:        "neutral",
+	Skipped:        "skipped",
+	Cancelled:      "cancelled",
+	TimedOut:       "timed_out",
+	ActionRequired: "action_required",
+	Stale:          "stale",
 }
 
 func (s Status) String() string {
 	return statusToString[s]
 }
 
+// IsTerminal returns true if the status marks the end of a build.
+func (s Status) IsTerminal() bool {
+	_, ok := statusToString[s]
+
+	return ok && s != Pending
+}
+
+// IsPassing returns true if the status does not block merging a PR, as
+// GitHub treats neutral and skipped checks as successful.
+func (s Status) IsPassing() bool {
+	return s == Success || s == Neutral || s == Skipped
+}
+
+// IsFailing returns true if the status tells that the build is broken, as
+// opposed to, for example, being cancelled.
+func (s Status) IsFailing() bool {
+	return s == Failure || s == Error || s == TimedOut
+}
+
+// commitStates are the states a commit status can be in.
+var commitStates = []Status{Pending, Success, Failure, Error}
+
+// checkConclusions are the conclusions of a completed check run or check suite.
+var checkConclusions = []Status{Success, Failure, Neutral, Skipped, Cancelled, TimedOut, ActionRequired, Stale}
+
+// ParseStatus translates the state of a commit status into a Status. The
+// conclusions only reported by the Checks API are not states of a commit status.
 func ParseStatus(in string) (Status, error) {
-	for s, ss := range statusToString {
-		if in == ss {
+	for _, s := range commitStates {
+		if in == s.String() {
 			return s, nil
 		}
 	}
@@ -103,13 +188,35 @@ func ParseStatus(in string) (Status, error) {
 	return 0, fmt.Errorf("could not translate '%s' into a Status", in)
 }
 
+// ParseCheckStatus translates the status and the conclusion of a check run or
+// a check suite into a Status. Anything that is not completed is pending.
+func ParseCheckStatus(status, conclusion string) (Status, error) {
+	switch status {
+	case "requested", "queued", "in_progress", "waiting", "pending":
+		return Pending, nil
+	case "completed":
+		for _, s := range checkConclusions {
+			if conclusion == s.String() {
+				return s, nil
+			}
+		}
+
+		return 0, fmt.Errorf("could not translate conclusion '%s' into a Status", conclusion)
+	}
+
+	return 0, fmt.Errorf("could not translate check status '%s' into a Status", status)
+}
+
 // When there is an update to a Pull Request, such as creation, closing, re-opening.
 type PullUpdate struct {
 	Repo      string
 	Action    PREvent
 	SHA       string
+	OldSHA    string // Set only on synchronize, the head before the push
+	Base      string // The branch the PR is to be merged into
 	Number    int
 	Merged    bool
+	Opened    time.Time // When the PR was opened
 	Timestamp time.Time
 }
 
@@ -131,3 +238,37 @@ type CommitUpdate struct {
 	SHA       string
 	Timestamp time.Time
 }
+
+// When a PR gets a review, or a review comment, from someone else than its
+// author.
+type ReviewUpdate struct {
+	Repo      string
+	Number    int
+	SHA       string // The head of the PR
+	State     ReviewState
+	Opened    time.Time // When the PR was opened
+	Timestamp time.Time
+}
+
+// When a GitHub Actions job is queued, starts running, or completes.
+type JobUpdate struct {
+	Repo        string
+	Workflow    string
+	Job         string
+	Labels      []string // Runner labels, from the job's `runs-on:`
+	Status      Status
+	CreatedAt   time.Time // When the job got queued
+	StartedAt   time.Time // When a runner picked the job up
+	CompletedAt time.Time
+}
+
+// When a GitHub Actions workflow run is requested or completes.
+type WorkflowUpdate struct {
+	Repo        string
+	Workflow    string
+	Attempt     int
+	Status      Status
+	CreatedAt   time.Time // When the workflow run got requested
+	StartedAt   time.Time // When the current attempt started running
+	CompletedAt time.Time
+}
@@ -0,0 +1,78 @@
+package metrics
+
+import (
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Exemplar tells which PR, commit, and build an observation is about, in order
+// to find them from an outlier. Whatever is not known is left empty.
+type Exemplar struct {
+	PR      int // 0 for a branch
+	SHA     string
+	Context string
+}
+
+// shortSHA is the length of the abbreviated SHAs, as the labels of an exemplar
+// are limited to prometheus.ExemplarMaxRunes.
+const shortSHA = 12
+
+// exemplarLabels returns the labels of the exemplar, the most useful ones first,
+// leaving out the ones that do not fit.
+func (m *GithubMetrics) exemplarLabels(repository string, exemplar Exemplar) prometheus.Labels {
+	sha := exemplar.SHA
+	if len(sha) > shortSHA {
+		sha = sha[:shortSHA]
+	}
+
+	var htmlURL, pr string
+
+	switch {
+	case m.WebURL == "":
+	case exemplar.PR != 0:
+		htmlURL = fmt.Sprintf("%s%s/pull/%d", m.WebURL, repository, exemplar.PR)
+	case exemplar.SHA != "":
+		htmlURL = fmt.Sprintf("%s%s/commit/%s", m.WebURL, repository, exemplar.SHA)
+	}
+
+	if exemplar.PR != 0 {
+		pr = fmt.Sprint(exemplar.PR)
+	}
+
+	candidates := []struct{ name, value string }{
+		{"html_url", htmlURL},
+		{"pr", pr},
+		{"sha", sha},
+		{"context", exemplar.Context},
+		{"repository", repository},
+	}
+
+	labels := prometheus.Labels{}
+	runes := 0
+
+	for _, c := range candidates {
+		length := utf8.RuneCountInString(c.name) + utf8.RuneCountInString(c.value)
+		if c.value == "" || runes+length > prometheus.ExemplarMaxRunes {
+			continue
+		}
+
+		labels[c.name] = c.value
+		runes += length
+	}
+
+	return labels
+}
+
+// observe records the value, along with the exemplar.
+func (m *GithubMetrics) observe(observer prometheus.Observer, value float64, repository string, exemplar Exemplar) {
+	labels := m.exemplarLabels(repository, exemplar)
+
+	if eo, ok := observer.(prometheus.ExemplarObserver); ok && len(labels) != 0 {
+		eo.ObserveWithExemplar(value, labels)
+		return
+	}
+
+	observer.Observe(value)
+}
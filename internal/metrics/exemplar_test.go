@@ -0,0 +1,81 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func runes(labels prometheus.Labels) int {
+	total := 0
+	for name, value := range labels {
+		total += utf8.RuneCountInString(name) + utf8.RuneCountInString(value)
+	}
+
+	return total
+}
+
+func TestExemplarLabels(t *testing.T) {
+	m := GithubMetrics{WebURL: "https://github.com/"}
+	sha := "6dcb09b5b57875f334f61aebed695e2e4193db5e"
+
+	assert := assert.New(t)
+	assert.Equal(prometheus.Labels{
+		"html_url":   "https://github.com/knl/pulley/pull/42",
+		"pr":         "42",
+		"sha":        "6dcb09b5b578",
+		"context":    "ci/build",
+		"repository": "knl/pulley",
+	}, m.exemplarLabels("knl/pulley", Exemplar{PR: 42, SHA: sha, Context: "ci/build"}))
+
+	// A branch links to its commit
+	assert.Equal(prometheus.Labels{
+		"html_url":   "https://github.com/knl/pulley/commit/" + sha,
+		"sha":        "6dcb09b5b578",
+		"repository": "knl/pulley",
+	}, m.exemplarLabels("knl/pulley", Exemplar{SHA: sha}))
+
+	// Without the web UI, there is nothing to link to
+	m.WebURL = ""
+	assert.NotContains(m.exemplarLabels("knl/pulley", Exemplar{PR: 42, SHA: sha}), "html_url")
+}
+
+// The labels that would go over prometheus.ExemplarMaxRunes are left out, the
+// least useful ones first.
+func TestExemplarRuneBudget(t *testing.T) {
+	m := GithubMetrics{WebURL: "https://github.com/"}
+	sha := "6dcb09b5b57875f334f61aebed695e2e4193db5e"
+
+	// The link, the PR, and the SHA take 64 runes, the repository 20
+	tests := []struct {
+		name     string
+		context  string
+		expected []string
+	}{
+		{"AllFit", strings.Repeat("c", 37), []string{"html_url", "pr", "sha", "context", "repository"}},
+		{"RepositoryLeftOut", strings.Repeat("c", 40), []string{"html_url", "pr", "sha", "context"}},
+		{"ContextLeftOut", strings.Repeat("c", 60), []string{"html_url", "pr", "sha", "repository"}},
+		{"RunesNotBytes", strings.Repeat("é", 37), []string{"html_url", "pr", "sha", "context", "repository"}},
+	}
+
+	for _, tt := range tests {
+		tt := tt // see: https://github.com/kyoh86/scopelint/issues/4
+		t.Run(tt.name, func(t *testing.T) {
+			labels := m.exemplarLabels("knl/pulley", Exemplar{PR: 42, SHA: sha, Context: tt.context})
+
+			names := make([]string, 0, len(labels))
+			for _, name := range []string{"html_url", "pr", "sha", "context", "repository"} {
+				if _, ok := labels[name]; ok {
+					names = append(names, name)
+				}
+			}
+
+			assert := assert.New(t)
+			assert.Equal(tt.expected, names)
+			assert.LessOrEqual(runes(labels), prometheus.ExemplarMaxRunes)
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package metrics
+
+import (
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// otherValue replaces the values of a label that has too many distinct ones.
+const otherValue = "other"
+
+// Limits bounds the number of series, by bounding the number of distinct values
+// of the repository and build labels. The jobs of GitHub Actions count as
+// builds, and their workflows and runner labels get as many distinct values as
+// the builds, each. The zero value does not limit anything.
+type Limits struct {
+	MaxRepositories int       // 0 means unlimited
+	MaxBuilds       int       // 0 means unlimited, bounds the workflows and the runner labels too
+	BuildRewrites   []Rewrite // Applied to the builds before counting them, the first matching one wins
+}
+
+// Rewrite replaces the matches of Regex in a label value with Replacement,
+// which can refer to the submatches, as in regexp.Regexp.ReplaceAllString.
+type Rewrite struct {
+	Regex       *regexp.Regexp
+	Replacement string
+}
+
+// labelGuard folds the values of a label into otherValue, once it has seen max
+// distinct values. The values seen first keep being reported as they are.
+type labelGuard struct {
+	max    int
+	folded prometheus.Counter
+
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+func newLabelGuard(max int, folded prometheus.Counter) *labelGuard {
+	return &labelGuard{
+		max:    max,
+		folded: folded,
+		seen:   make(map[string]bool),
+	}
+}
+
+// value returns the label value of an observation, which takes room for the
+// value, if there is room left, or counts it as folded otherwise.
+func (g *labelGuard) value(value string) string {
+	if g.max <= 0 {
+		return value
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if !g.seen[value] {
+		if len(g.seen) >= g.max {
+			g.folded.Inc()
+			return otherValue
+		}
+
+		g.seen[value] = true
+	}
+
+	return value
+}
+
+// lookup returns the label values of figures reported over and over, such as
+// the gauges, without taking room for the values, nor counting the folded
+// ones. The values not observed yet are reported as they are as long as there
+// is room left for them, in order.
+func (g *labelGuard) lookup(values []string) map[string]string {
+	labels := make(map[string]string, len(values))
+
+	sorted := append([]string(nil), values...)
+	sort.Strings(sorted)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	room := g.max - len(g.seen)
+
+	for _, value := range sorted {
+		if _, ok := labels[value]; ok {
+			continue
+		}
+
+		switch {
+		case g.max <= 0 || g.seen[value]:
+			labels[value] = value
+		case room > 0:
+			labels[value] = value
+			room--
+		default:
+			labels[value] = otherValue
+		}
+	}
+
+	return labels
+}
+
+// rewriteBuild applies the first rewrite matching the build.
+func (m *GithubMetrics) rewriteBuild(build string) string {
+	for _, rewrite := range m.buildRewrites {
+		if rewrite.Regex.MatchString(build) {
+			return rewrite.Regex.ReplaceAllString(build, rewrite.Replacement)
+		}
+	}
+
+	return build
+}
+
+// repositoryLabel returns the value of the repository label for an observation
+// about the repository.
+func (m *GithubMetrics) repositoryLabel(repository string) string {
+	return m.repositories.value(repository)
+}
+
+// buildLabel returns the value of the build label for an observation about the
+// build, rewritten, and folded if there are too many builds.
+func (m *GithubMetrics) buildLabel(build string) string {
+	return m.builds.value(m.rewriteBuild(build))
+}
+
+// RepositoryLabels returns the values of the repository label for the
+// repositories, when reporting the figures of the live state. Unlike the
+// observations, this does not count the folded repositories.
+func (m *GithubMetrics) RepositoryLabels(repositories []string) map[string]string {
+	return m.repositories.lookup(repositories)
+}
+
+// BuildLabels returns the values of the build label for the builds, rewritten,
+// when reporting the figures of the live state. Unlike the observations, this
+// does not count the folded builds.
+func (m *GithubMetrics) BuildLabels(builds []string) map[string]string {
+	rewritten := make([]string, len(builds))
+	for i, build := range builds {
+		rewritten[i] = m.rewriteBuild(build)
+	}
+
+	labels := m.builds.lookup(rewritten)
+
+	byBuild := make(map[string]string, len(builds))
+	for i, build := range builds {
+		byBuild[build] = labels[rewritten[i]]
+	}
+
+	return byBuild
+}
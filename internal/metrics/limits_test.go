@@ -0,0 +1,166 @@
+package metrics
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/knl/pulley/internal/events"
+)
+
+// The values seen first keep their own series, while the later ones are
+// reported as "other", and counted.
+func TestLabelGuard(t *testing.T) {
+	folded := prometheus.NewCounter(prometheus.CounterOpts{Name: "folded"})
+	guard := newLabelGuard(2, folded)
+
+	assert := assert.New(t)
+	assert.Equal("knl/a", guard.value("knl/a"))
+	assert.Equal("knl/b", guard.value("knl/b"))
+	assert.Equal(otherValue, guard.value("knl/c"))
+	assert.Equal(otherValue, guard.value("knl/c"))
+	assert.Equal("knl/a", guard.value("knl/a"))
+	assert.Equal("knl/b", guard.value("knl/b"))
+	assert.Equal(float64(2), testutil.ToFloat64(folded))
+}
+
+func TestLabelGuardUnlimited(t *testing.T) {
+	guard := newLabelGuard(0, nil)
+
+	for _, value := range []string{"knl/a", "knl/b", "knl/c"} {
+		assert.Equal(t, value, guard.value(value))
+	}
+}
+
+// Looking the label values up for the gauges neither takes the room of the
+// values, nor counts the folded ones.
+func TestLabelLookup(t *testing.T) {
+	folded := prometheus.NewCounter(prometheus.CounterOpts{Name: "folded"})
+	guard := newLabelGuard(2, folded)
+
+	assert := assert.New(t)
+	assert.Equal("knl/pulley", guard.value("knl/pulley"))
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(map[string]string{
+			"knl/a":      "knl/a",
+			"knl/b":      otherValue,
+			"knl/pulley": "knl/pulley",
+		}, guard.lookup([]string{"knl/b", "knl/pulley", "knl/a", "knl/b"}))
+	}
+
+	assert.Equal(float64(0), testutil.ToFloat64(folded))
+
+	// The room left goes to the first observed value
+	assert.Equal("knl/b", guard.value("knl/b"))
+	assert.Equal(otherValue, guard.value("knl/a"))
+	assert.Equal(float64(1), testutil.ToFloat64(folded))
+}
+
+// The observations fold the repositories, and count them per label.
+func TestRepositoryFolded(t *testing.T) {
+	m := GithubMetrics{
+		PREvents: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "github_pull_request_total",
+		},
+			[]string{"repository", "event"},
+		),
+		FoldedLabels: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "github_label_values_folded_total",
+		},
+			[]string{"label"},
+		),
+	}
+	m.repositories = newLabelGuard(1, m.FoldedLabels.WithLabelValues("repository"))
+
+	m.RegisterPREvent("knl/pulley", events.Opened)
+	m.RegisterPREvent("knl/other", events.Opened)
+	m.RegisterPREvent("knl/another", events.Closed)
+
+	assert := assert.New(t)
+	assert.Equal(float64(1), testutil.ToFloat64(m.PREvents.WithLabelValues("knl/pulley", "opened")))
+	assert.Equal(float64(1), testutil.ToFloat64(m.PREvents.WithLabelValues(otherValue, "opened")))
+	assert.Equal(float64(1), testutil.ToFloat64(m.PREvents.WithLabelValues(otherValue, "closed")))
+	assert.Equal(float64(2), testutil.ToFloat64(m.FoldedLabels.WithLabelValues("repository")))
+}
+
+// Only the first matching rewrite applies, before the builds are counted.
+func TestBuildRewrites(t *testing.T) {
+	m := GithubMetrics{
+		builds: newLabelGuard(2, prometheus.NewCounter(prometheus.CounterOpts{Name: "folded"})),
+		buildRewrites: []Rewrite{
+			{regexp.MustCompile(`^(ci/build)-\d+$`), "$1"},
+			{regexp.MustCompile(`^ci/.*$`), "ci"},
+			{regexp.MustCompile(`-\d+$`), ""},
+		},
+	}
+
+	assert := assert.New(t)
+	assert.Equal("ci/build", m.buildLabel("ci/build-12"))
+	assert.Equal("ci/build", m.buildLabel("ci/build-13"))
+	assert.Equal("ci", m.buildLabel("ci/lint-1"))
+	assert.Equal(otherValue, m.buildLabel("test-2"))
+	assert.Equal(map[string]string{
+		"ci/build-14": "ci/build",
+		"test-3":      otherValue,
+	}, m.BuildLabels([]string{"ci/build-14", "test-3"}))
+}
+
+// The jobs fold with the builds, while the workflows and the runner labels fold
+// on their own.
+func TestJobsFolded(t *testing.T) {
+	histogram := func(name string, labels ...string) *prometheus.HistogramVec {
+		return prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name}, labels)
+	}
+
+	m := GithubMetrics{
+		JobQueuedDuration: histogram("github_actions_job_queued_duration_seconds", "repository", "workflow", "job", "runner_labels"),
+		JobDuration:       histogram("github_actions_job_duration_seconds", "repository", "workflow", "job", "runner_labels", "status"),
+		RunQueuedDuration: histogram("github_actions_workflow_queued_duration_seconds", "repository", "workflow"),
+		RunDuration:       histogram("github_actions_workflow_duration_seconds", "repository", "workflow", "status"),
+		FoldedLabels: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "github_label_values_folded_total",
+		},
+			[]string{"label"},
+		),
+		buildRewrites: []Rewrite{
+			{regexp.MustCompile(` \(.*\)$`), ""},
+		},
+	}
+	m.repositories = newLabelGuard(0, nil)
+	m.builds = newLabelGuard(1, m.FoldedLabels.WithLabelValues("build"))
+	m.workflows = newLabelGuard(1, m.FoldedLabels.WithLabelValues("workflow"))
+	m.runners = newLabelGuard(1, m.FoldedLabels.WithLabelValues("runner_labels"))
+
+	m.RegisterJobQueued("knl/pulley", "ci", "test (1.17)", "ubuntu-latest", 1)
+	m.RegisterJobQueued("knl/pulley", "ci", "test (1.18)", "ubuntu-latest", 1)
+	m.RegisterJobDone("knl/pulley", "release", "publish", "macos-latest", events.Success, 1)
+	m.RegisterRunQueued("knl/pulley", "ci", 1)
+	m.RegisterRunDone("knl/pulley", "nightly", events.Failure, 1)
+
+	assert := assert.New(t)
+	assert.Equal(1, testutil.CollectAndCount(m.JobQueuedDuration))
+	assert.Equal(1, testutil.CollectAndCount(m.JobDuration))
+	assert.Equal(1, testutil.CollectAndCount(m.RunQueuedDuration))
+	assert.Equal(1, testutil.CollectAndCount(m.RunDuration))
+
+	assert.Equal(uint64(2), sampleCount(t, m.JobQueuedDuration.WithLabelValues("knl/pulley", "ci", "test", "ubuntu-latest")))
+	assert.Equal(uint64(1), sampleCount(t, m.JobDuration.WithLabelValues("knl/pulley", otherValue, otherValue, otherValue, "success")))
+	assert.Equal(uint64(1), sampleCount(t, m.RunQueuedDuration.WithLabelValues("knl/pulley", "ci")))
+	assert.Equal(uint64(1), sampleCount(t, m.RunDuration.WithLabelValues("knl/pulley", otherValue, "failure")))
+
+	assert.Equal(float64(1), testutil.ToFloat64(m.FoldedLabels.WithLabelValues("build")))
+	assert.Equal(float64(2), testutil.ToFloat64(m.FoldedLabels.WithLabelValues("workflow")))
+	assert.Equal(float64(1), testutil.ToFloat64(m.FoldedLabels.WithLabelValues("runner_labels")))
+}
+
+func sampleCount(t *testing.T, observer prometheus.Observer) uint64 {
+	var metric dto.Metric
+	assert.NoError(t, observer.(prometheus.Metric).Write(&metric))
+
+	return metric.GetHistogram().GetSampleCount()
+}
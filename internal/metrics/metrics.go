@@ -1,7 +1,14 @@
 package metrics
 
 import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"github.com/knl/pulley/internal/events"
 	"github.com/knl/pulley/internal/version"
@@ -17,9 +24,74 @@ type GithubMetrics struct {
 	PRValidatedDuration *prometheus.HistogramVec // The distribution of the durations between PR creation and the status check that makes the PR mergeable (required status check)
 	PRMergedDuration    *prometheus.HistogramVec // The distribution of the duration between PR creation and the time it was merged
 	BuildDuration       *prometheus.HistogramVec // The distribution of the build durations
+	JobQueuedDuration   *prometheus.HistogramVec // The distribution of the durations GitHub Actions jobs wait for a runner
+	JobDuration         *prometheus.HistogramVec // The distribution of the durations GitHub Actions jobs run on a runner
+	RunQueuedDuration   *prometheus.HistogramVec // The distribution of the durations GitHub Actions workflow runs wait to start
+	RunDuration         *prometheus.HistogramVec // The distribution of the durations GitHub Actions workflow runs take to complete
+	TrackedSHAs         prometheus.Gauge         // The number of SHAs currently tracked
+	SHAEvictions        *prometheus.CounterVec   // The number of tracked SHAs evicted before their PR or branch was closed
+	DroppedUpdates      *prometheus.CounterVec   // The number of webhooks dropped due to the queue being full
+	SpilledUpdates      prometheus.Counter       // The number of webhooks spilled to disk due to the queue being full
+	DuplicateDeliveries *prometheus.CounterVec   // The number of webhooks ignored, due to being delivered before
+	ValidatedDeliveries *prometheus.CounterVec   // The number of webhooks validated, per secret token
+	ReloadFailures      prometheus.Counter       // The number of configuration reloads rejected
+	FirstFailure        *prometheus.HistogramVec // Histogram of how long it takes for a PR to get its first failure
+	ReviewDuration      *prometheus.HistogramVec // The distribution of the durations between PR creation and its first review, request for changes, and approval
+	ApprovedMerged      *prometheus.HistogramVec // The distribution of the durations between the first approval of a PR and the time it was merged
+	PushMerged          *prometheus.HistogramVec // The distribution of the durations between the last push to a PR and the time it was merged
+	MergedPushes        *prometheus.HistogramVec // The distribution of the number of pushes to a PR until it was merged
+	BuildRetries        *prometheus.CounterVec   // The number of builds restarted on the same SHA
+	FlakyBuilds         *prometheus.CounterVec   // The number of builds that passed after failing on the same SHA
+	StuckBuilds         *prometheus.GaugeVec     // The number of builds pending for longer than they should
+	AbandonedBuilds     *prometheus.CounterVec   // The number of stuck builds whose SHA was forgotten before they finished
+	FoldedLabels        *prometheus.CounterVec   // The number of label values replaced by "other", due to the label having too many distinct values
+
+	WebURL string // GitHub's web UI, to link the exemplars to their PR or commit, empty leaves the links out
+
+	repositories  *labelGuard
+	builds        *labelGuard
+	buildRewrites []Rewrite
+	workflows     *labelGuard
+	runners       *labelGuard
+
+	stuckMu           sync.Mutex
+	stuckRepositories map[string]int // The repositories reported by StuckBuilds
 }
 
-func NewGithubMetrics() *GithubMetrics {
+// Histograms tells which buckets the histograms have. The zero value keeps the
+// default classic buckets, without native ones.
+type Histograms struct {
+	Buckets          map[string][]float64 // The upper bounds of the classic buckets, per histogram, in place of the default ones
+	NoClassic        bool                 // Drops the classic buckets, for native histograms only
+	NativeFactor     float64              // How much wider each native bucket is than the previous one, no native buckets unless greater than 1
+	NativeMaxBuckets uint32               // The maximal number of native buckets, 0 means unlimited
+}
+
+// NewGithubMetrics creates and registers the metrics, with the repository,
+// build, workflow, and runner labels bounded by limits. Naming anything else than a histogram in the
+// buckets is an error.
+func NewGithubMetrics(histograms Histograms, limits Limits) (*GithubMetrics, error) {
+	names := make(map[string]bool)
+
+	histogramOpts := func(opts prometheus.HistogramOpts) prometheus.HistogramOpts {
+		names[opts.Name] = true
+
+		if bounds, ok := histograms.Buckets[opts.Name]; ok {
+			opts.Buckets = bounds
+		}
+
+		// Dropping the classic buckets leaves none, as client_golang falls back
+		// to its default ones only for histograms without native buckets
+		if histograms.NoClassic && histograms.NativeFactor > 1 {
+			opts.Buckets = nil
+		}
+
+		opts.NativeHistogramBucketFactor = histograms.NativeFactor
+		opts.NativeHistogramMaxBucketNumber = histograms.NativeMaxBuckets
+
+		return opts
+	}
+
 	metrics := &GithubMetrics{
 		PREvents: prometheus.NewCounterVec(prometheus.CounterOpts{
 			Name: "github_pull_request_events_total",
@@ -46,41 +118,207 @@ func NewGithubMetrics() *GithubMetrics {
 			[]string{"repository"},
 		),
 		CINoticedDuration: prometheus.NewHistogramVec(
-			prometheus.HistogramOpts{
+			histogramOpts(prometheus.HistogramOpts{
 				Name: "github_ci_noticed_duration_seconds",
 				Help: "The time it takes for a CI to send the first 'pending' status check, measured from opening the PR",
 				// Start from 1 second, move up to 8*1024 seconds (~80min)
 				Buckets: prometheus.ExponentialBuckets(1, 2, 14),
-			},
+			}),
 			[]string{"repository"},
 		),
 		PRValidatedDuration: prometheus.NewHistogramVec(
-			prometheus.HistogramOpts{
+			histogramOpts(prometheus.HistogramOpts{
 				Name: "github_pull_request_validated_duration_seconds",
 				Help: "The time it takes for a CI to build a PR, measured from opening the PR until the required status check is finished, per status",
 				// Start from 1 second, move up to 8*1024 seconds (~2h30)
 				Buckets: prometheus.ExponentialBuckets(1, 2, 14),
-			},
+			}),
 			[]string{"repository", "status"},
 		),
 		PRMergedDuration: prometheus.NewHistogramVec(
-			prometheus.HistogramOpts{
+			histogramOpts(prometheus.HistogramOpts{
 				Name: "github_pull_request_merged_duration_seconds",
 				Help: "The time it takes for a PR to be merged, measured from opening the PR",
 				// Start from 1 minute, move up to 8*1024 seconds (~6 days)
 				Buckets: prometheus.ExponentialBuckets(60, 2, 14),
-			},
+			}),
 			[]string{"repository"},
 		),
 		BuildDuration: prometheus.NewHistogramVec(
-			prometheus.HistogramOpts{
+			histogramOpts(prometheus.HistogramOpts{
 				Name: "github_ci_build_duration_seconds",
 				Help: "The time it takes for a build",
 				// Start from 1 second, move up to 512s (~9min)
 				Buckets: prometheus.ExponentialBuckets(1, 2, 10),
-			},
+			}),
+			[]string{"repository", "build", "status"},
+		),
+		JobQueuedDuration: prometheus.NewHistogramVec(
+			histogramOpts(prometheus.HistogramOpts{
+				Name: "github_actions_job_queued_duration_seconds",
+				Help: "The time a GitHub Actions job waits for a runner, measured from queueing the job until it starts",
+				// Start from 1 second, move up to 8*1024 seconds (~2h30)
+				Buckets: prometheus.ExponentialBuckets(1, 2, 14),
+			}),
+			[]string{"repository", "workflow", "job", "runner_labels"},
+		),
+		JobDuration: prometheus.NewHistogramVec(
+			histogramOpts(prometheus.HistogramOpts{
+				Name: "github_actions_job_duration_seconds",
+				Help: "The time a GitHub Actions job runs, measured from the start of the job until it completes",
+				// Start from 1 second, move up to 8*1024 seconds (~2h30)
+				Buckets: prometheus.ExponentialBuckets(1, 2, 14),
+			}),
+			[]string{"repository", "workflow", "job", "runner_labels", "status"},
+		),
+		RunQueuedDuration: prometheus.NewHistogramVec(
+			histogramOpts(prometheus.HistogramOpts{
+				Name: "github_actions_workflow_queued_duration_seconds",
+				Help: "The time a GitHub Actions workflow run waits, measured from requesting the run until it starts",
+				// Start from 1 second, move up to 8*1024 seconds (~2h30)
+				Buckets: prometheus.ExponentialBuckets(1, 2, 14),
+			}),
+			[]string{"repository", "workflow"},
+		),
+		RunDuration: prometheus.NewHistogramVec(
+			histogramOpts(prometheus.HistogramOpts{
+				Name: "github_actions_workflow_duration_seconds",
+				Help: "The time a GitHub Actions workflow run takes, measured from the start of the run until it completes",
+				// Start from 1 second, move up to 8*1024 seconds (~2h30)
+				Buckets: prometheus.ExponentialBuckets(1, 2, 14),
+			}),
+			[]string{"repository", "workflow", "status"},
+		),
+		TrackedSHAs: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "github_tracked_shas",
+			Help: "The number of commit SHAs currently tracked",
+		}),
+		SHAEvictions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "github_tracked_sha_evictions_total",
+			Help: "The number of tracked commit SHAs evicted, either due to not being updated for too long, or due to tracking too many",
+		},
+			[]string{"reason"},
+		),
+		DroppedUpdates: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "webhook_dropped_updates_total",
+			Help: "The number of webhooks dropped, due to no room in the queue of updates to process",
+		},
+			[]string{"reason"},
+		),
+		SpilledUpdates: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "webhook_spilled_updates_total",
+			Help: "The number of webhooks spilled to disk, due to no room in the queue of updates to process",
+		}),
+		DuplicateDeliveries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "webhook_duplicate_deliveries_total",
+			Help: "The number of webhooks ignored, due to having the same delivery GUID as a webhook already processed",
+		},
+			[]string{"event"},
+		),
+		ValidatedDeliveries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "webhook_validated_deliveries_total",
+			Help: "The number of webhooks validated, by the index of the secret token that validated them",
+		},
+			[]string{"secret"},
+		),
+		FirstFailure: prometheus.NewHistogramVec(
+			histogramOpts(prometheus.HistogramOpts{
+				Name: "github_pull_request_first_failure_duration_seconds",
+				Help: "The time it takes for a CI to tell that a PR is broken, measured from opening the PR until the first failed status check, per build",
+				// Start from 1 second, move up to 8*1024 seconds (~2h30)
+				Buckets: prometheus.ExponentialBuckets(1, 2, 14),
+			}),
 			[]string{"repository", "build", "status"},
 		),
+		ReviewDuration: prometheus.NewHistogramVec(
+			histogramOpts(prometheus.HistogramOpts{
+				Name: "github_pull_request_review_duration_seconds",
+				Help: "The time it takes for a PR to be reviewed, measured from opening the PR until its first review, its first request for changes, and its first approval",
+				// Start from 1 minute, move up to 8*1024 minutes (~6 days)
+				Buckets: prometheus.ExponentialBuckets(60, 2, 14),
+			}),
+			[]string{"repository", "review"},
+		),
+		ApprovedMerged: prometheus.NewHistogramVec(
+			histogramOpts(prometheus.HistogramOpts{
+				Name: "github_pull_request_approved_merged_duration_seconds",
+				Help: "The time it takes for a PR to be merged, measured from its first approval",
+				// Start from 1 minute, move up to 8*1024 minutes (~6 days)
+				Buckets: prometheus.ExponentialBuckets(60, 2, 14),
+			}),
+			[]string{"repository"},
+		),
+		PushMerged: prometheus.NewHistogramVec(
+			histogramOpts(prometheus.HistogramOpts{
+				Name: "github_pull_request_last_push_merged_duration_seconds",
+				Help: "The time it takes for a PR to be merged, measured from the last push to the PR",
+				// Start from 1 minute, move up to 8*1024 minutes (~6 days)
+				Buckets: prometheus.ExponentialBuckets(60, 2, 14),
+			}),
+			[]string{"repository"},
+		),
+		MergedPushes: prometheus.NewHistogramVec(
+			histogramOpts(prometheus.HistogramOpts{
+				Name: "github_pull_request_merged_pushes",
+				Help: "The number of times a PR got pushed to after opening it, that is, how many times the CI had to build it again, until it was merged",
+				// Fibonacci-like, as most PRs need only a few pushes
+				Buckets: []float64{0, 1, 2, 3, 5, 8, 13, 21, 34},
+			}),
+			[]string{"repository"},
+		),
+		BuildRetries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "github_ci_build_retries_total",
+			Help: "The number of times a build was restarted after finishing, without a change to the code",
+		},
+			[]string{"repository", "build"},
+		),
+		FlakyBuilds: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "github_ci_build_flaky_total",
+			Help: "The number of times a build passed after failing, without a change to the code",
+		},
+			[]string{"repository", "build"},
+		),
+		StuckBuilds: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "github_ci_stuck_builds",
+			Help: "The number of builds currently pending for longer than their stuck rule allows",
+		},
+			[]string{"repository"},
+		),
+		AbandonedBuilds: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "github_ci_abandoned_builds_total",
+			Help: "The number of stuck builds that never finished, as their SHA stopped being tracked",
+		},
+			[]string{"repository", "build"},
+		),
+		FoldedLabels: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "github_label_values_folded_total",
+			Help: "The number of times a value of the label was replaced by 'other', as the label had too many distinct values",
+		},
+			[]string{"label"},
+		),
+		ReloadFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "config_reload_failures_total",
+			Help: "The number of configuration reloads rejected, due to an invalid configuration",
+		}),
+	}
+
+	metrics.repositories = newLabelGuard(limits.MaxRepositories, metrics.FoldedLabels.WithLabelValues("repository"))
+	metrics.builds = newLabelGuard(limits.MaxBuilds, metrics.FoldedLabels.WithLabelValues("build"))
+	metrics.buildRewrites = limits.BuildRewrites
+	metrics.workflows = newLabelGuard(limits.MaxBuilds, metrics.FoldedLabels.WithLabelValues("workflow"))
+	metrics.runners = newLabelGuard(limits.MaxBuilds, metrics.FoldedLabels.WithLabelValues("runner_labels"))
+
+	var unknown []string
+
+	for name := range histograms.Buckets {
+		if !names[name] {
+			unknown = append(unknown, name)
+		}
+	}
+
+	if len(unknown) != 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("buckets given for %v, which are not histograms", unknown)
 	}
 
 	prometheus.MustRegister(metrics.PREvents)
@@ -91,50 +329,211 @@ func NewGithubMetrics() *GithubMetrics {
 	prometheus.MustRegister(metrics.PRValidatedDuration)
 	prometheus.MustRegister(metrics.PRMergedDuration)
 	prometheus.MustRegister(metrics.BuildDuration)
+	prometheus.MustRegister(metrics.JobQueuedDuration)
+	prometheus.MustRegister(metrics.JobDuration)
+	prometheus.MustRegister(metrics.RunQueuedDuration)
+	prometheus.MustRegister(metrics.RunDuration)
+	prometheus.MustRegister(metrics.TrackedSHAs)
+	prometheus.MustRegister(metrics.SHAEvictions)
+	prometheus.MustRegister(metrics.DroppedUpdates)
+	prometheus.MustRegister(metrics.SpilledUpdates)
+	prometheus.MustRegister(metrics.DuplicateDeliveries)
+	prometheus.MustRegister(metrics.ValidatedDeliveries)
+	prometheus.MustRegister(metrics.ReloadFailures)
+	prometheus.MustRegister(metrics.FirstFailure)
+	prometheus.MustRegister(metrics.ReviewDuration)
+	prometheus.MustRegister(metrics.ApprovedMerged)
+	prometheus.MustRegister(metrics.PushMerged)
+	prometheus.MustRegister(metrics.MergedPushes)
+	prometheus.MustRegister(metrics.BuildRetries)
+	prometheus.MustRegister(metrics.FlakyBuilds)
+	prometheus.MustRegister(metrics.StuckBuilds)
+	prometheus.MustRegister(metrics.AbandonedBuilds)
+	prometheus.MustRegister(metrics.FoldedLabels)
 	prometheus.MustRegister(version.NewCollector())
 
-	return metrics
+	return metrics, nil
+}
+
+// Handler serves the registered metrics. The native buckets are only exposed in
+// the protobuf format, and the exemplars in the protobuf and OpenMetrics
+// formats, which the handler serves to scrapers asking for them.
+func Handler() http.Handler {
+	return promhttp.InstrumentMetricHandler(
+		prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true}),
+	)
 }
 
 type Publisher interface {
-	RegisterMerge(repository string, durationSeconds float64)
-	RegisterStart(repository string, durationSeconds float64)
-	RegisterValidation(repository string, status events.Status, durationSeconds float64)
-	RegisterBuildDone(repository string, build string, state events.Status, durationSeconds float64)
+	RegisterMerge(repository string, durationSeconds float64, exemplar Exemplar)
+	RegisterStart(repository string, durationSeconds float64, exemplar Exemplar)
+	RegisterValidation(repository string, status events.Status, durationSeconds float64, exemplar Exemplar)
+	RegisterBuildDone(repository string, build string, state events.Status, durationSeconds float64, exemplar Exemplar)
 	RegisterPREvent(repository string, event events.PREvent)
 	RegisterBranchEvent(repository string, event events.BranchEvent)
 	RegisterStatusCheck(repository string, state events.Status)
 	RegisterMissedPending(repository string)
+	RegisterJobQueued(repository string, workflow string, job string, runnerLabels string, durationSeconds float64)
+	RegisterJobDone(repository string, workflow string, job string, runnerLabels string, status events.Status, durationSeconds float64)
+	RegisterRunQueued(repository string, workflow string, durationSeconds float64)
+	RegisterRunDone(repository string, workflow string, status events.Status, durationSeconds float64)
+	RegisterTrackedSHAs(count int)
+	RegisterEviction(reason string)
+	RegisterDroppedUpdate(reason string)
+	RegisterSpilledUpdate()
+	RegisterDuplicateDelivery(event string)
+	RegisterValidatedDelivery(secret int)
+	RegisterReloadFailure()
+	RegisterFirstFailure(repository string, build string, status events.Status, durationSeconds float64, exemplar Exemplar)
+	RegisterReview(repository string, review string, durationSeconds float64, exemplar Exemplar)
+	RegisterApprovedMerge(repository string, durationSeconds float64, exemplar Exemplar)
+	RegisterLastPushMerge(repository string, durationSeconds float64, exemplar Exemplar)
+	RegisterMergedPushes(repository string, pushes int, exemplar Exemplar)
+	RegisterRetry(repository string, build string)
+	RegisterFlaky(repository string, build string)
+	RegisterStuckBuilds(counts map[string]int)
+	RegisterAbandonedBuild(repository string, build string)
+	RepositoryLabels(repositories []string) map[string]string
+	BuildLabels(builds []string) map[string]string
 }
 
-func (m *GithubMetrics) RegisterMerge(repository string, durationSeconds float64) {
-	m.PRMergedDuration.With(prometheus.Labels{"repository": repository}).Observe(durationSeconds)
+func (m *GithubMetrics) RegisterMerge(repository string, durationSeconds float64, exemplar Exemplar) {
+	m.observe(m.PRMergedDuration.With(prometheus.Labels{"repository": m.repositoryLabel(repository)}), durationSeconds, repository, exemplar)
 }
 
-func (m *GithubMetrics) RegisterStart(repository string, durationSeconds float64) {
-	m.CINoticedDuration.With(prometheus.Labels{"repository": repository}).Observe(durationSeconds)
+func (m *GithubMetrics) RegisterStart(repository string, durationSeconds float64, exemplar Exemplar) {
+	m.observe(m.CINoticedDuration.With(prometheus.Labels{"repository": m.repositoryLabel(repository)}), durationSeconds, repository, exemplar)
 }
 
-func (m *GithubMetrics) RegisterValidation(repository string, status events.Status, durationSeconds float64) {
-	m.PRValidatedDuration.With(prometheus.Labels{"repository": repository, "status": status.String()}).Observe(durationSeconds)
+func (m *GithubMetrics) RegisterValidation(repository string, status events.Status, durationSeconds float64, exemplar Exemplar) {
+	m.observe(m.PRValidatedDuration.With(prometheus.Labels{"repository": m.repositoryLabel(repository), "status": status.String()}), durationSeconds, repository, exemplar)
 }
 
-func (m *GithubMetrics) RegisterBuildDone(repository string, build string, status events.Status, durationSeconds float64) {
-	m.BuildDuration.With(prometheus.Labels{"repository": repository, "build": build, "status": status.String()}).Observe(durationSeconds)
+func (m *GithubMetrics) RegisterBuildDone(repository string, build string, status events.Status, durationSeconds float64, exemplar Exemplar) {
+	m.observe(m.BuildDuration.With(prometheus.Labels{"repository": m.repositoryLabel(repository), "build": m.buildLabel(build), "status": status.String()}), durationSeconds, repository, exemplar)
 }
 
 func (m *GithubMetrics) RegisterPREvent(repository string, event events.PREvent) {
-	m.PREvents.With(prometheus.Labels{"repository": repository, "event": event.String()}).Inc()
+	m.PREvents.With(prometheus.Labels{"repository": m.repositoryLabel(repository), "event": event.String()}).Inc()
 }
 
 func (m *GithubMetrics) RegisterBranchEvent(repository string, event events.BranchEvent) {
-	m.BranchEvents.With(prometheus.Labels{"repository": repository, "event": event.String()}).Inc()
+	m.BranchEvents.With(prometheus.Labels{"repository": m.repositoryLabel(repository), "event": event.String()}).Inc()
 }
 
 func (m *GithubMetrics) RegisterStatusCheck(repository string, state events.Status) {
-	m.StatusChecks.With(prometheus.Labels{"repository": repository, "state": state.String()}).Inc()
+	m.StatusChecks.With(prometheus.Labels{"repository": m.repositoryLabel(repository), "state": state.String()}).Inc()
 }
 
 func (m *GithubMetrics) RegisterMissedPending(repository string) {
-	m.MissedPendings.With(prometheus.Labels{"repository": repository}).Inc()
+	m.MissedPendings.With(prometheus.Labels{"repository": m.repositoryLabel(repository)}).Inc()
+}
+
+func (m *GithubMetrics) RegisterJobQueued(repository string, workflow string, job string, runnerLabels string, durationSeconds float64) {
+	m.JobQueuedDuration.With(prometheus.Labels{"repository": m.repositoryLabel(repository), "workflow": m.workflows.value(workflow), "job": m.buildLabel(job), "runner_labels": m.runners.value(runnerLabels)}).Observe(durationSeconds)
+}
+
+func (m *GithubMetrics) RegisterJobDone(repository string, workflow string, job string, runnerLabels string, status events.Status, durationSeconds float64) {
+	m.JobDuration.With(prometheus.Labels{"repository": m.repositoryLabel(repository), "workflow": m.workflows.value(workflow), "job": m.buildLabel(job), "runner_labels": m.runners.value(runnerLabels), "status": status.String()}).Observe(durationSeconds)
+}
+
+func (m *GithubMetrics) RegisterRunQueued(repository string, workflow string, durationSeconds float64) {
+	m.RunQueuedDuration.With(prometheus.Labels{"repository": m.repositoryLabel(repository), "workflow": m.workflows.value(workflow)}).Observe(durationSeconds)
+}
+
+func (m *GithubMetrics) RegisterRunDone(repository string, workflow string, status events.Status, durationSeconds float64) {
+	m.RunDuration.With(prometheus.Labels{"repository": m.repositoryLabel(repository), "workflow": m.workflows.value(workflow), "status": status.String()}).Observe(durationSeconds)
+}
+
+func (m *GithubMetrics) RegisterTrackedSHAs(count int) {
+	m.TrackedSHAs.Set(float64(count))
+}
+
+func (m *GithubMetrics) RegisterEviction(reason string) {
+	m.SHAEvictions.With(prometheus.Labels{"reason": reason}).Inc()
+}
+
+func (m *GithubMetrics) RegisterDroppedUpdate(reason string) {
+	m.DroppedUpdates.With(prometheus.Labels{"reason": reason}).Inc()
+}
+
+func (m *GithubMetrics) RegisterSpilledUpdate() {
+	m.SpilledUpdates.Inc()
+}
+
+func (m *GithubMetrics) RegisterDuplicateDelivery(event string) {
+	m.DuplicateDeliveries.With(prometheus.Labels{"event": event}).Inc()
+}
+
+func (m *GithubMetrics) RegisterValidatedDelivery(secret int) {
+	m.ValidatedDeliveries.With(prometheus.Labels{"secret": strconv.Itoa(secret)}).Inc()
+}
+
+func (m *GithubMetrics) RegisterReloadFailure() {
+	m.ReloadFailures.Inc()
+}
+
+func (m *GithubMetrics) RegisterFirstFailure(repository string, build string, status events.Status, durationSeconds float64, exemplar Exemplar) {
+	m.observe(m.FirstFailure.With(prometheus.Labels{"repository": m.repositoryLabel(repository), "build": m.buildLabel(build), "status": status.String()}), durationSeconds, repository, exemplar)
+}
+
+func (m *GithubMetrics) RegisterReview(repository string, review string, durationSeconds float64, exemplar Exemplar) {
+	m.observe(m.ReviewDuration.With(prometheus.Labels{"repository": m.repositoryLabel(repository), "review": review}), durationSeconds, repository, exemplar)
+}
+
+func (m *GithubMetrics) RegisterApprovedMerge(repository string, durationSeconds float64, exemplar Exemplar) {
+	m.observe(m.ApprovedMerged.With(prometheus.Labels{"repository": m.repositoryLabel(repository)}), durationSeconds, repository, exemplar)
+}
+
+func (m *GithubMetrics) RegisterLastPushMerge(repository string, durationSeconds float64, exemplar Exemplar) {
+	m.observe(m.PushMerged.With(prometheus.Labels{"repository": m.repositoryLabel(repository)}), durationSeconds, repository, exemplar)
+}
+
+func (m *GithubMetrics) RegisterMergedPushes(repository string, pushes int, exemplar Exemplar) {
+	m.observe(m.MergedPushes.With(prometheus.Labels{"repository": m.repositoryLabel(repository)}), float64(pushes), repository, exemplar)
+}
+
+func (m *GithubMetrics) RegisterRetry(repository string, build string) {
+	m.BuildRetries.With(prometheus.Labels{"repository": m.repositoryLabel(repository), "build": m.buildLabel(build)}).Inc()
+}
+
+func (m *GithubMetrics) RegisterFlaky(repository string, build string) {
+	m.FlakyBuilds.With(prometheus.Labels{"repository": m.repositoryLabel(repository), "build": m.buildLabel(build)}).Inc()
+}
+
+func (m *GithubMetrics) RegisterStuckBuilds(counts map[string]int) {
+	repositories := make([]string, 0, len(counts))
+	for repository := range counts {
+		repositories = append(repositories, repository)
+	}
+
+	// Several repositories might be reported as "other"
+	labels := m.RepositoryLabels(repositories)
+
+	folded := make(map[string]int)
+	for repository, count := range counts {
+		folded[labels[repository]] += count
+	}
+
+	m.stuckMu.Lock()
+	defer m.stuckMu.Unlock()
+
+	for repository, count := range folded {
+		m.StuckBuilds.With(prometheus.Labels{"repository": repository}).Set(float64(count))
+	}
+
+	// Repositories without stuck builds are not reported anymore. They are
+	// deleted only once the others are set, so no scrape misses them all.
+	for repository := range m.stuckRepositories {
+		if _, ok := folded[repository]; !ok {
+			m.StuckBuilds.DeleteLabelValues(repository)
+		}
+	}
+
+	m.stuckRepositories = folded
+}
+
+func (m *GithubMetrics) RegisterAbandonedBuild(repository string, build string) {
+	m.AbandonedBuilds.With(prometheus.Labels{"repository": m.repositoryLabel(repository), "build": m.buildLabel(build)}).Inc()
 }
@@ -0,0 +1,91 @@
+package metrics
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+)
+
+// Only the repositories without stuck builds anymore stop being reported.
+func TestStuckBuildsUpdated(t *testing.T) {
+	m := GithubMetrics{
+		StuckBuilds: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "github_ci_stuck_builds",
+		},
+			[]string{"repository"},
+		),
+		repositories: newLabelGuard(0, nil),
+	}
+
+	m.RegisterStuckBuilds(map[string]int{"knl/pulley": 2, "knl/other": 1})
+	m.RegisterStuckBuilds(map[string]int{"knl/pulley": 1})
+
+	assert := assert.New(t)
+	assert.Equal(1, testutil.CollectAndCount(m.StuckBuilds))
+	assert.Equal(float64(1), testutil.ToFloat64(m.StuckBuilds.WithLabelValues("knl/pulley")))
+
+	m.RegisterStuckBuilds(map[string]int{})
+	assert.Equal(0, testutil.CollectAndCount(m.StuckBuilds))
+}
+
+func scrape(accept string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Accept", accept)
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, req)
+
+	return rec
+}
+
+// Native histograms without classic buckets are served to scrapers asking for
+// protobuf, while the others still get OpenMetrics.
+func TestNativeHistogramsServed(t *testing.T) {
+	m, err := NewGithubMetrics(Histograms{NoClassic: true, NativeFactor: 1.1}, Limits{})
+
+	assert := assert.New(t)
+	assert.NoError(err)
+
+	m.RegisterMerge("knl/pulley", 90, Exemplar{})
+
+	rec := scrape(string(expfmt.FmtProtoDelim))
+	assert.Equal(expfmt.FmtProtoDelim, expfmt.ResponseFormat(rec.Header()))
+
+	var histogram *dto.Histogram
+
+	decoder := expfmt.NewDecoder(rec.Body, expfmt.FmtProtoDelim)
+
+	for {
+		var family dto.MetricFamily
+		if err := decoder.Decode(&family); err != nil {
+			break
+		}
+
+		if family.GetName() == "github_pull_request_merged_duration_seconds" {
+			histogram = family.GetMetric()[0].GetHistogram()
+		}
+	}
+
+	if assert.NotNil(histogram) {
+		assert.Equal(uint64(1), histogram.GetSampleCount())
+		assert.Equal(int32(3), histogram.GetSchema())
+		assert.NotEmpty(histogram.GetPositiveSpan())
+
+		// Only the exemplar is carried in a bucket, with an infinite bound
+		for _, bucket := range histogram.GetBucket() {
+			assert.True(math.IsInf(bucket.GetUpperBound(), 1))
+		}
+	}
+
+	rec = scrape(string(expfmt.FmtOpenMetrics))
+	assert.True(strings.HasPrefix(rec.Header().Get("Content-Type"), expfmt.OpenMetricsType))
+	assert.Contains(rec.Body.String(), "github_pull_request_merged_duration_seconds_count{repository=\"knl/pulley\"} 1")
+}
@@ -0,0 +1,242 @@
+// Package protection discovers the status checks required by the branch
+// protection of a repository, using GitHub's API.
+package protection
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/v50/github"
+)
+
+// How long to wait for GitHub's API before giving up.
+const requestTimeout = 10 * time.Second
+
+type branch struct {
+	repo, name string
+}
+
+type entry struct {
+	contexts []string
+	fetched  time.Time
+}
+
+// Client fetches the required status checks in the background, and caches
+// them for refresh.
+type Client struct {
+	gh      *github.Client
+	refresh time.Duration
+
+	mu             sync.Mutex
+	required       map[branch]entry
+	defaultBranch  map[string]string
+	defaultFetched map[string]time.Time
+	refreshing     map[branch]bool // The entries being fetched in the background
+}
+
+// New creates a client authenticated with token, if not empty. The baseURL,
+// if not empty, replaces GitHub's API endpoint, for example, with the one of
+// GitHub Enterprise Server, that is, https://[hostname]/api/v3/.
+func New(token, baseURL string, refresh time.Duration) (*Client, error) {
+	gh := github.NewClient(nil)
+	if token != "" {
+		gh = github.NewTokenClient(context.Background(), token)
+	}
+
+	if baseURL != "" {
+		u, err := url.Parse(baseURL)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse the GitHub API URL '%s', %v", baseURL, err)
+		}
+
+		// The client resolves the API paths relative to the base URL
+		if !strings.HasSuffix(u.Path, "/") {
+			u.Path += "/"
+		}
+
+		gh.BaseURL = u
+	}
+
+	return &Client{
+		gh:             gh,
+		refresh:        refresh,
+		required:       make(map[branch]entry),
+		defaultBranch:  make(map[string]string),
+		defaultFetched: make(map[string]time.Time),
+		refreshing:     make(map[branch]bool),
+	}, nil
+}
+
+func splitRepo(repo string) (string, string, error) {
+	parts := strings.SplitN(repo, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("'%s' is not a full repository name", repo)
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// notProtected tells if GitHub reported that the branch has no required status
+// checks, rather than failing. Any other 404 is a failure, as GitHub also
+// answers with it when the repository does not exist, or the token cannot
+// access it.
+func notProtected(err error) bool {
+	if errors.Is(err, github.ErrBranchNotProtected) {
+		return true
+	}
+
+	var errResp *github.ErrorResponse
+
+	return errors.As(err, &errResp) && errResp.Response != nil && errResp.Response.StatusCode == http.StatusNotFound &&
+		errResp.Message == "Required status checks not enabled"
+}
+
+func (c *Client) fetchRequired(repo, name string) ([]string, error) {
+	owner, repoName, err := splitRepo(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	checks, _, err := c.gh.Repositories.GetRequiredStatusChecks(ctx, owner, repoName, name)
+	if notProtected(err) {
+		return []string{}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Only one of these is ever populated
+	contexts := append([]string{}, checks.Contexts...)
+	if len(contexts) == 0 {
+		for _, check := range checks.Checks {
+			contexts = append(contexts, check.Context)
+		}
+	}
+
+	return contexts, nil
+}
+
+func (c *Client) fetchDefaultBranch(repo string) (string, error) {
+	owner, repoName, err := splitRepo(repo)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	repository, _, err := c.gh.Repositories.Get(ctx, owner, repoName)
+	if err != nil {
+		return "", err
+	}
+
+	return repository.GetDefaultBranch(), nil
+}
+
+// schedule refreshes the cache entry of the branch in the background, unless a
+// refresh is in progress already. An empty branch name stands for the default
+// branch of the repository. The lock must be held.
+func (c *Client) schedule(key branch) {
+	if c.refreshing[key] {
+		return
+	}
+
+	c.refreshing[key] = true
+
+	go func() {
+		if key.name == "" {
+			c.refreshDefaultBranch(key.repo)
+		} else {
+			c.refreshRequired(key)
+		}
+
+		c.mu.Lock()
+		delete(c.refreshing, key)
+		c.mu.Unlock()
+	}()
+}
+
+func (c *Client) refreshDefaultBranch(repo string) {
+	defaultBranch, err := c.fetchDefaultBranch(repo)
+	if err != nil {
+		log.Printf("Could not fetch the default branch of %s, err=%v", repo, err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err == nil {
+		c.defaultBranch[repo] = defaultBranch
+	}
+
+	// Failures are not retried before the refresh, to not hammer the API
+	c.defaultFetched[repo] = time.Now()
+
+	// The default branch is asked for when its status checks are needed
+	if name := c.defaultBranch[repo]; name != "" {
+		if _, ok := c.required[branch{repo, name}]; !ok {
+			c.schedule(branch{repo, name})
+		}
+	}
+}
+
+func (c *Client) refreshRequired(key branch) {
+	contexts, err := c.fetchRequired(key.repo, key.name)
+	if err != nil {
+		log.Printf("Could not fetch the required status checks of %s on %s, err=%v", key.repo, key.name, err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Keep the ones fetched before, if any, but do not retry before the refresh
+	if err != nil {
+		contexts = c.required[key].contexts
+	}
+
+	c.required[key] = entry{contexts, time.Now()}
+}
+
+// RequiredContexts returns the status checks required to merge into the branch
+// of the repository, or into its default branch, if the branch is empty. It
+// only reads the cache, and never waits for GitHub's API: the status checks
+// not fetched yet, or not fetched for a refresh interval, are fetched in the
+// background. Until they are first fetched, it returns nil. If they cannot be
+// fetched, the ones fetched before are used.
+func (c *Client) RequiredContexts(repo, name string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+
+	if name == "" {
+		if fetched, ok := c.defaultFetched[repo]; !ok || now.Sub(fetched) >= c.refresh {
+			c.schedule(branch{repo, ""})
+		}
+
+		name = c.defaultBranch[repo]
+		if name == "" {
+			return nil
+		}
+	}
+
+	key := branch{repo, name}
+
+	cached, ok := c.required[key]
+	if !ok || now.Sub(cached.fetched) >= c.refresh {
+		c.schedule(key)
+	}
+
+	return cached.contexts
+}
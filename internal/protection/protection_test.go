@@ -0,0 +1,179 @@
+package protection_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/knl/pulley/internal/protection"
+)
+
+// fakeGithub serves the branch protection of knl/pulley, counting the requests.
+type fakeGithub struct {
+	mu       sync.Mutex
+	requests map[string]int
+	broken   bool
+}
+
+func (f *fakeGithub) count(path string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.requests[path]
+}
+
+func (f *fakeGithub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.requests[r.URL.Path]++
+	broken := f.broken
+	f.mu.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer ghp_secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if broken {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/api/v3/repos/knl/pulley":
+		fmt.Fprint(w, `{"full_name": "knl/pulley", "default_branch": "main"}`)
+	case "/api/v3/repos/knl/pulley/branches/main/protection/required_status_checks":
+		fmt.Fprint(w, `{"strict": true, "contexts": ["lint", "test"]}`)
+	case "/api/v3/repos/knl/pulley/branches/release/protection/required_status_checks":
+		fmt.Fprint(w, `{"strict": true, "checks": [{"context": "build"}]}`)
+	case "/api/v3/repos/knl/pulley/branches/unchecked/protection/required_status_checks":
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"message": "Required status checks not enabled"}`)
+	case "/api/v3/repos/knl/private/branches/main/protection/required_status_checks":
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"message": "Not Found"}`)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"message": "Branch not protected"}`)
+	}
+}
+
+func newClient(t *testing.T, refresh time.Duration) (*protection.Client, *fakeGithub) {
+	t.Helper()
+
+	fake := &fakeGithub{requests: make(map[string]int)}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	// No trailing slash, the client adds it
+	client, err := protection.New("ghp_secret", server.URL+"/api/v3", refresh)
+	assert.NoError(t, err)
+
+	return client, fake
+}
+
+// eventually waits for the status checks fetched in the background.
+func eventually(t *testing.T, expected []string, client *protection.Client, repo, name string) {
+	t.Helper()
+
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual(expected, client.RequiredContexts(repo, name))
+	}, time.Second, time.Millisecond)
+}
+
+func TestRequiredContexts(t *testing.T) {
+	client, _ := newClient(t, time.Hour)
+
+	eventually(t, []string{"lint", "test"}, client, "knl/pulley", "main")
+	eventually(t, []string{"build"}, client, "knl/pulley", "release")
+	eventually(t, []string{}, client, "knl/pulley", "feature")
+	assert.Nil(t, client.RequiredContexts("not-a-repo", "main"))
+}
+
+// Looking up the status checks never waits for GitHub's API.
+func TestRequiredContextsNotWaiting(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		fmt.Fprint(w, `{"strict": true, "contexts": ["lint"]}`)
+	}))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { close(release) })
+
+	client, err := protection.New("", server.URL, time.Hour)
+	assert.NoError(t, err)
+
+	done := make(chan []string)
+
+	go func() {
+		done <- client.RequiredContexts("knl/pulley", "main")
+	}()
+
+	select {
+	case contexts := <-done:
+		assert.Nil(t, contexts)
+	case <-time.After(time.Second):
+		t.Fatal("the lookup waited for GitHub's API")
+	}
+}
+
+// A repository that is missing, or that the token cannot access, is not the
+// same as a branch without required status checks.
+func TestRequiredContextsNotFound(t *testing.T) {
+	client, fake := newClient(t, time.Hour)
+
+	assert := assert.New(t)
+	assert.Nil(client.RequiredContexts("knl/private", "main"))
+	assert.Eventually(func() bool {
+		return fake.count("/api/v3/repos/knl/private/branches/main/protection/required_status_checks") == 1
+	}, time.Second, time.Millisecond)
+	assert.Never(func() bool {
+		return client.RequiredContexts("knl/private", "main") != nil
+	}, 50*time.Millisecond, time.Millisecond)
+
+	eventually(t, []string{}, client, "knl/pulley", "unchecked")
+}
+
+func TestDefaultBranch(t *testing.T) {
+	client, fake := newClient(t, time.Hour)
+
+	eventually(t, []string{"lint", "test"}, client, "knl/pulley", "")
+	assert.Equal(t, []string{"lint", "test"}, client.RequiredContexts("knl/pulley", ""))
+	assert.Equal(t, 1, fake.count("/api/v3/repos/knl/pulley"))
+}
+
+func TestRequiredContextsCached(t *testing.T) {
+	client, fake := newClient(t, time.Hour)
+
+	eventually(t, []string{"lint", "test"}, client, "knl/pulley", "main")
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, []string{"lint", "test"}, client.RequiredContexts("knl/pulley", "main"))
+	}
+
+	assert.Equal(t, 1, fake.count("/api/v3/repos/knl/pulley/branches/main/protection/required_status_checks"))
+}
+
+// When GitHub cannot be reached, the status checks fetched before are used.
+func TestRequiredContextsStale(t *testing.T) {
+	client, fake := newClient(t, 0)
+
+	eventually(t, []string{"lint", "test"}, client, "knl/pulley", "main")
+
+	fake.mu.Lock()
+	fake.broken = true
+	fake.mu.Unlock()
+
+	path := "/api/v3/repos/knl/pulley/branches/main/protection/required_status_checks"
+	fetched := fake.count(path)
+
+	assert := assert.New(t)
+	assert.Equal([]string{"lint", "test"}, client.RequiredContexts("knl/pulley", "main"))
+	assert.Eventually(func() bool { return fake.count(path) > fetched }, time.Second, time.Millisecond)
+	assert.Equal([]string{"lint", "test"}, client.RequiredContexts("knl/pulley", "main"))
+	assert.Nil(client.RequiredContexts("knl/pulley", "release"))
+}
@@ -0,0 +1,207 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/v50/github"
+)
+
+// archived is a single webhook, as stored in the archive.
+type archived struct {
+	Received time.Time       `json:"received"`
+	Headers  http.Header     `json:"headers"`
+	Body     json.RawMessage `json:"body"`
+}
+
+// archive appends every validated webhook to a file in dir, one JSON object
+// per line. A new file is started every day, and whenever the current file
+// would grow over maxSize bytes (if maxSize is positive).
+type archive struct {
+	dir     string
+	maxSize int64
+
+	mu    sync.Mutex
+	day   string
+	index int
+	size  int64
+}
+
+func newArchive(dir string, maxSize int64) *archive {
+	return &archive{dir: dir, maxSize: maxSize}
+}
+
+func (a *archive) name() string {
+	return filepath.Join(a.dir, fmt.Sprintf("webhooks-%s-%03d.jsonl", a.day, a.index))
+}
+
+// currentSize returns the size of the current file, continuing where a
+// previous run left off.
+func (a *archive) currentSize() int64 {
+	info, err := os.Stat(a.name())
+	if err != nil {
+		return 0
+	}
+
+	return info.Size()
+}
+
+func (a *archive) write(received time.Time, r *http.Request, payload []byte) error {
+	// Only GitHub's own headers are of interest, the signature is not needed
+	// anymore, as the payload has been validated
+	headers := make(http.Header)
+
+	for name, values := range r.Header {
+		if strings.HasPrefix(name, "X-Github-") {
+			headers[name] = values
+		}
+	}
+
+	line, err := json.Marshal(archived{
+		Received: received.UTC(),
+		Headers:  headers,
+		Body:     payload,
+	})
+	if err != nil {
+		return err
+	}
+
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if day := received.UTC().Format("2006-01-02"); day != a.day {
+		a.day = day
+		a.index = 0
+		a.size = a.currentSize()
+	}
+
+	for a.maxSize > 0 && a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+		a.index++
+		a.size = a.currentSize()
+	}
+
+	f, err := os.OpenFile(a.name(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+
+	n, err := f.Write(line)
+	a.size += int64(n)
+
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// ArchiveFiles expands the given paths into the archive files to replay, in
+// the order they were written. Directories are replaced by the archive files
+// they contain.
+func ArchiveFiles(paths []string) ([]string, error) {
+	var files []string
+
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+
+		matches, err := filepath.Glob(filepath.Join(path, "webhooks-*.jsonl"))
+		if err != nil {
+			return nil, err
+		}
+
+		// The names are chosen such that sorting them sorts them by time
+		sort.Strings(matches)
+		files = append(files, matches...)
+	}
+
+	return files, nil
+}
+
+// Replay feeds the webhooks archived in files to the MetricsProcessor, speed
+// times faster than they were originally received. A non-positive speed
+// replays them as fast as possible. Webhooks are parsed just like HookHandler
+// does, and redeliveries are skipped. Returns the number of updates replayed.
+func (p *Pulley) Replay(files []string, speed float64) (int, error) {
+	var (
+		last     time.Time
+		replayed int
+	)
+
+	seen := make(map[string]struct{})
+
+	for _, file := range files {
+		log.Printf("Replaying %s", file)
+
+		f, err := os.Open(file)
+		if err != nil {
+			return replayed, err
+		}
+
+		dec := json.NewDecoder(f)
+
+		for {
+			var rec archived
+
+			err := dec.Decode(&rec)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+
+			if err != nil {
+				f.Close()
+				return replayed, fmt.Errorf("could not read %s, %v", file, err)
+			}
+
+			deliveryID := rec.Headers.Get(github.DeliveryIDHeader)
+			if _, ok := seen[deliveryID]; ok && deliveryID != "" {
+				continue
+			}
+
+			seen[deliveryID] = struct{}{}
+
+			if speed > 0 && !last.IsZero() && rec.Received.After(last) {
+				time.Sleep(time.Duration(float64(rec.Received.Sub(last)) / speed))
+			}
+
+			last = rec.Received
+
+			eventType := rec.Headers.Get(github.EventTypeHeader)
+
+			event, err := github.ParseWebHook(eventType, rec.Body)
+			if err != nil {
+				log.Printf("could not parse webhook-id: %s, skipping: err=%s", deliveryID, err)
+				continue
+			}
+
+			if update := toUpdate(event, eventType, deliveryID); update != nil {
+				p.Updates <- update
+				replayed++
+			}
+		}
+
+		f.Close()
+	}
+
+	return replayed, nil
+}
@@ -0,0 +1,95 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArchiveRotated(t *testing.T) {
+	dir := t.TempDir()
+	a := newArchive(dir, 200)
+
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	req.Header.Set("X-GitHub-Event", "check_run")
+	req.Header.Set("X-Hub-Signature", "sha1=secret")
+
+	payload := []byte(`{"action": "created"}`)
+	day := time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	assert := assert.New(t)
+	assert.NoError(a.write(day, req, payload))
+	assert.NoError(a.write(day.Add(time.Minute), req, payload))
+	assert.NoError(a.write(day.Add(24*time.Hour), req, payload))
+
+	files, err := ArchiveFiles([]string{dir})
+	assert.NoError(err)
+	assert.Equal([]string{
+		filepath.Join(dir, "webhooks-2020-05-01-000.jsonl"),
+		filepath.Join(dir, "webhooks-2020-05-01-001.jsonl"),
+		filepath.Join(dir, "webhooks-2020-05-02-000.jsonl"),
+	}, files)
+
+	content, err := os.ReadFile(files[0])
+	assert.NoError(err)
+	assert.Contains(string(content), "check_run")
+	assert.NotContains(string(content), "secret")
+}
+
+// Archived webhooks are replayed through the processor, without redeliveries.
+func TestArchiveReplayed(t *testing.T) {
+	dir := t.TempDir()
+
+	archiving := Pulley{
+		Updates:     make(chan interface{}, 10),
+		ArchivePath: dir,
+	}
+
+	handler := archiving.HookHandler()
+	deliverTo(handler, "first", "check_run", checkRunPayload("created", "queued", "null"))
+	deliverTo(handler, "first", "check_run", checkRunPayload("created", "queued", "null"))
+	deliverTo(handler, "second", "check_run", checkRunPayload("completed", "completed", `"success"`))
+
+	m := fakeMetrics{
+		database: make(map[Key]float64),
+	}
+	pulley := Pulley{
+		Updates: make(chan interface{}),
+		Metrics: &m,
+	}
+
+	pulley.MetricsProcessor(matchAll, false)
+
+	files, err := ArchiveFiles([]string{dir})
+
+	assert := assert.New(t)
+	assert.NoError(err)
+
+	replayed, err := pulley.Replay(files, 0)
+	assert.NoError(err)
+	assert.Equal(2, replayed)
+
+	close(pulley.Updates)
+	pulley.WG.Wait()
+
+	assert.Equal(float64(1), m.database[Key{"status_check", "pending", "knl/pulley"}])
+	assert.Equal(float64(1), m.database[Key{"status_check", "success", "knl/pulley"}])
+}
+
+func TestReplayBrokenArchive(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "webhooks-2020-05-01-000.jsonl")
+	assert.NoError(t, os.WriteFile(path, []byte(strings.Repeat("{", 3)), 0o600))
+
+	pulley := Pulley{
+		Updates: make(chan interface{}, 1),
+	}
+
+	_, err := pulley.Replay([]string{path}, 0)
+	assert.Error(t, err)
+}
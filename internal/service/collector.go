@@ -0,0 +1,133 @@
+package service
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/knl/pulley/internal/metrics"
+)
+
+// liveCollector reports the figures of the live state on every scrape, as
+// opposed to the metrics updated by the MetricsProcessor along the way.
+type liveCollector struct {
+	pulley *Pulley
+
+	openPRs          *prometheus.Desc
+	waitingPRs       *prometheus.Desc
+	oldestWaiting    *prometheus.Desc
+	buildsInProgress *prometheus.Desc
+}
+
+// Collector returns a prometheus.Collector reporting, per repository, the open
+// PRs, the ones waiting for their head to get validated, for how long the
+// oldest one waits, and the builds in progress. Register it once the
+// MetricsProcessor is started.
+func (p *Pulley) Collector() prometheus.Collector {
+	return &liveCollector{
+		pulley: p,
+		openPRs: prometheus.NewDesc(
+			"github_pull_requests_open",
+			"The number of open PRs currently tracked",
+			[]string{"repository"}, nil,
+		),
+		waitingPRs: prometheus.NewDesc(
+			"github_pull_requests_waiting",
+			"The number of open PRs whose last push is not validated yet",
+			[]string{"repository"}, nil,
+		),
+		oldestWaiting: prometheus.NewDesc(
+			"github_pull_request_oldest_waiting_seconds",
+			"For how long the longest waiting PR waits for its last push to get validated, 0 if none waits",
+			[]string{"repository"}, nil,
+		),
+		buildsInProgress: prometheus.NewDesc(
+			"github_ci_builds_in_progress",
+			"The number of builds pending, and not finished yet",
+			[]string{"repository", "build"}, nil,
+		),
+	}
+}
+
+func (c *liveCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.openPRs
+	ch <- c.waitingPRs
+	ch <- c.oldestWaiting
+	ch <- c.buildsInProgress
+}
+
+func (c *liveCollector) Collect(ch chan<- prometheus.Metric) {
+	repos, ok := c.pulley.liveGauges()
+	if !ok {
+		return
+	}
+
+	for repo, gauges := range foldGauges(repos, c.pulley.Metrics) {
+		ch <- prometheus.MustNewConstMetric(c.openPRs, prometheus.GaugeValue, float64(gauges.OpenPRs), repo)
+		ch <- prometheus.MustNewConstMetric(c.waitingPRs, prometheus.GaugeValue, float64(gauges.WaitingPRs), repo)
+		ch <- prometheus.MustNewConstMetric(c.oldestWaiting, prometheus.GaugeValue, gauges.OldestWaiting.Seconds(), repo)
+
+		for build, count := range gauges.Builds {
+			ch <- prometheus.MustNewConstMetric(c.buildsInProgress, prometheus.GaugeValue, float64(count), repo, build)
+		}
+	}
+}
+
+// liveGauges asks the MetricsProcessor for the figures of the live state, as
+// only it may access the live state. It returns false if the MetricsProcessor
+// is not running.
+func (p *Pulley) liveGauges() (map[string]*repoGauges, bool) {
+	if p.gauges == nil {
+		return nil, false
+	}
+
+	reply := make(chan map[string]*repoGauges, 1)
+
+	select {
+	case p.gauges <- reply:
+	case <-p.done:
+		return nil, false
+	}
+
+	return <-reply, true
+}
+
+// foldGauges merges the figures of the repositories, and of the builds, that
+// share a label value, as the publisher limits the number of distinct values.
+func foldGauges(repos map[string]*repoGauges, publisher metrics.Publisher) map[string]*repoGauges {
+	var repositories, builds []string
+
+	for repo, gauges := range repos {
+		repositories = append(repositories, repo)
+
+		for build := range gauges.Builds {
+			builds = append(builds, build)
+		}
+	}
+
+	repoLabels := publisher.RepositoryLabels(repositories)
+	buildLabels := publisher.BuildLabels(builds)
+
+	folded := make(map[string]*repoGauges)
+
+	for repo, gauges := range repos {
+		label := repoLabels[repo]
+
+		merged, ok := folded[label]
+		if !ok {
+			merged = &repoGauges{Builds: make(map[string]int)}
+			folded[label] = merged
+		}
+
+		merged.OpenPRs += gauges.OpenPRs
+		merged.WaitingPRs += gauges.WaitingPRs
+
+		if gauges.OldestWaiting > merged.OldestWaiting {
+			merged.OldestWaiting = gauges.OldestWaiting
+		}
+
+		for build, count := range gauges.Builds {
+			merged.Builds[buildLabels[build]] += count
+		}
+	}
+
+	return folded
+}
@@ -0,0 +1,75 @@
+package service
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+type delivery struct {
+	id   string
+	seen time.Time
+}
+
+// deliveries remembers the recently seen webhook deliveries, by their
+// X-GitHub-Delivery GUID, in order to recognize redeliveries. It remembers at
+// most size of them, and none older than window.
+type deliveries struct {
+	window time.Duration
+	size   int
+
+	mu    sync.Mutex
+	byID  map[string]*list.Element
+	order *list.List // of delivery, the oldest at the front
+}
+
+func newDeliveries(window time.Duration, size int) *deliveries {
+	return &deliveries{
+		window: window,
+		size:   size,
+		byID:   make(map[string]*list.Element),
+		order:  list.New(),
+	}
+}
+
+// claim returns true if the delivery has not been seen within the window, and
+// remembers it as seen.
+func (d *deliveries) claim(id string, now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.expire(now)
+
+	if _, ok := d.byID[id]; ok {
+		return false
+	}
+
+	d.byID[id] = d.order.PushBack(delivery{id: id, seen: now})
+
+	for d.order.Len() > d.size {
+		d.remove(d.order.Front())
+	}
+
+	return true
+}
+
+// forget drops the delivery, such that its redelivery is accepted.
+func (d *deliveries) forget(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if e, ok := d.byID[id]; ok {
+		d.remove(e)
+	}
+}
+
+func (d *deliveries) expire(now time.Time) {
+	for e := d.order.Front(); e != nil && now.Sub(e.Value.(delivery).seen) > d.window; e = d.order.Front() {
+		d.remove(e)
+	}
+}
+
+func (d *deliveries) remove(e *list.Element) {
+	delete(d.byID, e.Value.(delivery).id)
+	d.order.Remove(e)
+}
@@ -0,0 +1,67 @@
+package service
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"github.com/knl/pulley/internal/metrics"
+)
+
+// Reasons for evicting a live SHA.
+const (
+	evictedExpired  = "expired"
+	evictedCapacity = "capacity"
+)
+
+// sweepInterval returns how often to look for expired SHAs. There is no need
+// to be precise, as the TTLs are expected to be in days.
+func sweepInterval(ttl time.Duration) time.Duration {
+	if ttl < time.Minute {
+		return ttl
+	}
+
+	return time.Minute
+}
+
+// evictExpired removes all live SHAs that have not been updated for longer
+// than ttl, along with the PRs they are the head of.
+func evictExpired(live *liveState, now time.Time, ttl time.Duration, publisher metrics.Publisher) {
+	for key, state := range live.SHAs {
+		if now.Sub(state.LastSeen) <= ttl {
+			continue
+		}
+
+		log.Printf("SHA %s of %s has not been updated since %s, evicting", key.SHA, key.Repo, state.LastSeen)
+
+		live.evict(key)
+		publisher.RegisterEviction(evictedExpired)
+	}
+}
+
+// evictOverflow removes the least recently updated live SHAs once there are
+// more than maxSHAs, down to a tenth below maxSHAs, such that they are not
+// sorted again on every update. A non-positive maxSHAs means there is no limit.
+func evictOverflow(live *liveState, maxSHAs int, publisher metrics.Publisher) {
+	if maxSHAs <= 0 || len(live.SHAs) <= maxSHAs {
+		return
+	}
+
+	keys := make([]shaKey, 0, len(live.SHAs))
+	for key := range live.SHAs {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return live.SHAs[keys[i]].LastSeen.Before(live.SHAs[keys[j]].LastSeen)
+	})
+
+	lowWater := maxSHAs - maxSHAs/10
+
+	for _, key := range keys[:len(keys)-lowWater] {
+		log.Printf("Too many live SHAs, evicting %s of %s last updated at %s", key.SHA, key.Repo, live.SHAs[key].LastSeen)
+
+		live.evict(key)
+		publisher.RegisterEviction(evictedCapacity)
+	}
+}
@@ -1,23 +1,41 @@
 package service
 
 import (
+	"bytes"
+	"fmt"
+	"io"
 	"log"
+	"mime"
 	"net/http"
+	"strings"
+	"time"
 
-	"github.com/google/go-github/v29/github"
+	"github.com/google/go-github/v50/github"
 
 	"github.com/knl/pulley/internal/events"
 )
 
 // HookHandler parses GitHub webhooks and sends an update to MetricsProcessor.
+// Redeliveries of webhooks already processed are ignored, if DedupWindow and
+// DedupSize are set. Validated webhooks are archived, if ArchivePath is set.
 func (p *Pulley) HookHandler() http.HandlerFunc {
+	var seen *deliveries
+	if p.DedupWindow > 0 && p.DedupSize > 0 {
+		seen = newDeliveries(p.DedupWindow, p.DedupSize)
+	}
+
+	var archive *archive
+	if p.ArchivePath != "" {
+		archive = newArchive(p.ArchivePath, int64(p.ArchiveMaxSize))
+	}
+
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			w.WriteHeader(405) // Return 405 Method Not Allowed.
 			return
 		}
 
-		payload, err := github.ValidatePayload(r, p.Token)
+		payload, err := p.validatePayload(r)
 		if err != nil {
 			log.Printf("error reading request body: err=%s\n", err)
 			w.WriteHeader(400) // Return 400 Bad Request.
@@ -26,6 +44,12 @@ func (p *Pulley) HookHandler() http.HandlerFunc {
 		}
 		defer r.Body.Close()
 
+		if archive != nil {
+			if err := archive.write(time.Now(), r, payload); err != nil {
+				log.Printf("could not archive webhook-id: %s, err=%s\n", github.DeliveryID(r), err)
+			}
+		}
+
 		event, err := github.ParseWebHook(github.WebHookType(r), payload)
 		if err != nil {
 			log.Printf("could not parse webhook: err=%s\n", err)
@@ -34,58 +58,318 @@ func (p *Pulley) HookHandler() http.HandlerFunc {
 			return
 		}
 
-		// send PR, Branch, and Commit updates to the MetricsProcessor
-	LOOP:
-		switch e := event.(type) {
-		case *github.PullRequestEvent:
-			action, err := events.ParsePREvent(*e.Action)
-			if err != nil {
-				log.Printf("Skipping Pull Request Event, due to %v", err)
-				break
-			}
-			p.Updates <- events.PullUpdate{
-				Number:    *e.Number,
-				SHA:       *e.PullRequest.Head.SHA,
-				Action:    action,
-				Timestamp: *e.PullRequest.UpdatedAt,
-				Merged:    *e.PullRequest.Merged,
-				Repo:      *e.Repo.FullName,
-			}
-		case *github.PushEvent:
-			var action events.BranchEvent
-			switch {
-			case !*e.Created && !*e.Deleted:
-				action = events.Rebased
-			case *e.Created && !*e.Deleted:
-				action = events.Created
-			case !*e.Created && *e.Deleted:
-				action = events.Deleted
-			default:
-				log.Printf("Weird state where branch is both created and deleted, skipping.")
-				break LOOP
-			}
-			p.Updates <- events.BranchUpdate{
-				SHA:       *e.After,
-				OldSHA:    *e.Before,
-				Action:    action,
-				Timestamp: e.Repo.PushedAt.Time,
-				Repo:      *e.Repo.FullName,
-			}
-		case *github.StatusEvent:
-			status, err := events.ParseStatus(*e.State)
-			if err != nil {
-				log.Printf("Skipping a status event, due to: %v", err)
-				break
+		deliveryID := github.DeliveryID(r)
+		if seen != nil && deliveryID != "" {
+			if !seen.claim(deliveryID, time.Now()) {
+				log.Printf("Skipping webhook-id: %s, already delivered", deliveryID)
+				p.Metrics.RegisterDuplicateDelivery(github.WebHookType(r))
+
+				return
 			}
-			p.Updates <- events.CommitUpdate{
-				Status:    status,
-				Context:   *e.Context,
-				SHA:       *e.SHA,
-				Timestamp: e.UpdatedAt.Time,
-				Repo:      *e.Repo.FullName,
+		}
+
+		update := toUpdate(event, github.WebHookType(r), deliveryID)
+		if update == nil {
+			return
+		}
+
+		if err := p.enqueue(update); err != nil {
+			log.Printf("Rejecting webhook-id: %s, due to: %v", deliveryID, err)
+
+			// The redelivery should not be treated as a duplicate
+			if seen != nil {
+				seen.forget(deliveryID)
 			}
+
+			w.WriteHeader(503) // Return 503 Service Unavailable, GitHub will redeliver it.
+
+			return
+		}
+	}
+}
+
+// validatePayload validates the webhook with any of the secret tokens, trying
+// them in order, and returns its payload. The body is read once, as it cannot
+// be read again.
+func (p *Pulley) validatePayload(r *http.Request) ([]byte, error) {
+	if len(p.Tokens) == 0 {
+		return github.ValidatePayload(r, nil)
+	}
+
+	signature := r.Header.Get(github.SHA256SignatureHeader)
+	if signature == "" {
+		signature = r.Header.Get(github.SHA1SignatureHeader)
+	}
+
+	contentType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, token := range p.Tokens {
+		var payload []byte
+
+		payload, err = github.ValidatePayloadFromBody(contentType, bytes.NewReader(body), signature, token)
+		if err == nil {
+			p.Metrics.RegisterValidatedDelivery(i)
+			return payload, nil
+		}
+	}
+
+	// None of the tokens validated it, the error of the last one will do
+	return nil, err
+}
+
+// toUpdate translates a parsed webhook event into an update for the
+// MetricsProcessor. A nil update means there is nothing to process.
+func toUpdate(event interface{}, eventType, deliveryID string) interface{} {
+	// send PR, Branch, and Commit updates to the MetricsProcessor
+	var update interface{}
+
+LOOP:
+	switch e := event.(type) {
+	case *github.PullRequestEvent:
+		action, err := events.ParsePREvent(*e.Action)
+		if err != nil {
+			log.Printf("Skipping Pull Request Event, due to %v", err)
+			break
+		}
+		update = events.PullUpdate{
+			Number:    *e.Number,
+			SHA:       *e.PullRequest.Head.SHA,
+			OldSHA:    e.GetBefore(),
+			Base:      e.GetPullRequest().GetBase().GetRef(),
+			Action:    action,
+			Opened:    e.GetPullRequest().GetCreatedAt().Time,
+			Timestamp: e.PullRequest.UpdatedAt.Time,
+			Merged:    *e.PullRequest.Merged,
+			Repo:      *e.Repo.FullName,
+		}
+	case *github.PushEvent:
+		var action events.BranchEvent
+		switch {
+		case !*e.Created && !*e.Deleted:
+			action = events.Rebased
+		case *e.Created && !*e.Deleted:
+			action = events.Created
+		case !*e.Created && *e.Deleted:
+			action = events.Deleted
 		default:
-			log.Printf("unknown WebHookType: %s, webhook-id: %s skipping\n", github.WebHookType(r), r.Header.Get("X-GitHub-Delivery"))
+			log.Printf("Weird state where branch is both created and deleted, skipping.")
+			break LOOP
+		}
+		update = events.BranchUpdate{
+			SHA:       *e.After,
+			OldSHA:    *e.Before,
+			Action:    action,
+			Timestamp: e.Repo.PushedAt.Time,
+			Repo:      *e.Repo.FullName,
+		}
+	case *github.StatusEvent:
+		status, err := events.ParseStatus(*e.State)
+		if err != nil {
+			log.Printf("Skipping a status event, due to: %v", err)
+			break
+		}
+		update = events.CommitUpdate{
+			Status:    status,
+			Context:   *e.Context,
+			SHA:       *e.SHA,
+			Timestamp: e.UpdatedAt.Time,
+			Repo:      *e.Repo.FullName,
+		}
+	case *github.CheckRunEvent:
+		cu, err := checkRunUpdate(e)
+		if err != nil {
+			log.Printf("Skipping a check run event, due to: %v", err)
+			break
+		}
+		update = cu
+	case *github.CheckSuiteEvent:
+		// Repositories only get the completed suites, whose check runs are
+		// tracked already, one by one
+		log.Printf("Skipping a check suite event, its check runs are tracked instead")
+	case *github.PullRequestReviewEvent:
+		ru, err := reviewUpdate(e)
+		if err != nil {
+			log.Printf("Skipping a review event, due to: %v", err)
+			break
 		}
+		update = ru
+	case *github.PullRequestReviewCommentEvent:
+		ru, err := reviewCommentUpdate(e)
+		if err != nil {
+			log.Printf("Skipping a review comment event, due to: %v", err)
+			break
+		}
+		update = ru
+	case *github.WorkflowJobEvent:
+		ju, err := workflowJobUpdate(e)
+		if err != nil {
+			log.Printf("Skipping a workflow job event, due to: %v", err)
+			break
+		}
+		update = ju
+	case *github.WorkflowRunEvent:
+		wu, err := workflowRunUpdate(e)
+		if err != nil {
+			log.Printf("Skipping a workflow run event, due to: %v", err)
+			break
+		}
+		update = wu
+	default:
+		log.Printf("unknown WebHookType: %s, webhook-id: %s skipping\n", eventType, deliveryID)
+	}
+
+	return update
+}
+
+// checkRunUpdate translates a check run into a status update. A check run is
+// pending from the moment it is created until it completes. The name of the
+// check run plays the role of the status' context.
+func checkRunUpdate(e *github.CheckRunEvent) (events.CommitUpdate, error) {
+	switch e.GetAction() {
+	case "created", "completed":
+	default:
+		// Reruns show up as new check runs, nothing to do for these
+		return events.CommitUpdate{}, fmt.Errorf("action '%s' is not tracked", e.GetAction())
+	}
+
+	run := e.GetCheckRun()
+
+	status, err := events.ParseCheckStatus(run.GetStatus(), run.GetConclusion())
+	if err != nil {
+		return events.CommitUpdate{}, err
+	}
+
+	timestamp := run.GetStartedAt()
+	if status.IsTerminal() {
+		timestamp = run.GetCompletedAt()
+	}
+
+	return events.CommitUpdate{
+		Status:    status,
+		Context:   run.GetName(),
+		SHA:       run.GetHeadSHA(),
+		Timestamp: timeOrNow(timestamp),
+		Repo:      e.GetRepo().GetFullName(),
+	}, nil
+}
+
+// reviewUpdate translates a submitted review into an update. Reviews by the
+// author of the PR, that is, replies to the reviewers, are not tracked.
+func reviewUpdate(e *github.PullRequestReviewEvent) (events.ReviewUpdate, error) {
+	if e.GetAction() != "submitted" {
+		return events.ReviewUpdate{}, fmt.Errorf("action '%s' is not tracked", e.GetAction())
+	}
+
+	review := e.GetReview()
+	pr := e.GetPullRequest()
+
+	if review.GetUser().GetLogin() == pr.GetUser().GetLogin() {
+		return events.ReviewUpdate{}, fmt.Errorf("review by the author of PR %d", pr.GetNumber())
+	}
+
+	// The API reports the state in upper case, webhooks in lower case
+	state, err := events.ParseReviewState(strings.ToLower(review.GetState()))
+	if err != nil {
+		return events.ReviewUpdate{}, err
+	}
+
+	return events.ReviewUpdate{
+		Repo:      e.GetRepo().GetFullName(),
+		Number:    pr.GetNumber(),
+		SHA:       pr.GetHead().GetSHA(),
+		State:     state,
+		Opened:    pr.GetCreatedAt().Time,
+		Timestamp: timeOrNow(review.GetSubmittedAt()),
+	}, nil
+}
+
+// reviewCommentUpdate translates a review comment into an update, as a review
+// that only comments.
+func reviewCommentUpdate(e *github.PullRequestReviewCommentEvent) (events.ReviewUpdate, error) {
+	if e.GetAction() != "created" {
+		return events.ReviewUpdate{}, fmt.Errorf("action '%s' is not tracked", e.GetAction())
 	}
+
+	comment := e.GetComment()
+	pr := e.GetPullRequest()
+
+	if comment.GetUser().GetLogin() == pr.GetUser().GetLogin() {
+		return events.ReviewUpdate{}, fmt.Errorf("review comment by the author of PR %d", pr.GetNumber())
+	}
+
+	return events.ReviewUpdate{
+		Repo:      e.GetRepo().GetFullName(),
+		Number:    pr.GetNumber(),
+		SHA:       pr.GetHead().GetSHA(),
+		State:     events.Commented,
+		Opened:    pr.GetCreatedAt().Time,
+		Timestamp: timeOrNow(comment.GetCreatedAt()),
+	}, nil
+}
+
+// workflowJobUpdate translates a GitHub Actions job into an update carrying
+// all the timestamps needed to split the queueing from the execution time.
+func workflowJobUpdate(e *github.WorkflowJobEvent) (events.JobUpdate, error) {
+	job := e.GetWorkflowJob()
+
+	status, err := events.ParseCheckStatus(job.GetStatus(), job.GetConclusion())
+	if err != nil {
+		return events.JobUpdate{}, err
+	}
+
+	return events.JobUpdate{
+		Repo:        e.GetRepo().GetFullName(),
+		Workflow:    job.GetWorkflowName(),
+		Job:         job.GetName(),
+		Labels:      job.Labels,
+		Status:      status,
+		CreatedAt:   job.GetCreatedAt().Time,
+		StartedAt:   job.GetStartedAt().Time,
+		CompletedAt: job.GetCompletedAt().Time,
+	}, nil
+}
+
+// workflowRunUpdate translates a GitHub Actions workflow run into an update.
+// The run does not report when it completed, but it is the last time it got
+// updated.
+func workflowRunUpdate(e *github.WorkflowRunEvent) (events.WorkflowUpdate, error) {
+	run := e.GetWorkflowRun()
+
+	status, err := events.ParseCheckStatus(run.GetStatus(), run.GetConclusion())
+	if err != nil {
+		return events.WorkflowUpdate{}, err
+	}
+
+	wu := events.WorkflowUpdate{
+		Repo:      e.GetRepo().GetFullName(),
+		Workflow:  run.GetName(),
+		Attempt:   run.GetRunAttempt(),
+		Status:    status,
+		CreatedAt: run.GetCreatedAt().Time,
+		StartedAt: run.GetRunStartedAt().Time,
+	}
+
+	if status.IsTerminal() {
+		wu.CompletedAt = run.GetUpdatedAt().Time
+	}
+
+	return wu, nil
+}
+
+// timeOrNow works around webhooks that arrive without a timestamp, by taking
+// the time of arrival as a good approximation.
+func timeOrNow(ts github.Timestamp) time.Time {
+	if ts.IsZero() {
+		return time.Now()
+	}
+
+	return ts.Time
 }
@@ -0,0 +1,499 @@
+package service
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/knl/pulley/internal/events"
+	"github.com/knl/pulley/internal/test"
+)
+
+func deliver(p *Pulley, eventType, payload string) *httptest.ResponseRecorder {
+	return deliverTo(p.HookHandler(), test.RandSHA(), eventType, payload)
+}
+
+func deliverTo(handler http.Handler, deliveryID, eventType, payload string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-GitHub-Event", eventType)
+	req.Header.Set("X-GitHub-Delivery", deliveryID)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	return rec
+}
+
+const checkRunTmpl = `{
+  "action": "ACTION",
+  "check_run": {
+    "name": "build",
+    "head_sha": "6dcb09b5b57875f334f61aebed695e2e4193db5e",
+    "status": "STATUS",
+    "conclusion": CONCLUSION,
+    "started_at": "2020-05-01T10:00:00Z",
+    "completed_at": "2020-05-01T10:05:00Z"
+  },
+  "repository": {"full_name": "knl/pulley"}
+}`
+
+func checkRunPayload(action, status, conclusion string) string {
+	return strings.NewReplacer(
+		"ACTION", action,
+		"STATUS", status,
+		"CONCLUSION", conclusion,
+	).Replace(checkRunTmpl)
+}
+
+var checkRunTests = []struct {
+	name       string
+	action     string
+	status     string
+	conclusion string
+	expected   events.Status
+	minute     int
+}{
+	{"Queued", "created", "queued", "null", events.Pending, 0},
+	{"InProgress", "created", "in_progress", "null", events.Pending, 0},
+	{"Success", "completed", "completed", `"success"`, events.Success, 5},
+	{"Failure", "completed", "completed", `"failure"`, events.Failure, 5},
+	{"Cancelled", "completed", "completed", `"cancelled"`, events.Cancelled, 5},
+	{"TimedOut", "completed", "completed", `"timed_out"`, events.TimedOut, 5},
+	{"Neutral", "completed", "completed", `"neutral"`, events.Neutral, 5},
+	{"Skipped", "completed", "completed", `"skipped"`, events.Skipped, 5},
+}
+
+func TestCheckRunTranslated(t *testing.T) {
+	for _, tt := range checkRunTests {
+		tt := tt // see: https://github.com/kyoh86/scopelint/issues/4
+		t.Run(tt.name, func(t *testing.T) {
+			pulley := Pulley{
+				Updates: make(chan interface{}, 1),
+			}
+
+			rec := deliver(&pulley, "check_run", checkRunPayload(tt.action, tt.status, tt.conclusion))
+
+			assert := assert.New(t)
+			assert.Equal(http.StatusOK, rec.Code)
+			assert.Len(pulley.Updates, 1)
+
+			update := <-pulley.Updates
+			assert.Equal(events.CommitUpdate{
+				Repo:      test.DefaultRepository,
+				Status:    tt.expected,
+				Context:   "build",
+				SHA:       "6dcb09b5b57875f334f61aebed695e2e4193db5e",
+				Timestamp: time.Date(2020, 5, 1, 10, tt.minute, 0, 0, time.UTC),
+			}, update)
+		})
+	}
+}
+
+func TestCheckRunRerequestIgnored(t *testing.T) {
+	pulley := Pulley{
+		Updates: make(chan interface{}, 1),
+	}
+
+	rec := deliver(&pulley, "check_run", checkRunPayload("rerequested", "completed", `"failure"`))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, pulley.Updates)
+}
+
+const statusTmpl = `{
+  "sha": "6dcb09b5b57875f334f61aebed695e2e4193db5e",
+  "state": "STATE",
+  "context": "ci/build",
+  "updated_at": "2020-05-01T10:05:00Z",
+  "repository": {"full_name": "knl/pulley"}
+}`
+
+// Commit statuses only have the states of the Status API, the conclusions of
+// the Checks API are not valid states.
+func TestStatusTranslated(t *testing.T) {
+	tests := []struct {
+		state    string
+		expected events.Status
+	}{
+		{"pending", events.Pending},
+		{"success", events.Success},
+		{"failure", events.Failure},
+		{"error", events.Error},
+		{"neutral", 0},
+		{"timed_out", 0},
+		{"action_required", 0},
+	}
+
+	for _, tt := range tests {
+		tt := tt // see: https://github.com/kyoh86/scopelint/issues/4
+		t.Run(tt.state, func(t *testing.T) {
+			pulley := Pulley{
+				Updates: make(chan interface{}, 1),
+			}
+
+			rec := deliver(&pulley, "status", strings.Replace(statusTmpl, "STATE", tt.state, 1))
+
+			assert := assert.New(t)
+			assert.Equal(http.StatusOK, rec.Code)
+
+			if tt.expected == 0 {
+				assert.Empty(pulley.Updates)
+				return
+			}
+
+			assert.Len(pulley.Updates, 1)
+			assert.Equal(events.CommitUpdate{
+				Repo:      test.DefaultRepository,
+				Status:    tt.expected,
+				Context:   "ci/build",
+				SHA:       "6dcb09b5b57875f334f61aebed695e2e4193db5e",
+				Timestamp: time.Date(2020, 5, 1, 10, 5, 0, 0, time.UTC),
+			}, <-pulley.Updates)
+		})
+	}
+}
+
+// Repositories only get the completed check suites, which would duplicate the
+// check runs they contain, thus only the check runs are tracked.
+func TestCheckSuiteIgnored(t *testing.T) {
+	suite := `{
+  "action": "completed",
+  "check_suite": {
+    "head_sha": "6dcb09b5b57875f334f61aebed695e2e4193db5e",
+    "status": "completed",
+    "conclusion": "failure",
+    "app": {"name": "GitHub Actions"},
+    "created_at": "2020-05-01T10:00:00Z",
+    "updated_at": "2020-05-01T10:07:00Z"
+  },
+  "repository": {"full_name": "knl/pulley"}
+}`
+
+	pulley := Pulley{
+		Updates: make(chan interface{}, 3),
+	}
+
+	assert := assert.New(t)
+	assert.Equal(http.StatusOK, deliver(&pulley, "check_run", checkRunPayload("created", "in_progress", "null")).Code)
+	assert.Equal(http.StatusOK, deliver(&pulley, "check_run", checkRunPayload("completed", "completed", `"failure"`)).Code)
+	assert.Equal(http.StatusOK, deliver(&pulley, "check_suite", suite).Code)
+	assert.Len(pulley.Updates, 2)
+
+	for _, status := range []events.Status{events.Pending, events.Failure} {
+		update := (<-pulley.Updates).(events.CommitUpdate)
+		assert.Equal("build", update.Context)
+		assert.Equal(status, update.Status)
+	}
+}
+
+func TestWorkflowJobTranslated(t *testing.T) {
+	payload := `{
+  "action": "completed",
+  "workflow_job": {
+    "name": "test",
+    "workflow_name": "CI",
+    "head_sha": "6dcb09b5b57875f334f61aebed695e2e4193db5e",
+    "status": "completed",
+    "conclusion": "success",
+    "labels": ["ubuntu-latest"],
+    "created_at": "2020-05-01T10:00:00Z",
+    "started_at": "2020-05-01T10:02:00Z",
+    "completed_at": "2020-05-01T10:05:00Z"
+  },
+  "repository": {"full_name": "knl/pulley"}
+}`
+
+	pulley := Pulley{
+		Updates: make(chan interface{}, 1),
+	}
+
+	rec := deliver(&pulley, "workflow_job", payload)
+
+	assert := assert.New(t)
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Len(pulley.Updates, 1)
+
+	update := <-pulley.Updates
+	assert.Equal(events.JobUpdate{
+		Repo:        test.DefaultRepository,
+		Workflow:    "CI",
+		Job:         "test",
+		Labels:      []string{"ubuntu-latest"},
+		Status:      events.Success,
+		CreatedAt:   time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC),
+		StartedAt:   time.Date(2020, 5, 1, 10, 2, 0, 0, time.UTC),
+		CompletedAt: time.Date(2020, 5, 1, 10, 5, 0, 0, time.UTC),
+	}, update)
+}
+
+const workflowRunTmpl = `{
+  "action": "ACTION",
+  "workflow_run": {
+    "name": "CI",
+    "head_sha": "6dcb09b5b57875f334f61aebed695e2e4193db5e",
+    "run_attempt": 2,
+    "status": "STATUS",
+    "conclusion": CONCLUSION,
+    "created_at": "2020-05-01T10:00:00Z",
+    "run_started_at": "2020-05-01T10:01:00Z",
+    "updated_at": "2020-05-01T10:09:00Z"
+  },
+  "repository": {"full_name": "knl/pulley"}
+}`
+
+// A workflow run completes when it was last updated, while a run in progress
+// has not completed yet.
+func TestWorkflowRunTranslated(t *testing.T) {
+	tests := []struct {
+		name       string
+		action     string
+		status     string
+		conclusion string
+		expected   events.Status
+		completed  time.Time
+	}{
+		{"Queued", "requested", "queued", "null", events.Pending, time.Time{}},
+		{"Completed", "completed", "completed", `"failure"`, events.Failure, time.Date(2020, 5, 1, 10, 9, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		tt := tt // see: https://github.com/kyoh86/scopelint/issues/4
+		t.Run(tt.name, func(t *testing.T) {
+			pulley := Pulley{
+				Updates: make(chan interface{}, 1),
+			}
+
+			payload := strings.NewReplacer(
+				"ACTION", tt.action,
+				"STATUS", tt.status,
+				"CONCLUSION", tt.conclusion,
+			).Replace(workflowRunTmpl)
+
+			rec := deliver(&pulley, "workflow_run", payload)
+
+			assert := assert.New(t)
+			assert.Equal(http.StatusOK, rec.Code)
+			assert.Len(pulley.Updates, 1)
+			assert.Equal(events.WorkflowUpdate{
+				Repo:        test.DefaultRepository,
+				Workflow:    "CI",
+				Attempt:     2,
+				Status:      tt.expected,
+				CreatedAt:   time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC),
+				StartedAt:   time.Date(2020, 5, 1, 10, 1, 0, 0, time.UTC),
+				CompletedAt: tt.completed,
+			}, <-pulley.Updates)
+		})
+	}
+}
+
+const reviewTmpl = `{
+  "action": "submitted",
+  "review": {
+    "user": {"login": "REVIEWER"},
+    "state": "STATE",
+    "submitted_at": "2020-05-01T12:00:00Z"
+  },
+  "pull_request": {
+    "number": 42,
+    "user": {"login": "knl"},
+    "head": {"sha": "6dcb09b5b57875f334f61aebed695e2e4193db5e"},
+    "created_at": "2020-05-01T10:00:00Z"
+  },
+  "repository": {"full_name": "knl/pulley"}
+}`
+
+var reviewTests = []struct {
+	name     string
+	reviewer string
+	state    string
+	expected events.ReviewState
+}{
+	{"Approved", "octocat", "approved", events.Approved},
+	{"ApprovedUpperCase", "octocat", "APPROVED", events.Approved},
+	{"ChangesRequested", "octocat", "changes_requested", events.ChangesRequested},
+	{"Commented", "octocat", "commented", events.Commented},
+	{"ByAuthor", "knl", "commented", 0},
+	{"Dismissed", "octocat", "dismissed", 0},
+}
+
+func TestReviewTranslated(t *testing.T) {
+	for _, tt := range reviewTests {
+		tt := tt // see: https://github.com/kyoh86/scopelint/issues/4
+		t.Run(tt.name, func(t *testing.T) {
+			pulley := Pulley{
+				Updates: make(chan interface{}, 1),
+			}
+
+			payload := strings.NewReplacer("REVIEWER", tt.reviewer, "STATE", tt.state).Replace(reviewTmpl)
+			rec := deliver(&pulley, "pull_request_review", payload)
+
+			assert := assert.New(t)
+			assert.Equal(http.StatusOK, rec.Code)
+
+			if tt.expected == 0 {
+				assert.Empty(pulley.Updates)
+				return
+			}
+
+			assert.Len(pulley.Updates, 1)
+
+			update := <-pulley.Updates
+			assert.Equal(events.ReviewUpdate{
+				Repo:      test.DefaultRepository,
+				Number:    42,
+				SHA:       "6dcb09b5b57875f334f61aebed695e2e4193db5e",
+				State:     tt.expected,
+				Opened:    time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC),
+				Timestamp: time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC),
+			}, update)
+		})
+	}
+}
+
+func TestReviewCommentTranslated(t *testing.T) {
+	payload := `{
+  "action": "created",
+  "comment": {
+    "user": {"login": "octocat"},
+    "created_at": "2020-05-01T11:00:00Z"
+  },
+  "pull_request": {
+    "number": 42,
+    "user": {"login": "knl"},
+    "head": {"sha": "6dcb09b5b57875f334f61aebed695e2e4193db5e"},
+    "created_at": "2020-05-01T10:00:00Z"
+  },
+  "repository": {"full_name": "knl/pulley"}
+}`
+
+	pulley := Pulley{
+		Updates: make(chan interface{}, 1),
+	}
+
+	rec := deliver(&pulley, "pull_request_review_comment", payload)
+
+	assert := assert.New(t)
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Len(pulley.Updates, 1)
+
+	update := <-pulley.Updates
+	assert.Equal(events.ReviewUpdate{
+		Repo:      test.DefaultRepository,
+		Number:    42,
+		SHA:       "6dcb09b5b57875f334f61aebed695e2e4193db5e",
+		State:     events.Commented,
+		Opened:    time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC),
+		Timestamp: time.Date(2020, 5, 1, 11, 0, 0, 0, time.UTC),
+	}, update)
+}
+
+// Once stopping, webhooks are rejected so that GitHub redelivers them later.
+func TestRejectedWhenStopping(t *testing.T) {
+	m := fakeMetrics{
+		database: make(map[Key]float64),
+	}
+	pulley := Pulley{
+		Updates: make(chan interface{}),
+		Metrics: &m,
+	}
+
+	pulley.MetricsProcessor(matchAll, false)
+
+	assert := assert.New(t)
+	assert.NoError(pulley.Stop(context.Background()))
+
+	rec := deliver(&pulley, "check_run", checkRunPayload("created", "queued", "null"))
+	assert.Equal(http.StatusServiceUnavailable, rec.Code)
+}
+
+// Redeliveries are acknowledged, but not processed again.
+func TestRedeliveryIgnored(t *testing.T) {
+	m := fakeMetrics{
+		database: make(map[Key]float64),
+	}
+	pulley := Pulley{
+		Updates:     make(chan interface{}, 3),
+		Metrics:     &m,
+		DedupWindow: time.Hour,
+		DedupSize:   10,
+	}
+
+	handler := pulley.HookHandler()
+	payload := checkRunPayload("created", "queued", "null")
+
+	assert := assert.New(t)
+	assert.Equal(http.StatusOK, deliverTo(handler, "first", "check_run", payload).Code)
+	assert.Equal(http.StatusOK, deliverTo(handler, "first", "check_run", payload).Code)
+	assert.Equal(http.StatusOK, deliverTo(handler, "second", "check_run", payload).Code)
+
+	assert.Len(pulley.Updates, 2)
+	assert.Equal(float64(1), m.database[Key{"duplicate", "check_run", ""}])
+}
+
+// Deliveries are remembered only within the window, and only up to a size.
+func TestDeliveriesBounded(t *testing.T) {
+	now := time.Now()
+	seen := newDeliveries(time.Hour, 2)
+
+	assert := assert.New(t)
+	assert.True(seen.claim("a", now))
+	assert.False(seen.claim("a", now.Add(time.Minute)))
+	assert.True(seen.claim("a", now.Add(2*time.Hour)))
+
+	assert.True(seen.claim("b", now.Add(2*time.Hour)))
+	assert.True(seen.claim("c", now.Add(2*time.Hour)))
+	assert.True(seen.claim("a", now.Add(2*time.Hour)))
+
+	seen.forget("a")
+	assert.True(seen.claim("a", now.Add(2*time.Hour)))
+}
+
+func deliverSigned(p *Pulley, token []byte, payload string) *httptest.ResponseRecorder {
+	mac := hmac.New(sha256.New, token)
+	mac.Write([]byte(payload))
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-GitHub-Event", "check_run")
+	req.Header.Set("X-GitHub-Delivery", test.RandSHA())
+	req.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	rec := httptest.NewRecorder()
+	p.HookHandler().ServeHTTP(rec, req)
+
+	return rec
+}
+
+// Any of the tokens validates a webhook, which is counted per token.
+func TestTokensRotated(t *testing.T) {
+	m := fakeMetrics{
+		database: make(map[Key]float64),
+	}
+	pulley := Pulley{
+		Updates: make(chan interface{}, 3),
+		Metrics: &m,
+		Tokens:  [][]byte{[]byte("new"), []byte("old")},
+	}
+
+	payload := checkRunPayload("created", "queued", "null")
+
+	assert := assert.New(t)
+	assert.Equal(http.StatusOK, deliverSigned(&pulley, []byte("new"), payload).Code)
+	assert.Equal(http.StatusOK, deliverSigned(&pulley, []byte("old"), payload).Code)
+	assert.Equal(http.StatusOK, deliverSigned(&pulley, []byte("old"), payload).Code)
+	assert.Equal(http.StatusBadRequest, deliverSigned(&pulley, []byte("unknown"), payload).Code)
+
+	assert.Len(pulley.Updates, 3)
+	assert.Equal(float64(1), m.database[Key{"validated", "0", ""}])
+	assert.Equal(float64(2), m.database[Key{"validated", "1", ""}])
+}
@@ -2,6 +2,8 @@ package service
 
 import (
 	"log"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/knl/pulley/internal/config"
@@ -9,44 +11,83 @@ import (
 	"github.com/knl/pulley/internal/metrics"
 )
 
-type shaState struct {
-	Time        time.Time
-	CheckSeen   bool                 // Set to true if a status check has been received
-	CIStart     time.Time            // Time when we received the first CI notification (CheckSeen == true)
-	BuildStarts map[string]time.Time // when a build started
-}
-
-type liveSHAMap = map[string]*shaState
+// Values of the review label, for each milestone of the review.
+const (
+	firstReview      = "first"
+	changesRequested = "changes_requested"
+	approved         = "approved"
+)
 
-func newShaState(timestamp time.Time) *shaState {
-	return &shaState{
-		Time:        timestamp,
-		CheckSeen:   false,
-		CIStart:     timestamp, // not necessarily correct
-		BuildStarts: make(map[string]time.Time),
-	}
-}
+func processPullUpdate(up events.PullUpdate, live *liveState, publisher metrics.Publisher) {
+	key := prKey{up.Repo, up.Number}
 
-func processPullUpdate(up events.PullUpdate, liveSHAs *liveSHAMap, publisher metrics.Publisher) {
 	// Possible values for PR actions are:
 	// "assigned", "unassigned", "review_requested", "review_request_removed", "labeled", "unlabeled",
-	// "opened", "edited", "closed", "ready_for_review", "locked", "unlocked", or "reopened".
+	// "opened", "edited", "closed", "ready_for_review", "locked", "unlocked", "reopened",
+	// "synchronize", "converted_to_draft", "auto_merge_enabled", "auto_merge_disabled",
+	// "enqueued", "dequeued", "milestoned", or "demilestoned".
 	switch up.Action {
 	case events.Opened, events.Reopened, events.ReadyForReview:
-		(*liveSHAs)[up.SHA] = newShaState(up.Timestamp)
+		// A draft PR was opened already, and it keeps its reviews
+		pr, ok := live.PRs[key]
+		if !ok || up.Action != events.ReadyForReview {
+			opened := up.Timestamp
+			if up.Action == events.ReadyForReview {
+				// The draft was opened before it got tracked
+				opened = openedAt(up)
+			}
+
+			pr = newPRState(up.Repo, up.Number, up.Base, opened)
+			live.PRs[key] = pr
+		}
+
+		live.track(up.Repo, up.SHA, up.Timestamp)
+		live.setHead(pr, up.SHA, up.Timestamp)
+
+	case events.Synchronize:
+		// New commits were pushed to the PR. For PRs from the same repository, the
+		// push event might have already moved the tracking to the new head, but for
+		// forks this is the only notification we get.
+		log.Printf("PR %d is synchronized, replacing live SHA %s with %s", up.Number, up.OldSHA, up.SHA)
+
+		pr, ok := live.PRs[key]
+		if !ok {
+			// The PR was opened before it got tracked
+			pr = newPRState(up.Repo, up.Number, up.Base, openedAt(up))
+			live.PRs[key] = pr
+		}
+
+		pr.Base = up.Base
+		live.setHead(pr, up.SHA, up.Timestamp)
 
 	case events.Closed:
-		if _, ok := (*liveSHAs)[up.SHA]; !ok {
-			log.Printf("%s is not in live SHAs, skipping.", up.SHA)
+		pr, ok := live.PRs[key]
+		if !ok {
+			log.Printf("PR %d of %s is not tracked, skipping.", up.Number, up.Repo)
 			break
 		}
 
 		if up.Merged {
-			mergeTime := up.Timestamp.Sub((*liveSHAs)[up.SHA].Time).Seconds()
-			publisher.RegisterMerge(up.Repo, mergeTime)
+			exemplar := metrics.Exemplar{PR: up.Number, SHA: up.SHA}
+
+			mergeTime := up.Timestamp.Sub(pr.Opened).Seconds()
+			publisher.RegisterMerge(up.Repo, mergeTime, exemplar)
+
+			// The head is the last push, or the opening of the PR
+			if head, ok := pr.head(); ok {
+				if state, ok := live.SHAs[shaKey{up.Repo, head}]; ok {
+					publisher.RegisterLastPushMerge(up.Repo, up.Timestamp.Sub(state.Time).Seconds(), exemplar)
+				}
+
+				publisher.RegisterMergedPushes(up.Repo, len(pr.Heads)-1, exemplar)
+			}
+
+			if !pr.Approved.IsZero() {
+				publisher.RegisterApprovedMerge(up.Repo, up.Timestamp.Sub(pr.Approved).Seconds(), exemplar)
+			}
 		}
 
-		delete(*liveSHAs, up.SHA)
+		live.close(pr)
 
 	default:
 		log.Printf("Skipping action %s", up.Action)
@@ -56,64 +97,221 @@ func processPullUpdate(up events.PullUpdate, liveSHAs *liveSHAMap, publisher met
 	publisher.RegisterPREvent(up.Repo, up.Action)
 }
 
-func processBranchUpdate(up events.BranchUpdate, liveSHAs *liveSHAMap, publisher metrics.Publisher) {
+// openedAt returns when the PR was opened, or the time of the update, if it is
+// not known, as for the updates archived before it was recorded.
+func openedAt(up events.PullUpdate) time.Time {
+	if up.Opened.IsZero() {
+		return up.Timestamp
+	}
+
+	return up.Opened
+}
+
+func processBranchUpdate(up events.BranchUpdate, live *liveState, publisher metrics.Publisher) {
 	switch up.Action {
 	case events.Deleted:
 		// up.SHA would be all 0s, we need OldSHA here
 		log.Printf("Branch is deleted, removing live SHA %s", up.OldSHA)
 
-		delete(*liveSHAs, up.SHA)
+		live.evict(shaKey{up.Repo, up.OldSHA})
 	case events.Rebased:
 		// This means the branch was updated
 		log.Printf("Branch is updated, replacing live SHA %s with %s", up.OldSHA, up.SHA)
 
-		delete(*liveSHAs, up.OldSHA)
-		(*liveSHAs)[up.SHA] = newShaState(up.Timestamp)
+		// A push does not tell which PRs it goes to, but the previous head knows
+		if old, ok := live.SHAs[shaKey{up.Repo, up.OldSHA}]; ok {
+			for _, number := range append([]int(nil), old.PRs...) {
+				if pr, ok := live.PRs[prKey{up.Repo, number}]; ok {
+					live.setHead(pr, up.SHA, up.Timestamp)
+				}
+			}
+
+			live.forget(old.key())
+		}
+
+		// The synchronize event of a PR might have been processed already
+		live.track(up.Repo, up.SHA, up.Timestamp)
 	}
 
 	publisher.RegisterBranchEvent(up.Repo, up.Action)
 }
 
-func processCommitUpdate(up events.CommitUpdate, liveSHAs *liveSHAMap, publisher metrics.Publisher, contextOk config.ContextChecker, trackBuildTimes bool) {
+// processReviewUpdate times the first review of a PR, its first request for
+// changes, and its first approval, from the time the PR was opened, regardless
+// of how many times it got pushed to since.
+func processReviewUpdate(up events.ReviewUpdate, live *liveState, publisher metrics.Publisher) {
+	pr, ok := live.PRs[prKey{up.Repo, up.Number}]
+	if !ok {
+		log.Printf("PR %d of %s is not tracked, skipping", up.Number, up.Repo)
+		return
+	}
+
+	if head, ok := pr.head(); ok {
+		if state, ok := live.SHAs[shaKey{up.Repo, head}]; ok {
+			state.seen(up.Timestamp)
+		}
+	}
+
+	exemplar := metrics.Exemplar{PR: up.Number, SHA: up.SHA}
+
+	// The PR might have been opened before it got tracked
+	opened := up.Opened
+	if opened.IsZero() {
+		opened = pr.Opened
+	}
+
+	if pr.Reviewed.IsZero() {
+		log.Printf("First review time for PR %d is %s", up.Number, up.Timestamp.Sub(opened))
+		publisher.RegisterReview(up.Repo, firstReview, up.Timestamp.Sub(opened).Seconds(), exemplar)
+
+		pr.Reviewed = up.Timestamp
+	}
+
+	switch up.State {
+	case events.ChangesRequested:
+		if pr.ChangesRequested.IsZero() {
+			publisher.RegisterReview(up.Repo, changesRequested, up.Timestamp.Sub(opened).Seconds(), exemplar)
+
+			pr.ChangesRequested = up.Timestamp
+		}
+	case events.Approved:
+		if pr.Approved.IsZero() {
+			log.Printf("Approval time for PR %d is %s", up.Number, up.Timestamp.Sub(opened))
+			publisher.RegisterReview(up.Repo, approved, up.Timestamp.Sub(opened).Seconds(), exemplar)
+
+			pr.Approved = up.Timestamp
+		}
+	}
+}
+
+// requiredOutcome returns the outcome of the required builds, once all of them
+// have finished. The outcome is a failure if any of them failed. A build that
+// was cancelled, or is waiting on an action, is expected to run again, so
+// there is no outcome until it does.
+func requiredOutcome(required []string, finished map[string]events.Status) (events.Status, bool) {
+	outcome := events.Success
+
+	for _, context := range required {
+		status, ok := finished[context]
+		if !ok {
+			return 0, false
+		}
+
+		switch {
+		case status.IsFailing():
+			outcome = events.Failure
+		case !status.IsPassing():
+			return 0, false
+		}
+	}
+
+	return outcome, true
+}
+
+func processCommitUpdate(up events.CommitUpdate, live *liveState, publisher metrics.Publisher, checkers config.Checkers, trackBuildTimes bool) {
 	publisher.RegisterStatusCheck(up.Repo, up.Status)
 
-	state, ok := (*liveSHAs)[up.SHA]
+	state, ok := live.SHAs[shaKey{up.Repo, up.SHA}]
 	if !ok {
 		log.Printf("Could not find the start time for SHA %s, skipping", up.SHA)
 		return
 	}
 
+	state.seen(up.Timestamp)
+
 	// The first status can be anything, pending, error, success, ...
 	if !state.CheckSeen {
 		startTime := up.Timestamp.Sub(state.Time)
 		log.Printf("CI Start time for SHA %s is %s", up.SHA, startTime)
-		publisher.RegisterStart(up.Repo, startTime.Seconds())
+		publisher.RegisterStart(up.Repo, startTime.Seconds(), state.exemplar(up.Context))
 
-		// This will be propagated to liveSHAs
+		// This will be propagated to the live SHAs
 		state.CheckSeen = true
 		state.CIStart = up.Timestamp
 	}
 
-	switch up.Status {
-	case events.Pending:
+	switch {
+	case up.Status == events.Pending:
+		// The build was restarted, the PR waits for it again
+		if _, ok := state.Finished[up.Context]; ok {
+			log.Printf("Build %s is retried on SHA %s", up.Context, up.SHA)
+			publisher.RegisterRetry(up.Repo, up.Context)
+		}
+
+		delete(state.Finished, up.Context)
+
+		if _, ok := state.Pending[up.Context]; !ok {
+			state.Pending[up.Context] = up.Timestamp
+		}
+
 		// Track individual builds
 		if trackBuildTimes {
-			(*liveSHAs)[up.SHA].BuildStarts[up.Context] = up.Timestamp
+			state.BuildStarts[up.Context] = up.Timestamp
+		}
+
+	case up.Status.IsTerminal():
+		delete(state.Pending, up.Context)
+		delete(state.Stuck, up.Context)
+
+		// A build that passes after failing, without a change to the code, is flaky
+		switch {
+		case up.Status.IsFailing():
+			state.Failed[up.Context] = true
+		case up.Status.IsPassing() && state.Failed[up.Context]:
+			log.Printf("Build %s is flaky on SHA %s", up.Context, up.SHA)
+			publisher.RegisterFlaky(up.Repo, up.Context)
+
+			delete(state.Failed, up.Context)
 		}
 
-	case events.Success, events.Failure, events.Error:
 		// Validation time is per PR, so only matters for the right context
-		if contextOk(up.Repo, up.Context) {
+		if checkers.Aggregate != nil && checkers.Aggregate(up.Repo, up.Context) {
 			validationTime := up.Timestamp.Sub(state.Time)
 			log.Printf("Validation time for SHA %s is %s with status %s", up.SHA, validationTime, up.Status)
-			publisher.RegisterValidation(up.Repo, up.Status, validationTime.Seconds())
+			publisher.RegisterValidation(up.Repo, up.Status, validationTime.Seconds(), state.exemplar(up.Context))
+
+			state.Validated = true
+		}
+
+		// Time how fast the CI tells that the PR is broken
+		if !state.FailureSeen && up.Status.IsFailing() && checkers.FailFast != nil && checkers.FailFast(up.Repo, up.Context) {
+			failureTime := up.Timestamp.Sub(state.Time)
+			log.Printf("First failure time for SHA %s is %s, from build %s", up.SHA, failureTime, up.Context)
+			publisher.RegisterFirstFailure(up.Repo, up.Context, up.Status, failureTime.Seconds(), state.exemplar(up.Context))
+
+			state.FailureSeen = true
+		}
+
+		// Or, the PR is validated once the last of the required builds finishes.
+		// The builds required depend on where the PR goes, and the same head can
+		// go to several branches. Only the first outcome counts, retrying a
+		// required build afterwards does not validate the PR again.
+		state.Finished[up.Context] = up.Status
+
+		for _, base := range live.bases(state) {
+			var required []string
+			if checkers.Required != nil {
+				required = checkers.Required(up.Repo, base)
+			}
+
+			if state.Validated || !containsString(required, up.Context) {
+				continue
+			}
+
+			if outcome, ok := requiredOutcome(required, state.Finished); ok {
+				validationTime := up.Timestamp.Sub(state.Time)
+				log.Printf("Validation time for SHA %s is %s with status %s, after all required builds", up.SHA, validationTime, outcome)
+				publisher.RegisterValidation(up.Repo, outcome, validationTime.Seconds(), state.exemplar(up.Context))
+
+				state.Validated = true
+			}
 		}
 
 		// Track individual builds. Work around the fact that sometimes we might
 		// have not received the 'pending' for a build. Then, take the CIStart time
 		// as a good approximation
 		if trackBuildTimes {
-			buildStart, ok := (*liveSHAs)[up.SHA].BuildStarts[up.Context]
+			buildStart, ok := state.BuildStarts[up.Context]
 			if !ok {
 				buildStart = state.CIStart
 
@@ -121,7 +319,7 @@ func processCommitUpdate(up events.CommitUpdate, liveSHAs *liveSHAMap, publisher
 			}
 
 			buildTime := up.Timestamp.Sub(buildStart)
-			publisher.RegisterBuildDone(up.Repo, up.Context, up.Status, buildTime.Seconds())
+			publisher.RegisterBuildDone(up.Repo, up.Context, up.Status, buildTime.Seconds(), state.exemplar(up.Context))
 		}
 
 	default:
@@ -129,51 +327,253 @@ func processCommitUpdate(up events.CommitUpdate, liveSHAs *liveSHAMap, publisher
 	}
 }
 
+// runnerLabels returns a canonical representation of the runner labels, as the
+// order in `runs-on:` does not matter.
+func runnerLabels(labels []string) string {
+	sorted := append([]string(nil), labels...)
+	sort.Strings(sorted)
+
+	return strings.Join(sorted, ",")
+}
+
+func processJobUpdate(up events.JobUpdate, publisher metrics.Publisher) {
+	// The update carries all the timestamps, thus wait for the job to complete,
+	// in order to observe each job only once.
+	if !up.Status.IsTerminal() {
+		return
+	}
+
+	// Jobs cancelled or skipped before getting a runner never started
+	if up.StartedAt.IsZero() || up.StartedAt.Before(up.CreatedAt) || up.CompletedAt.Before(up.StartedAt) {
+		log.Printf("Job %s of workflow %s never started, skipping", up.Job, up.Workflow)
+		return
+	}
+
+	labels := runnerLabels(up.Labels)
+
+	queueTime := up.StartedAt.Sub(up.CreatedAt)
+	log.Printf("Queue time for job %s of workflow %s on %s is %s", up.Job, up.Workflow, labels, queueTime)
+	publisher.RegisterJobQueued(up.Repo, up.Workflow, up.Job, labels, queueTime.Seconds())
+
+	runTime := up.CompletedAt.Sub(up.StartedAt)
+	publisher.RegisterJobDone(up.Repo, up.Workflow, up.Job, labels, up.Status, runTime.Seconds())
+}
+
+func processWorkflowUpdate(up events.WorkflowUpdate, publisher metrics.Publisher) {
+	if !up.Status.IsTerminal() {
+		return
+	}
+
+	if up.StartedAt.IsZero() || up.CompletedAt.Before(up.StartedAt) {
+		log.Printf("Workflow %s never started, skipping", up.Workflow)
+		return
+	}
+
+	// Re-runs keep the creation time of the first attempt, which would count
+	// the duration of all previous attempts as queueing
+	if up.Attempt <= 1 && !up.StartedAt.Before(up.CreatedAt) {
+		queueTime := up.StartedAt.Sub(up.CreatedAt)
+		log.Printf("Queue time for workflow %s is %s", up.Workflow, queueTime)
+		publisher.RegisterRunQueued(up.Repo, up.Workflow, queueTime.Seconds())
+	}
+
+	runTime := up.CompletedAt.Sub(up.StartedAt)
+	publisher.RegisterRunDone(up.Repo, up.Workflow, up.Status, runTime.Seconds())
+}
+
+func processUpdate(update interface{}, live *liveState, publisher metrics.Publisher, checkers config.Checkers, trackBuildTimes bool) {
+	switch up := update.(type) {
+	case events.PullUpdate:
+		// When a PR is opened, its tracking starts.
+		log.Printf("updated pr: %d to commit: %s, action=%s\n", up.Number, up.SHA, up.Action)
+
+		processPullUpdate(up, live, publisher)
+
+	case events.BranchUpdate:
+		log.Printf("updated a branch to commit: %s (from %s)", up.SHA, up.OldSHA)
+
+		processBranchUpdate(up, live, publisher)
+
+	case events.CommitUpdate:
+		// track good, bad, overall
+		// Find which PRs are the ones with the status as the HEAD
+		// and use that
+		log.Printf("updated commit: %s context: %s status: %s", up.SHA, up.Context, up.Status)
+
+		processCommitUpdate(up, live, publisher, checkers, trackBuildTimes)
+
+	case events.ReviewUpdate:
+		log.Printf("updated pr: %d with a review: %s", up.Number, up.State)
+
+		processReviewUpdate(up, live, publisher)
+
+	case events.JobUpdate:
+		log.Printf("updated job: %s workflow: %s status: %s", up.Job, up.Workflow, up.Status)
+
+		processJobUpdate(up, publisher)
+
+	case events.WorkflowUpdate:
+		log.Printf("updated workflow: %s status: %s", up.Workflow, up.Status)
+
+		processWorkflowUpdate(up, publisher)
+	}
+}
+
+// drain passes all the updates already queued to process, without waiting for
+// new ones to arrive.
+func drain(updates <-chan interface{}, process func(interface{})) {
+	for {
+		select {
+		case update, ok := <-updates:
+			if !ok {
+				return
+			}
+
+			process(update)
+		default:
+			return
+		}
+	}
+}
+
 // MetricsProcessor receives updates when
 // - a pull request is opened/updated/closed
 // - a branch receives a new push (merge to master is a push event)
 // - a status has been received for a commit
+// - a pull request gets reviewed
+// - a GitHub Actions job or workflow run changes its state
 // The pullUpdate and branchUpdate channels will update a branch or PR SHA
 // to the current one.
 //
 // The MetricsProcessor works by keeping a track of "live" SHAs. They get
 // created when a PR is opened/reopened. They get updated when a branch is being
 // pushed to (while the old value gets removed). For each of these live SHAs, it
-// keeps the creation time (when PR/branch has been created).
+// keeps the creation time (when PR/branch has been created). Alongside, it
+// keeps a track of the open PRs, with the time they got opened, and the SHAs
+// they had as their head. SHAs are tracked per repository, and PRs per
+// repository and number, as neither SHAs nor PR numbers are unique across
+// repositories.
+//
+// The assumption is that the CI builds everything (branches and PRs). Branches
+// that linger around, and PRs that never get closed, are evicted once they have
+// not seen an update for longer than SHATTL, or when there are more than MaxSHAs
+// live SHAs being tracked.
+//
+// Every StuckInterval, the builds pending for longer than the Stuck checker
+// allows are counted as stuck. Stuck builds whose SHA stops being tracked are
+// counted as abandoned.
+//
+// The figures of the live state, such as the open PRs, are computed on request
+// of the Collector, in order to be reported at the time of scraping.
 //
-// The assumption is that the CI builds everything (branches and PRs). If there are
-// branches that linger around, it's not a problem, because there aren't so many of them.
-func (p *Pulley) MetricsProcessor(contextOk config.ContextChecker, trackBuildTimes bool) {
-	// Keep track of live SHAs -- we don't need separation per repository, as SHAs are pretty unique
-	// map[commitSHA]shaState
-	liveSHAs := make(liveSHAMap)
+// If SnapshotPath is set, the live SHAs are restored from it on start, and
+// saved to it every SnapshotInterval and once the processing stops, either due
+// to the updates channel being closed, or due to Stop being called.
+func (p *Pulley) MetricsProcessor(checkers config.Checkers, trackBuildTimes bool) {
+	live := newLiveState()
+
+	if p.SnapshotPath != "" {
+		restored, err := loadSnapshot(p.SnapshotPath)
+		if err != nil {
+			log.Printf("Could not restore the state from %s, starting from scratch: %v", p.SnapshotPath, err)
+		} else {
+			log.Printf("Restored %d live SHAs and %d PRs from %s", len(restored.SHAs), len(restored.PRs), p.SnapshotPath)
+
+			live = restored
+		}
+	}
+
+	live.forgotten = func(state *shaState) {
+		abandonStuck(state, p.Metrics)
+	}
+
+	p.stop = make(chan struct{})
+	p.checkers = make(chan config.Checkers)
+	p.gauges = make(chan chan map[string]*repoGauges)
+	p.done = make(chan struct{})
+
+	if p.QueuePolicy == config.SpillPolicy {
+		p.spool = newSpool(p.QueueSpillPath)
+
+		p.WG.Add(1)
+
+		go p.unspool(p.Updates)
+	}
 
 	p.WG.Add(1)
 
 	go func(updates <-chan interface{}) {
 		defer p.WG.Done()
+		defer close(p.done)
 
-		for update := range updates {
-			switch up := update.(type) {
-			case events.PullUpdate:
-				// When a PR is opened, its tracking starts.
-				log.Printf("updated pr: %d to commit: %s, action=%s\n", up.Number, up.SHA, up.Action)
+		// A nil channel never fires, thus expired SHAs are not swept without a TTL
+		var sweep <-chan time.Time
 
-				processPullUpdate(up, &liveSHAs, p.Metrics)
+		if p.SHATTL > 0 {
+			ticker := time.NewTicker(sweepInterval(p.SHATTL))
+			defer ticker.Stop()
 
-			case events.BranchUpdate:
-				log.Printf("updated a branch to commit: %s (from %s)", up.SHA, up.OldSHA)
+			sweep = ticker.C
+		}
+
+		var stuck <-chan time.Time
+
+		if p.StuckInterval > 0 {
+			ticker := time.NewTicker(p.StuckInterval)
+			defer ticker.Stop()
+
+			stuck = ticker.C
+		}
+
+		var persist <-chan time.Time
+
+		if p.SnapshotPath != "" && p.SnapshotInterval > 0 {
+			ticker := time.NewTicker(p.SnapshotInterval)
+			defer ticker.Stop()
+
+			persist = ticker.C
+		}
 
-				processBranchUpdate(up, &liveSHAs, p.Metrics)
+		for {
+			select {
+			case update, ok := <-updates:
+				if !ok {
+					// Nothing more will change, keep the state for the next start
+					p.snapshot(live)
 
-			case events.CommitUpdate:
-				// track good, bad, overall
-				// Find which PRs are the ones with the status as the HEAD
-				// and use that
-				log.Printf("updated commit: %s context: %s status: %s", up.SHA, up.Context, up.Status)
+					return
+				}
 
-				processCommitUpdate(up, &liveSHAs, p.Metrics, contextOk, trackBuildTimes)
+				processUpdate(update, live, p.Metrics, checkers, trackBuildTimes)
+				evictOverflow(live, p.MaxSHAs, p.Metrics)
+
+			case now := <-sweep:
+				evictExpired(live, now, p.SHATTL, p.Metrics)
+
+			case now := <-stuck:
+				sweepStuck(live, now, checkers.Stuck, p.StuckLinks, p.Metrics)
+
+			case <-persist:
+				p.snapshot(live)
+
+			case checkers = <-p.checkers:
+				log.Printf("Reloaded the contexts to monitor")
+
+			case reply := <-p.gauges:
+				reply <- live.gauges(time.Now())
+
+			case <-p.stop:
+				drain(updates, func(update interface{}) {
+					processUpdate(update, live, p.Metrics, checkers, trackBuildTimes)
+					evictOverflow(live, p.MaxSHAs, p.Metrics)
+				})
+
+				p.snapshot(live)
+
+				return
 			}
+
+			p.Metrics.RegisterTrackedSHAs(len(live.SHAs))
 		}
 	}(p.Updates)
 }
@@ -1,15 +1,23 @@
 package service
 
 import (
+	"context"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/knl/pulley/internal/config"
 	"github.com/knl/pulley/internal/events"
+	"github.com/knl/pulley/internal/metrics"
 	"github.com/knl/pulley/internal/test"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -17,53 +25,311 @@ type Key struct {
 	MetricName, Event, Repository string
 }
 
+// fakeMetrics records the metrics in database. It is locked, as the metrics
+// are also published from the HTTP handlers, not only from the
+// MetricsProcessor.
 type fakeMetrics struct {
-	database map[Key]float64
+	mu        sync.Mutex
+	database  map[Key]float64
+	exemplars map[Key]metrics.Exemplar // The last exemplar of each metric, if set
 }
 
-func (m *fakeMetrics) RegisterMerge(repository string, durationSeconds float64) {
+func (m *fakeMetrics) exemplar(key Key, exemplar metrics.Exemplar) {
+	if m.exemplars != nil {
+		m.exemplars[key] = exemplar
+	}
+}
+
+func (m *fakeMetrics) RegisterMerge(repository string, durationSeconds float64, exemplar metrics.Exemplar) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := Key{"merge", "", repository}
+	m.exemplar(key, exemplar)
+
+	val := m.database[key]
+	m.database[key] = val + durationSeconds
 }
 
-func (m *fakeMetrics) RegisterStart(repository string, durationSeconds float64) {
+func (m *fakeMetrics) RegisterStart(repository string, durationSeconds float64, exemplar metrics.Exemplar) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.exemplar(Key{"start", "", repository}, exemplar)
 }
 
-func (m *fakeMetrics) RegisterValidation(repository string, status events.Status, durationSeconds float64) {
+func (m *fakeMetrics) RegisterValidation(repository string, status events.Status, durationSeconds float64, exemplar metrics.Exemplar) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	key := Key{"ci_validation", status.String(), repository}
+	m.exemplar(key, exemplar)
+
 	val := m.database[key]
 	m.database[key] = val + durationSeconds
 }
 
-func (m *fakeMetrics) RegisterBuildDone(repository string, build string, status events.Status, durationSeconds float64) {
+func (m *fakeMetrics) RegisterBuildDone(repository string, build string, status events.Status, durationSeconds float64, exemplar metrics.Exemplar) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.exemplar(Key{"build_done", build, repository}, exemplar)
 }
 
 func (m *fakeMetrics) RegisterPREvent(repository string, event events.PREvent) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	key := Key{"pr_event", event.String(), repository}
 	val := m.database[key]
 	m.database[key] = val + 1
 }
 
 func (m *fakeMetrics) RegisterBranchEvent(repository string, event events.BranchEvent) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	key := Key{"branch_event", event.String(), repository}
 	val := m.database[key]
 	m.database[key] = val + 1
 }
 
 func (m *fakeMetrics) RegisterStatusCheck(repository string, state events.Status) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	key := Key{"status_check", state.String(), repository}
 	val := m.database[key]
 	m.database[key] = val + 1
 }
 
 func (m *fakeMetrics) RegisterMissedPending(repository string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	key := Key{"pending", "missed", repository}
 	val := m.database[key]
 	m.database[key] = val + 1
 }
 
+func (m *fakeMetrics) RegisterJobQueued(repository string, workflow string, job string, runnerLabels string, durationSeconds float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := Key{"job_queued", runnerLabels, repository}
+	val := m.database[key]
+	m.database[key] = val + durationSeconds
+}
+
+func (m *fakeMetrics) RegisterJobDone(repository string, workflow string, job string, runnerLabels string, status events.Status, durationSeconds float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := Key{"job_done", status.String(), repository}
+	val := m.database[key]
+	m.database[key] = val + durationSeconds
+}
+
+func (m *fakeMetrics) RegisterRunQueued(repository string, workflow string, durationSeconds float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := Key{"run_queued", workflow, repository}
+	val := m.database[key]
+	m.database[key] = val + durationSeconds
+}
+
+func (m *fakeMetrics) RegisterRunDone(repository string, workflow string, status events.Status, durationSeconds float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := Key{"run_done", status.String(), repository}
+	val := m.database[key]
+	m.database[key] = val + durationSeconds
+}
+
+func (m *fakeMetrics) RegisterTrackedSHAs(count int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := Key{"tracked_shas", "", ""}
+	m.database[key] = float64(count)
+}
+
+func (m *fakeMetrics) RegisterEviction(reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := Key{"eviction", reason, ""}
+	val := m.database[key]
+	m.database[key] = val + 1
+}
+
+func (m *fakeMetrics) RegisterDroppedUpdate(reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := Key{"dropped", reason, ""}
+	val := m.database[key]
+	m.database[key] = val + 1
+}
+
+func (m *fakeMetrics) RegisterSpilledUpdate() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := Key{"spilled", "", ""}
+	val := m.database[key]
+	m.database[key] = val + 1
+}
+
+func (m *fakeMetrics) RegisterDuplicateDelivery(event string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := Key{"duplicate", event, ""}
+	val := m.database[key]
+	m.database[key] = val + 1
+}
+
+func (m *fakeMetrics) RegisterValidatedDelivery(secret int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := Key{"validated", strconv.Itoa(secret), ""}
+	val := m.database[key]
+	m.database[key] = val + 1
+}
+
+func (m *fakeMetrics) RegisterReloadFailure() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := Key{"reload_failure", "", ""}
+	val := m.database[key]
+	m.database[key] = val + 1
+}
+
+func (m *fakeMetrics) RegisterReview(repository string, review string, durationSeconds float64, exemplar metrics.Exemplar) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := Key{"review", review, repository}
+	m.exemplar(key, exemplar)
+
+	val := m.database[key]
+	m.database[key] = val + durationSeconds
+}
+
+func (m *fakeMetrics) RegisterApprovedMerge(repository string, durationSeconds float64, exemplar metrics.Exemplar) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := Key{"approved_merge", "", repository}
+	m.exemplar(key, exemplar)
+
+	val := m.database[key]
+	m.database[key] = val + durationSeconds
+}
+
+func (m *fakeMetrics) RegisterLastPushMerge(repository string, durationSeconds float64, exemplar metrics.Exemplar) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := Key{"last_push_merge", "", repository}
+	m.exemplar(key, exemplar)
+
+	val := m.database[key]
+	m.database[key] = val + durationSeconds
+}
+
+func (m *fakeMetrics) RegisterMergedPushes(repository string, pushes int, exemplar metrics.Exemplar) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := Key{"merged_pushes", "", repository}
+	m.exemplar(key, exemplar)
+
+	val := m.database[key]
+	m.database[key] = val + float64(pushes)
+}
+
+func (m *fakeMetrics) RegisterRetry(repository string, build string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := Key{"retry", build, repository}
+	val := m.database[key]
+	m.database[key] = val + 1
+}
+
+func (m *fakeMetrics) RegisterFlaky(repository string, build string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := Key{"flaky", build, repository}
+	val := m.database[key]
+	m.database[key] = val + 1
+}
+
+func (m *fakeMetrics) RegisterStuckBuilds(counts map[string]int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key := range m.database {
+		if key.MetricName == "stuck" {
+			delete(m.database, key)
+		}
+	}
+
+	for repository, count := range counts {
+		m.database[Key{"stuck", "", repository}] = float64(count)
+	}
+}
+
+func (m *fakeMetrics) RegisterAbandonedBuild(repository string, build string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := Key{"abandoned", build, repository}
+	val := m.database[key]
+	m.database[key] = val + 1
+}
+
+func (m *fakeMetrics) RepositoryLabels(repositories []string) map[string]string {
+	return labelsOf(repositories, func(repository string) string { return repository })
+}
+
+func (m *fakeMetrics) BuildLabels(builds []string) map[string]string {
+	return labelsOf(builds, func(build string) string { return build })
+}
+
+func labelsOf(values []string, label func(string) string) map[string]string {
+	labels := make(map[string]string, len(values))
+	for _, value := range values {
+		labels[value] = label(value)
+	}
+
+	return labels
+}
+
+func (m *fakeMetrics) RegisterFirstFailure(repository string, build string, status events.Status, durationSeconds float64, exemplar metrics.Exemplar) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := Key{"first_failure", build, repository}
+	m.exemplar(key, exemplar)
+
+	val := m.database[key]
+	m.database[key] = val + durationSeconds
+}
+
 func matchAllContexts(repo, context string) bool {
 	return true
 }
 
+var matchAll = config.Checkers{Aggregate: matchAllContexts}
+
 func collectKeys(database map[Key]float64, metric string) []Key {
 	keys := make([]Key, 0, len(database))
 
@@ -92,10 +358,10 @@ func TestPullEventsRecognized(t *testing.T) {
 	pulley := Pulley{
 		Updates: make(chan interface{}),
 		Metrics: &m,
-		Token:   nil,
+		Tokens:  nil,
 	}
 
-	pulley.MetricsProcessor(matchAllContexts, false)
+	pulley.MetricsProcessor(matchAll, false)
 
 	// Not the best approach, but we don't test MetricsProcessor directly,
 	// in order to avoid data races
@@ -122,10 +388,10 @@ func TestBranchEventsRecognized(t *testing.T) {
 	pulley := Pulley{
 		Updates: make(chan interface{}),
 		Metrics: &m,
-		Token:   nil,
+		Tokens:  nil,
 	}
 
-	pulley.MetricsProcessor(matchAllContexts, false)
+	pulley.MetricsProcessor(matchAll, false)
 
 	// Not the best approach, but we don't test MetricsProcessor directly,
 	// in order to avoid data races
@@ -143,6 +409,32 @@ func TestBranchEventsRecognized(t *testing.T) {
 	assert.Empty(collectKeys(m.database, "commit_event"))
 }
 
+// Deleting a branch stops tracking its head.
+func TestBranchDeleted(t *testing.T) {
+	m := fakeMetrics{
+		database: make(map[Key]float64),
+	}
+
+	live := newLiveState()
+
+	created := test.MakeBranchUpdate()
+	live.track(created.Repo, created.SHA, time.Now())
+	other := live.track(created.Repo, test.RandSHA(), time.Now())
+
+	processBranchUpdate(events.BranchUpdate{
+		Repo:      created.Repo,
+		Action:    events.Deleted,
+		SHA:       test.ZeroSHA,
+		OldSHA:    created.SHA,
+		Timestamp: time.Now(),
+	}, live, &m)
+
+	assert := assert.New(t)
+	assert.NotContains(live.SHAs, shaKey{created.Repo, created.SHA})
+	assert.Contains(live.SHAs, other.key())
+	assert.Equal(float64(1), m.database[Key{"branch_event", events.Deleted.String(), test.DefaultRepository}])
+}
+
 // Correctly count CI validation times
 // Send a new PR event, CI pending, CI success.
 func TestCIValidationWithPending(t *testing.T) {
@@ -152,10 +444,10 @@ func TestCIValidationWithPending(t *testing.T) {
 	pulley := Pulley{
 		Updates: make(chan interface{}),
 		Metrics: &m,
-		Token:   nil,
+		Tokens:  nil,
 	}
 
-	pulley.MetricsProcessor(matchAllContexts, false)
+	pulley.MetricsProcessor(matchAll, false)
 
 	iterations := 10
 	pendingTimeSeconds := 13
@@ -204,10 +496,10 @@ func TestCIValidationWithoutPending(t *testing.T) {
 	pulley := Pulley{
 		Updates: make(chan interface{}),
 		Metrics: &m,
-		Token:   nil,
+		Tokens:  nil,
 	}
 
-	pulley.MetricsProcessor(matchAllContexts, false)
+	pulley.MetricsProcessor(matchAll, false)
 
 	iterations := 10
 	buildTimeSeconds := 60
@@ -238,3 +530,1293 @@ func TestCIValidationWithoutPending(t *testing.T) {
 	assert.GreaterOrEqual(duration, 0.99*expected)
 	assert.LessOrEqual(duration, 1.01*expected)
 }
+
+// Conclusions reported by the Checks API finish the validation just like
+// the terminal statuses do.
+func TestCIValidationWithCheckConclusion(t *testing.T) {
+	m := fakeMetrics{
+		database: make(map[Key]float64),
+	}
+	pulley := Pulley{
+		Updates: make(chan interface{}),
+		Metrics: &m,
+		Tokens:  nil,
+	}
+
+	pulley.MetricsProcessor(matchAll, false)
+
+	buildTimeSeconds := 60
+
+	pu := test.MakePullUpdate()
+	pulley.Updates <- pu
+
+	pulley.Updates <- events.CommitUpdate{
+		Repo:      pu.Repo,
+		Status:    events.TimedOut,
+		Context:   "some",
+		SHA:       pu.SHA,
+		Timestamp: pu.Timestamp.Add(time.Second * time.Duration(buildTimeSeconds)),
+	}
+
+	close(pulley.Updates)
+	pulley.WG.Wait()
+
+	assert := assert.New(t)
+	duration := m.database[Key{"ci_validation", events.TimedOut.String(), test.DefaultRepository}]
+
+	assert.InDelta(float64(buildTimeSeconds), duration, 0.01*float64(buildTimeSeconds))
+}
+
+// Jobs are observed once they complete, with the queueing time split from the
+// time spent running.
+var requiredTests = []struct {
+	name     string
+	statuses []events.Status // of lint, test, and build, in order
+	expected events.Status
+}{
+	{"AllPassed", []events.Status{events.Success, events.Skipped, events.Success}, events.Success},
+	{"OneFailed", []events.Status{events.Success, events.Failure, events.Success}, events.Failure},
+	{"OneTimedOut", []events.Status{events.Success, events.TimedOut, events.Neutral}, events.Failure},
+}
+
+// With the required strategy, a PR is validated when the last required build
+// finishes, with a failure if any of them failed.
+func TestCIValidationWithRequired(t *testing.T) {
+	for _, tt := range requiredTests {
+		tt := tt // see: https://github.com/kyoh86/scopelint/issues/4
+		t.Run(tt.name, func(t *testing.T) {
+			m := fakeMetrics{
+				database: make(map[Key]float64),
+			}
+			pulley := Pulley{
+				Updates: make(chan interface{}),
+				Metrics: &m,
+				Tokens:  nil,
+			}
+
+			pulley.MetricsProcessor(config.Checkers{
+				Required: func(repo, branch string) []string { return []string{"lint", "test", "build"} },
+			}, false)
+
+			pu := test.MakePullUpdate()
+			pulley.Updates <- pu
+
+			// Builds that are not required are ignored
+			contexts := []string{"lint", "docs", "test", "build"}
+			statuses := []events.Status{tt.statuses[0], events.Failure, tt.statuses[1], tt.statuses[2]}
+
+			for i, context := range contexts {
+				pulley.Updates <- events.CommitUpdate{
+					Repo:      pu.Repo,
+					Status:    statuses[i],
+					Context:   context,
+					SHA:       pu.SHA,
+					Timestamp: pu.Timestamp.Add(time.Duration(i+1) * time.Minute),
+				}
+			}
+
+			close(pulley.Updates)
+			pulley.WG.Wait()
+
+			assert := assert.New(t)
+			assert.Equal([]Key{{"ci_validation", tt.expected.String(), test.DefaultRepository}}, collectKeys(m.database, "ci_validation"))
+			assert.Equal(float64(4*60), m.database[Key{"ci_validation", tt.expected.String(), test.DefaultRepository}])
+		})
+	}
+}
+
+// A required build that is restarted needs to finish again.
+func TestCIValidationWithRequiredRestarted(t *testing.T) {
+	m := fakeMetrics{
+		database: make(map[Key]float64),
+	}
+	pulley := Pulley{
+		Updates: make(chan interface{}),
+		Metrics: &m,
+		Tokens:  nil,
+	}
+
+	pulley.MetricsProcessor(config.Checkers{
+		Required: func(repo, branch string) []string { return []string{"lint", "test"} },
+	}, false)
+
+	pu := test.MakePullUpdate()
+	pulley.Updates <- pu
+
+	updates := []struct {
+		context string
+		status  events.Status
+	}{
+		{"lint", events.Failure},
+		{"lint", events.Pending},
+		{"test", events.Success},
+		{"lint", events.Success},
+	}
+
+	for i, u := range updates {
+		pulley.Updates <- events.CommitUpdate{
+			Repo:      pu.Repo,
+			Status:    u.status,
+			Context:   u.context,
+			SHA:       pu.SHA,
+			Timestamp: pu.Timestamp.Add(time.Duration(i+1) * time.Minute),
+		}
+	}
+
+	close(pulley.Updates)
+	pulley.WG.Wait()
+
+	assert := assert.New(t)
+	assert.Equal([]Key{{"ci_validation", events.Success.String(), test.DefaultRepository}}, collectKeys(m.database, "ci_validation"))
+	assert.Equal(float64(4*60), m.database[Key{"ci_validation", events.Success.String(), test.DefaultRepository}])
+}
+
+// Retrying a required build after the PR is validated does not validate it
+// again, while a cancelled build leaves the PR waiting for it to be retried.
+func TestCIValidationWithRequiredRetried(t *testing.T) {
+	tests := []struct {
+		name     string
+		first    events.Status
+		expected Key
+		duration float64
+	}{
+		{"failed", events.Failure, Key{"ci_validation", events.Failure.String(), test.DefaultRepository}, 2 * 60},
+		{"cancelled", events.Cancelled, Key{"ci_validation", events.Success.String(), test.DefaultRepository}, 4 * 60},
+	}
+
+	for _, tt := range tests {
+		tt := tt // see: https://github.com/kyoh86/scopelint/issues/4
+		t.Run(tt.name, func(t *testing.T) {
+			m := fakeMetrics{
+				database: make(map[Key]float64),
+			}
+			pulley := Pulley{
+				Updates: make(chan interface{}),
+				Metrics: &m,
+				Tokens:  nil,
+			}
+
+			pulley.MetricsProcessor(config.Checkers{
+				Required: func(repo, branch string) []string { return []string{"lint", "test"} },
+			}, false)
+
+			pu := test.MakePullUpdate()
+			pulley.Updates <- pu
+
+			updates := []struct {
+				context string
+				status  events.Status
+			}{
+				{"lint", tt.first},
+				{"test", events.Success},
+				{"lint", events.Pending},
+				{"lint", events.Success},
+			}
+
+			for i, u := range updates {
+				pulley.Updates <- events.CommitUpdate{
+					Repo:      pu.Repo,
+					Status:    u.status,
+					Context:   u.context,
+					SHA:       pu.SHA,
+					Timestamp: pu.Timestamp.Add(time.Duration(i+1) * time.Minute),
+				}
+			}
+
+			close(pulley.Updates)
+			pulley.WG.Wait()
+
+			assert := assert.New(t)
+			assert.Equal([]Key{tt.expected}, collectKeys(m.database, "ci_validation"))
+			assert.Equal(tt.duration, m.database[tt.expected])
+		})
+	}
+}
+
+// The required builds depend on the branch the PR goes into, which a push to
+// the PR does not tell.
+func TestCIValidationWithRequiredBase(t *testing.T) {
+	m := fakeMetrics{
+		database: make(map[Key]float64),
+	}
+	pulley := Pulley{
+		Updates: make(chan interface{}),
+		Metrics: &m,
+		Tokens:  nil,
+	}
+
+	pulley.MetricsProcessor(config.Checkers{
+		Required: func(repo, branch string) []string {
+			if branch == "release" {
+				return []string{"lint", "test"}
+			}
+
+			return []string{"lint"}
+		},
+	}, false)
+
+	pu := test.MakePullUpdate()
+	pu.Base = "release"
+	pulley.Updates <- pu
+
+	bu := test.MakeBranchUpdate()
+	bu.Action = events.Rebased
+	bu.OldSHA = pu.SHA
+	bu.Timestamp = pu.Timestamp
+	pulley.Updates <- bu
+
+	for i, context := range []string{"lint", "test"} {
+		pulley.Updates <- events.CommitUpdate{
+			Repo:      pu.Repo,
+			Status:    events.Success,
+			Context:   context,
+			SHA:       bu.SHA,
+			Timestamp: pu.Timestamp.Add(time.Duration(i+1) * time.Minute),
+		}
+	}
+
+	close(pulley.Updates)
+	pulley.WG.Wait()
+
+	assert := assert.New(t)
+	assert.Equal([]Key{{"ci_validation", events.Success.String(), test.DefaultRepository}}, collectKeys(m.database, "ci_validation"))
+	assert.Equal(float64(2*60), m.database[Key{"ci_validation", events.Success.String(), test.DefaultRepository}])
+}
+
+// Reviews are timed from opening the PR, even after pushes to it, and only the
+// first of each kind counts.
+func TestReviews(t *testing.T) {
+	m := fakeMetrics{
+		database: make(map[Key]float64),
+	}
+	pulley := Pulley{
+		Updates: make(chan interface{}),
+		Metrics: &m,
+		Tokens:  nil,
+	}
+
+	pulley.MetricsProcessor(matchAll, false)
+
+	pu := test.MakePullUpdate()
+	pulley.Updates <- pu
+
+	bu := test.MakeBranchUpdate()
+	bu.Action = events.Rebased
+	bu.OldSHA = pu.SHA
+	bu.Timestamp = pu.Timestamp.Add(30 * time.Minute)
+	pulley.Updates <- bu
+
+	reviews := []struct {
+		state  events.ReviewState
+		minute int
+	}{
+		{events.Commented, 60},
+		{events.ChangesRequested, 90},
+		{events.ChangesRequested, 100},
+		{events.Approved, 120},
+		{events.Approved, 150},
+	}
+
+	for _, r := range reviews {
+		pulley.Updates <- events.ReviewUpdate{
+			Repo:      pu.Repo,
+			Number:    pu.Number,
+			SHA:       bu.SHA,
+			State:     r.state,
+			Opened:    pu.Timestamp,
+			Timestamp: pu.Timestamp.Add(time.Duration(r.minute) * time.Minute),
+		}
+	}
+
+	pulley.Updates <- events.PullUpdate{
+		Repo:      pu.Repo,
+		Action:    events.Closed,
+		SHA:       bu.SHA,
+		Number:    pu.Number,
+		Merged:    true,
+		Timestamp: pu.Timestamp.Add(180 * time.Minute),
+	}
+
+	close(pulley.Updates)
+	pulley.WG.Wait()
+
+	assert := assert.New(t)
+	assert.Equal(float64(60*60), m.database[Key{"review", "first", test.DefaultRepository}])
+	assert.Equal(float64(90*60), m.database[Key{"review", "changes_requested", test.DefaultRepository}])
+	assert.Equal(float64(120*60), m.database[Key{"review", "approved", test.DefaultRepository}])
+	assert.Equal(float64(60*60), m.database[Key{"approved_merge", "", test.DefaultRepository}])
+}
+
+// Only the first failure of a monitored build is timed.
+func TestFirstFailure(t *testing.T) {
+	m := fakeMetrics{
+		database: make(map[Key]float64),
+	}
+	pulley := Pulley{
+		Updates: make(chan interface{}),
+		Metrics: &m,
+		Tokens:  nil,
+	}
+
+	pulley.MetricsProcessor(config.Checkers{
+		FailFast: func(repo, context string) bool { return context != "flaky" },
+	}, false)
+
+	pu := test.MakePullUpdate()
+	pulley.Updates <- pu
+
+	updates := []struct {
+		context string
+		status  events.Status
+	}{
+		{"lint", events.Success},
+		{"flaky", events.Failure},
+		{"test", events.Cancelled},
+		{"test", events.TimedOut},
+		{"build", events.Failure},
+	}
+
+	for i, u := range updates {
+		pulley.Updates <- events.CommitUpdate{
+			Repo:      pu.Repo,
+			Status:    u.status,
+			Context:   u.context,
+			SHA:       pu.SHA,
+			Timestamp: pu.Timestamp.Add(time.Duration(i+1) * time.Minute),
+		}
+	}
+
+	close(pulley.Updates)
+	pulley.WG.Wait()
+
+	assert := assert.New(t)
+	assert.Equal([]Key{{"first_failure", "test", test.DefaultRepository}}, collectKeys(m.database, "first_failure"))
+	assert.Equal(float64(4*60), m.database[Key{"first_failure", "test", test.DefaultRepository}])
+}
+
+func TestJobQueueAndRunTimes(t *testing.T) {
+	m := fakeMetrics{
+		database: make(map[Key]float64),
+	}
+	pulley := Pulley{
+		Updates: make(chan interface{}),
+		Metrics: &m,
+		Tokens:  nil,
+	}
+
+	pulley.MetricsProcessor(matchAll, false)
+
+	created := time.Now()
+	ju := events.JobUpdate{
+		Repo:      test.DefaultRepository,
+		Workflow:  "CI",
+		Job:       "test",
+		Labels:    []string{"self-hosted", "linux"},
+		Status:    events.Pending,
+		CreatedAt: created,
+	}
+
+	pulley.Updates <- ju
+
+	ju.StartedAt = created.Add(30 * time.Second)
+	pulley.Updates <- ju
+
+	ju.Status = events.Failure
+	ju.CompletedAt = ju.StartedAt.Add(90 * time.Second)
+	pulley.Updates <- ju
+
+	close(pulley.Updates)
+	pulley.WG.Wait()
+
+	assert := assert.New(t)
+	assert.InDelta(30, m.database[Key{"job_queued", "linux,self-hosted", test.DefaultRepository}], 0.01)
+	assert.InDelta(90, m.database[Key{"job_done", events.Failure.String(), test.DefaultRepository}], 0.01)
+}
+
+// Re-runs of a workflow have only their run time recorded.
+func TestWorkflowRerunNotQueued(t *testing.T) {
+	m := fakeMetrics{
+		database: make(map[Key]float64),
+	}
+	pulley := Pulley{
+		Updates: make(chan interface{}),
+		Metrics: &m,
+		Tokens:  nil,
+	}
+
+	pulley.MetricsProcessor(matchAll, false)
+
+	created := time.Now()
+	wu := events.WorkflowUpdate{
+		Repo:        test.DefaultRepository,
+		Workflow:    "CI",
+		Attempt:     1,
+		Status:      events.Success,
+		CreatedAt:   created,
+		StartedAt:   created.Add(10 * time.Second),
+		CompletedAt: created.Add(70 * time.Second),
+	}
+
+	pulley.Updates <- wu
+
+	wu.Attempt = 2
+	wu.StartedAt = created.Add(time.Hour)
+	wu.CompletedAt = wu.StartedAt.Add(60 * time.Second)
+	pulley.Updates <- wu
+
+	close(pulley.Updates)
+	pulley.WG.Wait()
+
+	assert := assert.New(t)
+	assert.InDelta(10, m.database[Key{"run_queued", "CI", test.DefaultRepository}], 0.01)
+	assert.InDelta(120, m.database[Key{"run_done", events.Success.String(), test.DefaultRepository}], 0.01)
+}
+
+// A synchronize moves the tracking to the new head of the PR, restarting the
+// timing of the CI.
+func TestSynchronizeRestartsTiming(t *testing.T) {
+	m := fakeMetrics{
+		database: make(map[Key]float64),
+	}
+	pulley := Pulley{
+		Updates: make(chan interface{}),
+		Metrics: &m,
+		Tokens:  nil,
+	}
+
+	pulley.MetricsProcessor(matchAll, false)
+
+	pushTimeSeconds := 600
+	buildTimeSeconds := 60
+
+	pu := test.MakePullUpdate()
+	pulley.Updates <- pu
+
+	oldSHA := pu.SHA
+	pu.Action = events.Synchronize
+	pu.OldSHA = oldSHA
+	pu.SHA = test.RandSHA()
+	pu.Timestamp = pu.Timestamp.Add(time.Second * time.Duration(pushTimeSeconds))
+	pulley.Updates <- pu
+
+	cu := events.CommitUpdate{
+		Repo:      pu.Repo,
+		Status:    events.Success,
+		Context:   "some",
+		SHA:       oldSHA,
+		Timestamp: pu.Timestamp.Add(time.Second * time.Duration(buildTimeSeconds)),
+	}
+
+	// The old head is not tracked anymore
+	pulley.Updates <- cu
+
+	cu.SHA = pu.SHA
+	pulley.Updates <- cu
+
+	close(pulley.Updates)
+	pulley.WG.Wait()
+
+	assert := assert.New(t)
+	duration := m.database[Key{"ci_validation", events.Success.String(), test.DefaultRepository}]
+
+	assert.InDelta(float64(buildTimeSeconds), duration, 0.01*float64(buildTimeSeconds))
+	assert.Equal(float64(1), m.database[Key{"pr_event", events.Synchronize.String(), test.DefaultRepository}])
+}
+
+// A PR that was opened before it got tracked is timed from when it was opened,
+// not from the first update seen.
+func TestUntrackedPROpenTime(t *testing.T) {
+	for _, action := range []events.PREvent{events.Synchronize, events.ReadyForReview} {
+		action := action
+		t.Run(action.String(), func(t *testing.T) {
+			m := fakeMetrics{
+				database: make(map[Key]float64),
+			}
+			live := newLiveState()
+
+			pu := test.MakePullUpdate()
+			pu.Action = action
+			pu.Opened = pu.Timestamp.Add(-time.Hour)
+			processPullUpdate(pu, live, &m)
+
+			pu.Action = events.Closed
+			pu.Merged = true
+			pu.Timestamp = pu.Timestamp.Add(time.Minute)
+			processPullUpdate(pu, live, &m)
+
+			assert.InDelta(t, (time.Hour + time.Minute).Seconds(), m.database[Key{"merge", "", test.DefaultRepository}], 0.01)
+		})
+	}
+}
+
+// When there are too many live SHAs, the least recently updated get evicted.
+func TestEvictOverflow(t *testing.T) {
+	m := fakeMetrics{
+		database: make(map[Key]float64),
+	}
+	pulley := Pulley{
+		Updates: make(chan interface{}),
+		Metrics: &m,
+		Tokens:  nil,
+		MaxSHAs: 5,
+	}
+
+	pulley.MetricsProcessor(matchAll, false)
+
+	start := time.Now()
+
+	var first events.PullUpdate
+
+	for i := 0; i < 10; i++ {
+		pu := test.MakePullUpdate()
+		pu.Timestamp = start.Add(time.Duration(i) * time.Minute)
+
+		if i == 0 {
+			first = pu
+		}
+
+		pulley.Updates <- pu
+	}
+
+	// The first PR got evicted, thus there is nothing to validate
+	pulley.Updates <- events.CommitUpdate{
+		Repo:      first.Repo,
+		Status:    events.Success,
+		Context:   "some",
+		SHA:       first.SHA,
+		Timestamp: start.Add(time.Hour),
+	}
+
+	close(pulley.Updates)
+	pulley.WG.Wait()
+
+	assert := assert.New(t)
+	assert.Equal(float64(5), m.database[Key{"eviction", evictedCapacity, ""}])
+	assert.Equal(float64(5), m.database[Key{"tracked_shas", "", ""}])
+	assert.Empty(collectKeys(m.database, "ci_validation"))
+}
+
+// The same SHA in a fork and upstream, as well as the same PR number in two
+// repositories, are tracked separately.
+func TestStateKeyedByRepository(t *testing.T) {
+	m := fakeMetrics{
+		database: make(map[Key]float64),
+	}
+	pulley := Pulley{
+		Updates: make(chan interface{}),
+		Metrics: &m,
+		Tokens:  nil,
+	}
+
+	pulley.MetricsProcessor(matchAll, false)
+
+	upstream := test.MakePullUpdate()
+	pulley.Updates <- upstream
+
+	fork := upstream
+	fork.Repo = "someone/pulley"
+	fork.Timestamp = upstream.Timestamp.Add(10 * time.Minute)
+	pulley.Updates <- fork
+
+	// Closing the PR in the fork does not stop tracking the one upstream
+	pulley.Updates <- events.PullUpdate{
+		Repo:      fork.Repo,
+		Action:    events.Closed,
+		SHA:       fork.SHA,
+		Number:    fork.Number,
+		Timestamp: fork.Timestamp.Add(time.Minute),
+	}
+
+	pulley.Updates <- events.CommitUpdate{
+		Repo:      upstream.Repo,
+		Status:    events.Success,
+		Context:   "some",
+		SHA:       upstream.SHA,
+		Timestamp: upstream.Timestamp.Add(5 * time.Minute),
+	}
+
+	close(pulley.Updates)
+	pulley.WG.Wait()
+
+	assert := assert.New(t)
+	assert.Equal([]Key{{"ci_validation", events.Success.String(), test.DefaultRepository}}, collectKeys(m.database, "ci_validation"))
+	assert.Equal(float64(5*60), m.database[Key{"ci_validation", events.Success.String(), test.DefaultRepository}])
+}
+
+// Two PRs from the same branch into different bases share the head, but each
+// needs the builds its base requires.
+func TestPRsSharingHead(t *testing.T) {
+	m := fakeMetrics{
+		database: make(map[Key]float64),
+	}
+	pulley := Pulley{
+		Updates: make(chan interface{}),
+		Metrics: &m,
+		Tokens:  nil,
+	}
+
+	pulley.MetricsProcessor(config.Checkers{
+		Required: func(repo, branch string) []string {
+			if branch == "release" {
+				return []string{"lint", "test"}
+			}
+
+			return []string{"lint"}
+		},
+	}, false)
+
+	toMaster := test.MakePullUpdate()
+	toMaster.Base = "master"
+	pulley.Updates <- toMaster
+
+	toRelease := toMaster
+	toRelease.Number = toMaster.Number + 1
+	toRelease.Base = "release"
+	pulley.Updates <- toRelease
+
+	// Merging one PR keeps tracking the head for the other one
+	pulley.Updates <- events.PullUpdate{
+		Repo:      toMaster.Repo,
+		Action:    events.Closed,
+		SHA:       toMaster.SHA,
+		Number:    toMaster.Number,
+		Merged:    true,
+		Timestamp: toMaster.Timestamp.Add(time.Minute),
+	}
+
+	for i, context := range []string{"lint", "test"} {
+		pulley.Updates <- events.CommitUpdate{
+			Repo:      toMaster.Repo,
+			Status:    events.Success,
+			Context:   context,
+			SHA:       toMaster.SHA,
+			Timestamp: toMaster.Timestamp.Add(time.Duration(i+2) * time.Minute),
+		}
+	}
+
+	close(pulley.Updates)
+	pulley.WG.Wait()
+
+	assert := assert.New(t)
+	assert.Equal(float64(3*60), m.database[Key{"ci_validation", events.Success.String(), test.DefaultRepository}])
+	assert.Equal(float64(1*60), m.database[Key{"merge", "", test.DefaultRepository}])
+}
+
+// The merge is timed from opening the PR, not from the last push to it.
+func TestMergeTimedFromOpening(t *testing.T) {
+	m := fakeMetrics{
+		database: make(map[Key]float64),
+	}
+	pulley := Pulley{
+		Updates: make(chan interface{}),
+		Metrics: &m,
+		Tokens:  nil,
+	}
+
+	pulley.MetricsProcessor(matchAll, false)
+
+	pu := test.MakePullUpdate()
+	pulley.Updates <- pu
+
+	sync := pu
+	sync.Action = events.Synchronize
+	sync.OldSHA = pu.SHA
+	sync.SHA = test.RandSHA()
+	sync.Timestamp = pu.Timestamp.Add(30 * time.Minute)
+	pulley.Updates <- sync
+
+	bu := test.MakeBranchUpdate()
+	bu.Action = events.Rebased
+	bu.OldSHA = sync.SHA
+	bu.Timestamp = pu.Timestamp.Add(40 * time.Minute)
+	pulley.Updates <- bu
+
+	pulley.Updates <- events.PullUpdate{
+		Repo:      pu.Repo,
+		Action:    events.Closed,
+		SHA:       bu.SHA,
+		Number:    pu.Number,
+		Merged:    true,
+		Timestamp: pu.Timestamp.Add(time.Hour),
+	}
+
+	close(pulley.Updates)
+	pulley.WG.Wait()
+
+	assert := assert.New(t)
+	assert.Equal(float64(60*60), m.database[Key{"merge", "", test.DefaultRepository}])
+	assert.Equal(float64(20*60), m.database[Key{"last_push_merge", "", test.DefaultRepository}])
+	assert.Equal(float64(2), m.database[Key{"merged_pushes", "", test.DefaultRepository}])
+}
+
+// A push to a PR from the same repository shows up twice, as a push and as a
+// synchronize, and it is counted once.
+func TestPushesCountedOnce(t *testing.T) {
+	m := fakeMetrics{
+		database: make(map[Key]float64),
+	}
+	pulley := Pulley{
+		Updates: make(chan interface{}),
+		Metrics: &m,
+		Tokens:  nil,
+	}
+
+	pulley.MetricsProcessor(matchAll, false)
+
+	pu := test.MakePullUpdate()
+	pulley.Updates <- pu
+
+	bu := test.MakeBranchUpdate()
+	bu.Action = events.Rebased
+	bu.OldSHA = pu.SHA
+	bu.Timestamp = pu.Timestamp.Add(10 * time.Minute)
+	pulley.Updates <- bu
+
+	sync := pu
+	sync.Action = events.Synchronize
+	sync.OldSHA = pu.SHA
+	sync.SHA = bu.SHA
+	sync.Timestamp = pu.Timestamp.Add(11 * time.Minute)
+	pulley.Updates <- sync
+
+	pulley.Updates <- events.PullUpdate{
+		Repo:      pu.Repo,
+		Action:    events.Closed,
+		SHA:       bu.SHA,
+		Number:    pu.Number,
+		Merged:    true,
+		Timestamp: pu.Timestamp.Add(time.Hour),
+	}
+
+	close(pulley.Updates)
+	pulley.WG.Wait()
+
+	assert := assert.New(t)
+	assert.Equal(float64(1), m.database[Key{"merged_pushes", "", test.DefaultRepository}])
+	assert.Equal(float64(50*60), m.database[Key{"last_push_merge", "", test.DefaultRepository}])
+}
+
+// A build restarted on the same SHA is a retry, and it is flaky if it passes
+// after failing.
+func TestFlakyBuilds(t *testing.T) {
+	m := fakeMetrics{
+		database: make(map[Key]float64),
+	}
+	pulley := Pulley{
+		Updates: make(chan interface{}),
+		Metrics: &m,
+		Tokens:  nil,
+	}
+
+	pulley.MetricsProcessor(matchAll, false)
+
+	pu := test.MakePullUpdate()
+	pulley.Updates <- pu
+
+	updates := []struct {
+		context string
+		status  events.Status
+	}{
+		{"test", events.Pending},
+		{"test", events.Failure},
+		{"test", events.Pending},
+		{"test", events.Failure},
+		{"test", events.Pending},
+		{"test", events.Success},
+		{"lint", events.Pending},
+		{"lint", events.Success},
+		{"lint", events.Pending},
+		{"lint", events.Success},
+		{"deploy", events.Cancelled},
+		{"deploy", events.Pending},
+		{"deploy", events.Success},
+	}
+
+	for i, u := range updates {
+		pulley.Updates <- events.CommitUpdate{
+			Repo:      pu.Repo,
+			Status:    u.status,
+			Context:   u.context,
+			SHA:       pu.SHA,
+			Timestamp: pu.Timestamp.Add(time.Duration(i+1) * time.Minute),
+		}
+	}
+
+	// A push is a change to the code, thus a failure before it does not count
+	bu := test.MakeBranchUpdate()
+	bu.Action = events.Rebased
+	bu.OldSHA = pu.SHA
+	bu.Timestamp = pu.Timestamp.Add(time.Hour)
+	pulley.Updates <- bu
+
+	pulley.Updates <- events.CommitUpdate{
+		Repo:      pu.Repo,
+		Status:    events.Success,
+		Context:   "test",
+		SHA:       bu.SHA,
+		Timestamp: bu.Timestamp.Add(time.Minute),
+	}
+
+	close(pulley.Updates)
+	pulley.WG.Wait()
+
+	assert := assert.New(t)
+	assert.Equal(float64(2), m.database[Key{"retry", "test", test.DefaultRepository}])
+	assert.Equal(float64(1), m.database[Key{"retry", "lint", test.DefaultRepository}])
+	assert.Equal(float64(1), m.database[Key{"retry", "deploy", test.DefaultRepository}])
+	assert.Equal([]Key{{"flaky", "test", test.DefaultRepository}}, collectKeys(m.database, "flaky"))
+	assert.Equal(float64(1), m.database[Key{"flaky", "test", test.DefaultRepository}])
+}
+
+// Once over the limit, the least recently updated SHAs get evicted in a batch,
+// and the next ones are evicted only once over the limit again.
+func TestEvictOverflowBatch(t *testing.T) {
+	m := fakeMetrics{
+		database: make(map[Key]float64),
+	}
+
+	now := time.Now()
+	live := newLiveState()
+
+	track := func(i int) {
+		live.track(test.DefaultRepository, "sha"+strconv.Itoa(i), now.Add(time.Duration(i)*time.Minute))
+	}
+
+	for i := 0; i < 21; i++ {
+		track(i)
+	}
+
+	evictOverflow(live, 20, &m)
+
+	assert := assert.New(t)
+	assert.Len(live.SHAs, 18)
+	assert.NotContains(live.SHAs, shaKey{test.DefaultRepository, "sha2"})
+	assert.Contains(live.SHAs, shaKey{test.DefaultRepository, "sha3"})
+	assert.Equal(float64(3), m.database[Key{"eviction", evictedCapacity, ""}])
+
+	for i := 21; i < 23; i++ {
+		track(i)
+		evictOverflow(live, 20, &m)
+	}
+
+	assert.Len(live.SHAs, 20)
+	assert.Equal(float64(3), m.database[Key{"eviction", evictedCapacity, ""}])
+}
+
+// Live SHAs that have not been updated within the TTL get evicted.
+func TestEvictExpired(t *testing.T) {
+	m := fakeMetrics{
+		database: make(map[Key]float64),
+	}
+
+	now := time.Now()
+	live := newLiveState()
+
+	fresh := newPRState(test.DefaultRepository, 1, "master", now.Add(-time.Hour))
+	live.PRs[fresh.key()] = fresh
+	live.setHead(fresh, "fresh", now.Add(-time.Hour))
+
+	stale := newPRState(test.DefaultRepository, 2, "master", now.Add(-48*time.Hour))
+	live.PRs[stale.key()] = stale
+	live.setHead(stale, "stale", now.Add(-48*time.Hour))
+
+	evictExpired(live, now, 24*time.Hour, &m)
+
+	assert := assert.New(t)
+	assert.Contains(live.SHAs, shaKey{test.DefaultRepository, "fresh"})
+	assert.NotContains(live.SHAs, shaKey{test.DefaultRepository, "stale"})
+	assert.Contains(live.PRs, fresh.key())
+	assert.NotContains(live.PRs, stale.key())
+	assert.Equal(float64(1), m.database[Key{"eviction", evictedExpired, ""}])
+}
+
+// A SHA that another PR moves its head to is not expired with the PR it was
+// the head of first.
+func TestEvictExpiredMovedHead(t *testing.T) {
+	m := fakeMetrics{
+		database: make(map[Key]float64),
+	}
+
+	now := time.Now()
+	live := newLiveState()
+
+	stale := newPRState(test.DefaultRepository, 1, "master", now.Add(-48*time.Hour))
+	live.PRs[stale.key()] = stale
+	live.setHead(stale, "shared", now.Add(-48*time.Hour))
+
+	moved := newPRState(test.DefaultRepository, 2, "master", now.Add(-48*time.Hour))
+	live.PRs[moved.key()] = moved
+	live.setHead(moved, "old", now.Add(-48*time.Hour))
+	live.setHead(moved, "shared", now.Add(-time.Hour))
+
+	evictExpired(live, now, 24*time.Hour, &m)
+
+	assert := assert.New(t)
+	assert.Contains(live.SHAs, shaKey{test.DefaultRepository, "shared"})
+	assert.Equal(now.Add(-time.Hour), live.SHAs[shaKey{test.DefaultRepository, "shared"}].LastSeen)
+}
+
+func TestStuckBuilds(t *testing.T) {
+	m := fakeMetrics{
+		database: make(map[Key]float64),
+	}
+
+	checkers := matchAll
+	checkers.Stuck = func(repo, context string) time.Duration {
+		if context == "deploy" {
+			return 0
+		}
+
+		return time.Hour
+	}
+
+	now := time.Now()
+	live := newLiveState()
+	live.forgotten = func(state *shaState) {
+		abandonStuck(state, &m)
+	}
+
+	pu := test.MakePullUpdate()
+	pu.Timestamp = now.Add(-3 * time.Hour)
+	processPullUpdate(pu, live, &m)
+
+	pending := func(context string, since time.Time) {
+		processCommitUpdate(events.CommitUpdate{
+			Repo:      pu.Repo,
+			Status:    events.Pending,
+			Context:   context,
+			SHA:       pu.SHA,
+			Timestamp: since,
+		}, live, &m, checkers, false)
+	}
+
+	pending("test", now.Add(-2*time.Hour))
+	pending("test", now.Add(-time.Minute)) // still pending since the first one
+	pending("lint", now.Add(-2*time.Hour))
+	pending("docs", now.Add(-time.Minute))
+	pending("deploy", now.Add(-2*time.Hour))
+
+	sweepStuck(live, now, checkers.Stuck, "https://github.com/", &m)
+
+	assert := assert.New(t)
+	assert.Equal(float64(2), m.database[Key{"stuck", "", pu.Repo}])
+
+	state := live.SHAs[shaKey{pu.Repo, pu.SHA}]
+	assert.Equal(map[string]bool{"test": true, "lint": true}, state.Stuck)
+	assert.Equal([]string{"https://github.com/" + pu.Repo + "/pull/" + strconv.Itoa(pu.Number)}, links("https://github.com/", state))
+
+	processCommitUpdate(events.CommitUpdate{
+		Repo:      pu.Repo,
+		Status:    events.Success,
+		Context:   "lint",
+		SHA:       pu.SHA,
+		Timestamp: now,
+	}, live, &m, checkers, false)
+
+	sweepStuck(live, now.Add(time.Hour), checkers.Stuck, "", &m)
+	assert.Equal(float64(2), m.database[Key{"stuck", "", pu.Repo}]) // test and docs
+	assert.Empty(collectKeys(m.database, "abandoned"))
+
+	// Closing the PR forgets its head, along with the builds stuck on it
+	pu.Action = events.Closed
+	pu.Timestamp = now.Add(time.Hour)
+	processPullUpdate(pu, live, &m)
+
+	sweepStuck(live, now.Add(time.Hour), checkers.Stuck, "", &m)
+	assert.Empty(collectKeys(m.database, "stuck"))
+	assert.ElementsMatch([]Key{{"abandoned", "test", pu.Repo}, {"abandoned", "docs", pu.Repo}}, collectKeys(m.database, "abandoned"))
+}
+
+// Marking a draft PR as ready for review keeps the builds already running on
+// its head, so that they are still abandoned once the PR is closed.
+func TestReadyForReviewKeepsBuilds(t *testing.T) {
+	m := fakeMetrics{
+		database: make(map[Key]float64),
+	}
+
+	checkers := matchAll
+	checkers.Stuck = func(repo, context string) time.Duration {
+		return time.Hour
+	}
+
+	now := time.Now()
+	live := newLiveState()
+	live.forgotten = func(state *shaState) {
+		abandonStuck(state, &m)
+	}
+
+	pu := test.MakePullUpdate()
+	pu.Timestamp = now.Add(-3 * time.Hour)
+	processPullUpdate(pu, live, &m)
+
+	processCommitUpdate(events.CommitUpdate{
+		Repo:      pu.Repo,
+		Status:    events.Pending,
+		Context:   "test",
+		SHA:       pu.SHA,
+		Timestamp: now.Add(-2 * time.Hour),
+	}, live, &m, checkers, false)
+
+	sweepStuck(live, now, checkers.Stuck, "", &m)
+
+	pu.Action = events.ReadyForReview
+	pu.Timestamp = now.Add(-time.Hour)
+	processPullUpdate(pu, live, &m)
+
+	assert := assert.New(t)
+	state := live.SHAs[shaKey{pu.Repo, pu.SHA}]
+	assert.Contains(state.Pending, "test")
+	assert.Equal(map[string]bool{"test": true}, state.Stuck)
+	assert.Equal(now.Add(-time.Hour), state.LastSeen)
+
+	pu.Action = events.Closed
+	pu.Timestamp = now
+	processPullUpdate(pu, live, &m)
+
+	assert.Equal([]Key{{"abandoned", "test", pu.Repo}}, collectKeys(m.database, "abandoned"))
+}
+
+func TestExemplars(t *testing.T) {
+	m := fakeMetrics{
+		database:  make(map[Key]float64),
+		exemplars: make(map[Key]metrics.Exemplar),
+	}
+	pulley := Pulley{
+		Updates: make(chan interface{}),
+		Metrics: &m,
+		Tokens:  nil,
+	}
+
+	pulley.MetricsProcessor(matchAll, false)
+
+	pu := test.MakePullUpdate()
+	pulley.Updates <- pu
+
+	pulley.Updates <- events.CommitUpdate{
+		Repo:      pu.Repo,
+		Status:    events.Failure,
+		Context:   "build",
+		SHA:       pu.SHA,
+		Timestamp: pu.Timestamp.Add(time.Minute),
+	}
+
+	pu.Action = events.Closed
+	pu.Merged = true
+	pu.Timestamp = pu.Timestamp.Add(time.Hour)
+	pulley.Updates <- pu
+
+	close(pulley.Updates)
+	pulley.WG.Wait()
+
+	expected := metrics.Exemplar{PR: pu.Number, SHA: pu.SHA, Context: "build"}
+
+	assert := assert.New(t)
+	assert.Equal(expected, m.exemplars[Key{"start", "", pu.Repo}])
+	assert.Equal(expected, m.exemplars[Key{"ci_validation", events.Failure.String(), pu.Repo}])
+	assert.Equal(metrics.Exemplar{PR: pu.Number, SHA: pu.SHA}, m.exemplars[Key{"merge", "", pu.Repo}])
+}
+
+func TestLiveGauges(t *testing.T) {
+	m := fakeMetrics{
+		database: make(map[Key]float64),
+	}
+
+	now := time.Now()
+	live := newLiveState()
+
+	open := func(repo string, number int, sha string, opened time.Time) {
+		processPullUpdate(events.PullUpdate{
+			Repo:      repo,
+			Action:    events.Opened,
+			SHA:       sha,
+			Number:    number,
+			Timestamp: opened,
+		}, live, &m)
+	}
+
+	status := func(repo, sha, context string, status events.Status) {
+		processCommitUpdate(events.CommitUpdate{
+			Repo:      repo,
+			Status:    status,
+			Context:   context,
+			SHA:       sha,
+			Timestamp: now,
+		}, live, &m, matchAll, false)
+	}
+
+	open(test.DefaultRepository, 1, "waiting", now.Add(-2*time.Hour))
+	open(test.DefaultRepository, 2, "validated", now.Add(-3*time.Hour))
+	status(test.DefaultRepository, "validated", "build", events.Failure)
+	open("knl/other", 1, "building", now.Add(-30*time.Minute))
+	status("knl/other", "building", "build", events.Pending)
+
+	// Branches have no PRs, but their builds are in progress all the same
+	live.track(test.DefaultRepository, "branch", now)
+	status(test.DefaultRepository, "branch", "lint", events.Pending)
+
+	assert.Equal(t, map[string]*repoGauges{
+		test.DefaultRepository: {OpenPRs: 2, WaitingPRs: 1, OldestWaiting: 2 * time.Hour, Builds: map[string]int{"lint": 1}},
+		"knl/other":            {OpenPRs: 1, WaitingPRs: 1, OldestWaiting: 30 * time.Minute, Builds: map[string]int{"build": 1}},
+	}, live.gauges(now))
+}
+
+func TestCollector(t *testing.T) {
+	m := fakeMetrics{
+		database: make(map[Key]float64),
+	}
+	pulley := Pulley{
+		Updates: make(chan interface{}),
+		Metrics: &m,
+		Tokens:  nil,
+	}
+
+	collector := pulley.Collector()
+
+	assert := assert.New(t)
+	assert.Equal(0, testutil.CollectAndCount(collector))
+
+	pulley.MetricsProcessor(matchAll, false)
+
+	pulley.Updates <- test.MakePullUpdate()
+	assert.Equal(1, testutil.CollectAndCount(collector, "github_pull_requests_open"))
+	assert.Equal(1, testutil.CollectAndCount(collector, "github_pull_requests_waiting"))
+
+	close(pulley.Updates)
+	pulley.WG.Wait()
+
+	// Scraping does not block once the processor exits
+	assert.Equal(0, testutil.CollectAndCount(collector))
+}
+
+// foldingMetrics reports only the default repository, and drops the numbers
+// from the builds.
+type foldingMetrics struct {
+	fakeMetrics
+}
+
+func (m *foldingMetrics) RepositoryLabels(repositories []string) map[string]string {
+	return labelsOf(repositories, func(repository string) string {
+		if repository != test.DefaultRepository {
+			return "other"
+		}
+
+		return repository
+	})
+}
+
+func (m *foldingMetrics) BuildLabels(builds []string) map[string]string {
+	return labelsOf(builds, func(build string) string {
+		return strings.TrimRight(build, "0123456789")
+	})
+}
+
+func TestFoldGauges(t *testing.T) {
+	repos := map[string]*repoGauges{
+		test.DefaultRepository: {OpenPRs: 1, WaitingPRs: 1, OldestWaiting: time.Hour, Builds: map[string]int{"build1": 1, "build2": 2}},
+		"knl/one":              {OpenPRs: 2, WaitingPRs: 1, OldestWaiting: time.Minute, Builds: map[string]int{"lint": 1}},
+		"knl/two":              {OpenPRs: 3, WaitingPRs: 2, OldestWaiting: 2 * time.Hour, Builds: map[string]int{"lint": 1}},
+	}
+
+	assert.Equal(t, map[string]*repoGauges{
+		test.DefaultRepository: {OpenPRs: 1, WaitingPRs: 1, OldestWaiting: time.Hour, Builds: map[string]int{"build": 3}},
+		"other":                {OpenPRs: 5, WaitingPRs: 3, OldestWaiting: 2 * time.Hour, Builds: map[string]int{"lint": 2}},
+	}, foldGauges(repos, &foldingMetrics{}))
+}
+
+// The live SHAs survive a restart of the processor.
+func TestSnapshotRestored(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	buildTimeSeconds := 60
+
+	m := fakeMetrics{
+		database: make(map[Key]float64),
+	}
+	pulley := Pulley{
+		Updates:      make(chan interface{}),
+		Metrics:      &m,
+		Tokens:       nil,
+		SnapshotPath: path,
+	}
+
+	pulley.MetricsProcessor(matchAll, false)
+
+	pu := test.MakePullUpdate()
+	pulley.Updates <- pu
+
+	close(pulley.Updates)
+	pulley.WG.Wait()
+
+	restarted := Pulley{
+		Updates:      make(chan interface{}),
+		Metrics:      &m,
+		Tokens:       nil,
+		SnapshotPath: path,
+	}
+
+	restarted.MetricsProcessor(matchAll, false)
+
+	restarted.Updates <- events.CommitUpdate{
+		Repo:      pu.Repo,
+		Status:    events.Success,
+		Context:   "some",
+		SHA:       pu.SHA,
+		Timestamp: pu.Timestamp.Add(time.Second * time.Duration(buildTimeSeconds)),
+	}
+
+	// So does the PR
+	restarted.Updates <- events.PullUpdate{
+		Repo:      pu.Repo,
+		Action:    events.Closed,
+		SHA:       pu.SHA,
+		Number:    pu.Number,
+		Merged:    true,
+		Timestamp: pu.Timestamp.Add(time.Hour),
+	}
+
+	close(restarted.Updates)
+	restarted.WG.Wait()
+
+	assert := assert.New(t)
+	duration := m.database[Key{"ci_validation", events.Success.String(), test.DefaultRepository}]
+
+	assert.InDelta(float64(buildTimeSeconds), duration, 0.01*float64(buildTimeSeconds))
+	assert.Equal(float64(60*60), m.database[Key{"merge", "", test.DefaultRepository}])
+}
+
+// A broken snapshot does not prevent the processor from starting.
+func TestSnapshotCorrupted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	assert := assert.New(t)
+	assert.NoError(os.WriteFile(path, []byte("{not json"), 0o600))
+
+	_, err := loadSnapshot(path)
+	assert.Error(err)
+
+	live, err := loadSnapshot(path + ".missing")
+	assert.NoError(err)
+	assert.Empty(live.SHAs)
+	assert.Empty(live.PRs)
+}
+
+// Stopping the processor handles all the updates that are already queued.
+func TestStopDrainsUpdates(t *testing.T) {
+	m := fakeMetrics{
+		database: make(map[Key]float64),
+	}
+	pulley := Pulley{
+		Updates: make(chan interface{}, 10),
+		Metrics: &m,
+		Tokens:  nil,
+	}
+
+	pulley.MetricsProcessor(matchAll, false)
+
+	for i := 0; i < 10; i++ {
+		pulley.Updates <- test.MakePullUpdate()
+	}
+
+	assert := assert.New(t)
+	assert.NoError(pulley.Stop(context.Background()))
+	assert.Equal(float64(10), m.database[Key{"pr_event", events.Opened.String(), test.DefaultRepository}])
+}
@@ -1,14 +1,73 @@
 package service
 
 import (
+	"context"
 	"sync"
+	"time"
 
+	"github.com/knl/pulley/internal/config"
 	"github.com/knl/pulley/internal/metrics"
 )
 
 type Pulley struct {
 	Updates chan interface{}
 	Metrics metrics.Publisher
-	Token   []byte
+	Tokens  [][]byte // Any of these validates a webhook, none skips the validation
 	WG      sync.WaitGroup
+	SHATTL  time.Duration // Live SHAs without updates for longer than this are evicted, 0 disables it
+	MaxSHAs int           // The maximal number of live SHAs, 0 means unlimited
+	// Where to persist the live SHAs across restarts, empty disables it
+	SnapshotPath     string
+	SnapshotInterval time.Duration
+	// What to do with webhooks when Updates is full
+	QueuePolicy    config.OverflowPolicy
+	QueueTimeout   time.Duration // How long to wait for room with the block policy, 0 waits forever
+	QueueSpillPath string        // Where to spill the updates with the spill policy
+	// How long, and how many, webhook deliveries to remember to detect redeliveries
+	DedupWindow time.Duration
+	DedupSize   int
+	// Where to archive validated webhooks, empty disables it
+	ArchivePath    string
+	ArchiveMaxSize int // Archive files are rotated when they would grow larger, 0 rotates them only daily
+	// Looks up the status checks required by the branch protection, on reload
+	Protection config.RequiredContexts
+	// How often to look for builds pending for too long, 0 disables it
+	StuckInterval time.Duration
+	StuckLinks    string // The GitHub web UI to link stuck builds to in the logs, empty does not log them
+
+	stop     chan struct{}                    // Closed when the MetricsProcessor should stop
+	checkers chan config.Checkers             // Passes reloaded Checkers to the MetricsProcessor
+	gauges   chan chan map[string]*repoGauges // Asks the MetricsProcessor for the figures of the live state
+	done     chan struct{}                    // Closed once the MetricsProcessor exits
+	stopOnce sync.Once
+	spool    *spool
+}
+
+// Stop tells the MetricsProcessor to process the updates already queued and
+// exit, and waits for it to do so, or for ctx to expire. Updates are never
+// closed, as webhooks might still be in flight, thus stop accepting webhooks
+// before calling Stop, to not lose any of them.
+func (p *Pulley) Stop(ctx context.Context) error {
+	if p.stop == nil {
+		// The MetricsProcessor has never been started
+		return nil
+	}
+
+	p.stopOnce.Do(func() {
+		close(p.stop)
+	})
+
+	done := make(chan struct{})
+
+	go func() {
+		p.WG.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
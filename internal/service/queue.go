@@ -0,0 +1,111 @@
+package service
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/knl/pulley/internal/config"
+)
+
+var (
+	errStopping  = errors.New("the processor is stopping")
+	errQueueFull = errors.New("the queue of updates is full")
+)
+
+// Reasons for dropping an update.
+const (
+	droppedTimeout     = "timeout"
+	droppedNewest      = "newest"
+	droppedOldest      = "oldest"
+	droppedSpillFailed = "spill_failed"
+)
+
+// enqueue passes the update to the MetricsProcessor, following the configured
+// policy when there is no room for it. An error means the update was dropped.
+func (p *Pulley) enqueue(update interface{}) error {
+	switch p.QueuePolicy {
+	case config.DropNewestPolicy:
+		select {
+		case p.Updates <- update:
+			return nil
+		case <-p.stop:
+			return errStopping
+		default:
+			p.Metrics.RegisterDroppedUpdate(droppedNewest)
+			return errQueueFull
+		}
+
+	case config.DropOldestPolicy:
+		for {
+			select {
+			case p.Updates <- update:
+				return nil
+			case <-p.stop:
+				return errStopping
+			default:
+			}
+
+			// Make room, unless the MetricsProcessor took the oldest update in the meantime
+			select {
+			case <-p.Updates:
+				p.Metrics.RegisterDroppedUpdate(droppedOldest)
+			default:
+			}
+		}
+
+	case config.SpillPolicy:
+		// Once anything gets spilled, everything else follows, to keep the order
+		if p.spool.empty() {
+			select {
+			case p.Updates <- update:
+				return nil
+			case <-p.stop:
+				return errStopping
+			default:
+			}
+		}
+
+		if err := p.spool.write(update); err != nil {
+			log.Printf("Could not spill an update to %s: %v", p.spool.path, err)
+			p.Metrics.RegisterDroppedUpdate(droppedSpillFailed)
+
+			return errQueueFull
+		}
+
+		p.Metrics.RegisterSpilledUpdate()
+
+		return nil
+
+	default:
+		// A nil channel never fires, thus without a timeout this blocks until there is room
+		var timeout <-chan time.Time
+
+		if p.QueueTimeout > 0 {
+			timer := time.NewTimer(p.QueueTimeout)
+			defer timer.Stop()
+
+			timeout = timer.C
+		}
+
+		select {
+		case p.Updates <- update:
+			return nil
+		case <-p.stop:
+			return errStopping
+		case <-timeout:
+			p.Metrics.RegisterDroppedUpdate(droppedTimeout)
+			return errQueueFull
+		}
+	}
+}
+
+// QueueDepth returns the number of updates waiting to be processed, both in
+// memory and spilled to disk.
+func (p *Pulley) QueueDepth() (queued, spilled int) {
+	if p.spool != nil {
+		spilled = p.spool.size()
+	}
+
+	return len(p.Updates), spilled
+}
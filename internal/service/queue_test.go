@@ -0,0 +1,233 @@
+package service
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/knl/pulley/internal/config"
+	"github.com/knl/pulley/internal/events"
+	"github.com/knl/pulley/internal/test"
+)
+
+func TestQueueBlockTimesOut(t *testing.T) {
+	m := fakeMetrics{
+		database: make(map[Key]float64),
+	}
+	pulley := Pulley{
+		Updates:      make(chan interface{}, 1),
+		Metrics:      &m,
+		QueuePolicy:  config.BlockPolicy,
+		QueueTimeout: 10 * time.Millisecond,
+	}
+
+	assert := assert.New(t)
+	assert.NoError(pulley.enqueue(test.MakePullUpdate()))
+	assert.Equal(errQueueFull, pulley.enqueue(test.MakePullUpdate()))
+	assert.Equal(float64(1), m.database[Key{"dropped", droppedTimeout, ""}])
+}
+
+// Without a timeout, the default policy waits for room in the queue for as long
+// as it takes.
+func TestQueueBlockWaits(t *testing.T) {
+	pulley := Pulley{
+		Updates: make(chan interface{}, 1),
+	}
+
+	first, second := test.MakePullUpdate(), test.MakePullUpdate()
+
+	assert := assert.New(t)
+	assert.NoError(pulley.enqueue(first))
+
+	done := make(chan error)
+
+	go func() {
+		done <- pulley.enqueue(second)
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("enqueue returned %v before there was room", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	assert.Equal(first, <-pulley.Updates)
+	assert.NoError(<-done)
+	assert.Equal(second, <-pulley.Updates)
+}
+
+func TestQueueDropNewest(t *testing.T) {
+	m := fakeMetrics{
+		database: make(map[Key]float64),
+	}
+	pulley := Pulley{
+		Updates:     make(chan interface{}, 1),
+		Metrics:     &m,
+		QueuePolicy: config.DropNewestPolicy,
+	}
+
+	first := test.MakePullUpdate()
+
+	assert := assert.New(t)
+	assert.NoError(pulley.enqueue(first))
+	assert.Equal(errQueueFull, pulley.enqueue(test.MakePullUpdate()))
+	assert.Equal(float64(1), m.database[Key{"dropped", droppedNewest, ""}])
+	assert.Equal(first, <-pulley.Updates)
+}
+
+func TestQueueDropOldest(t *testing.T) {
+	m := fakeMetrics{
+		database: make(map[Key]float64),
+	}
+	pulley := Pulley{
+		Updates:     make(chan interface{}, 1),
+		Metrics:     &m,
+		QueuePolicy: config.DropOldestPolicy,
+	}
+
+	last := test.MakePullUpdate()
+
+	assert := assert.New(t)
+	assert.NoError(pulley.enqueue(test.MakePullUpdate()))
+	assert.NoError(pulley.enqueue(last))
+	assert.Equal(float64(1), m.database[Key{"dropped", droppedOldest, ""}])
+	assert.Equal(last, <-pulley.Updates)
+}
+
+// Once spilling starts, the updates are spilled in order until they are all
+// passed on to the processor.
+func TestQueueSpill(t *testing.T) {
+	m := fakeMetrics{
+		database: make(map[Key]float64),
+	}
+	path := filepath.Join(t.TempDir(), "spill.jsonl")
+	pulley := Pulley{
+		Updates:        make(chan interface{}, 1),
+		Metrics:        &m,
+		QueuePolicy:    config.SpillPolicy,
+		QueueSpillPath: path,
+		spool:          newSpool(path),
+	}
+
+	// Spilled updates come back in UTC, without a monotonic clock reading
+	now := time.Now().UTC().Round(0)
+
+	pu := test.MakePullUpdate()
+	pu.Timestamp = now
+
+	bu := test.MakeBranchUpdate()
+	bu.Timestamp = now
+
+	updates := []interface{}{
+		pu,
+		bu,
+		events.CommitUpdate{
+			Repo:      test.DefaultRepository,
+			Status:    events.Pending,
+			Context:   "some",
+			SHA:       test.RandSHA(),
+			Timestamp: now,
+		},
+	}
+
+	assert := assert.New(t)
+
+	for _, up := range updates {
+		assert.NoError(pulley.enqueue(up))
+	}
+
+	assert.Equal(float64(2), m.database[Key{"spilled", "", ""}])
+
+	queued, spilled := pulley.QueueDepth()
+	assert.Equal(1, queued)
+	assert.Equal(2, spilled)
+
+	// Room in the queue does not allow jumping over the spilled updates
+	assert.Equal(updates[0], <-pulley.Updates)
+	assert.NoError(pulley.enqueue(updates[0]))
+
+	_, spilled = pulley.QueueDepth()
+	assert.Equal(3, spilled)
+
+	replayed := make(chan interface{}, 3)
+	assert.NoError(pulley.spool.replay(replayed, nil))
+	assert.True(pulley.spool.empty())
+	assert.Equal(updates[1], <-replayed)
+	assert.Equal(updates[2], <-replayed)
+	assert.Equal(updates[0], <-replayed)
+}
+
+// Every kind of update can be spilled, and comes back the same.
+func TestSpillRoundTrip(t *testing.T) {
+	// Spilled updates come back in UTC, without a monotonic clock reading
+	now := time.Now().UTC().Round(0)
+
+	pu := test.MakePullUpdate()
+	pu.Timestamp = now
+
+	bu := test.MakeBranchUpdate()
+	bu.Timestamp = now
+
+	updates := []interface{}{
+		pu,
+		bu,
+		events.CommitUpdate{
+			Repo:      test.DefaultRepository,
+			Status:    events.TimedOut,
+			Context:   "some",
+			SHA:       test.RandSHA(),
+			Timestamp: now,
+		},
+		events.ReviewUpdate{
+			Repo:      test.DefaultRepository,
+			Number:    1,
+			SHA:       test.RandSHA(),
+			State:     events.Approved,
+			Opened:    now.Add(-time.Hour),
+			Timestamp: now,
+		},
+		events.JobUpdate{
+			Repo:      test.DefaultRepository,
+			Workflow:  "ci",
+			Job:       "test",
+			Labels:    []string{"ubuntu-latest"},
+			Status:    events.Success,
+			CreatedAt: now.Add(-time.Minute),
+			StartedAt: now,
+		},
+		events.WorkflowUpdate{
+			Repo:     test.DefaultRepository,
+			Workflow: "ci",
+			Status:   events.Pending,
+		},
+	}
+
+	assert := assert.New(t)
+
+	for _, up := range updates {
+		data, err := events.Encode(up)
+		assert.NoError(err)
+
+		decoded, err := events.Decode(data)
+		assert.NoError(err)
+		assert.Equal(up, decoded)
+	}
+}
+
+// Spilled updates that could not be passed on survive a restart.
+func TestSpoolKeptWhenStopping(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spill.jsonl")
+	s := newSpool(path)
+
+	assert := assert.New(t)
+	assert.NoError(s.write(test.MakePullUpdate()))
+	assert.NoError(s.write(test.MakePullUpdate()))
+
+	stop := make(chan struct{})
+	close(stop)
+
+	assert.NoError(s.replay(make(chan interface{}), stop))
+	assert.Equal(2, newSpool(path).size())
+}
@@ -0,0 +1,78 @@
+package service
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/knl/pulley/internal/config"
+)
+
+var (
+	errNotStarted = errors.New("the processor has not been started")
+	errStopped    = errors.New("the processor has stopped")
+)
+
+// Reload loads the configuration again, from the file at path and the
+// environment variables, and passes the new Checkers to the
+// MetricsProcessor, which keeps tracking the live SHAs. An invalid
+// configuration is rejected, keeping the current one. Only the rules deciding
+// which contexts are monitored are reloaded, the rest needs a restart.
+func (p *Pulley) Reload(path string) error {
+	if p.checkers == nil {
+		return errNotStarted
+	}
+
+	newConfig, err := config.Load(path)
+	if err != nil {
+		p.Metrics.RegisterReloadFailure()
+		return err
+	}
+
+	printout, err := newConfig.Print()
+	if err != nil {
+		p.Metrics.RegisterReloadFailure()
+		return err
+	}
+
+	select {
+	case p.checkers <- newConfig.DefaultCheckers(p.Protection):
+	case <-p.stop:
+		return errStopping
+	case <-p.done:
+		return errStopped
+	}
+
+	log.Printf("[reload] %s", printout)
+
+	return nil
+}
+
+// ReloadHandler reloads the configuration on a POST request, authenticated
+// with the token as a bearer token. If the token is empty, every request is
+// refused.
+func (p *Pulley) ReloadHandler(token string, path string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(405) // Return 405 Method Not Allowed.
+			return
+		}
+
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.WriteHeader(401) // Return 401 Unauthorized.
+			return
+		}
+
+		if err := p.Reload(path); err != nil {
+			log.Printf("[reload] rejected the configuration, keeping the current one: %v", err)
+			w.WriteHeader(400) // Return 400 Bad Request.
+			fmt.Fprintln(w, err)
+
+			return
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/knl/pulley/internal/config"
+	"github.com/knl/pulley/internal/events"
+	"github.com/knl/pulley/internal/test"
+)
+
+func reloadRequest(handler http.Handler, method, token string) int {
+	req := httptest.NewRequest(method, "/admin/reload", nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	return rec.Code
+}
+
+func writeRules(t *testing.T, path, context string) {
+	rules := "repositories:\n  - repo: .*\n    context: " + context + "\n"
+	assert.NoError(t, os.WriteFile(path, []byte(rules), 0o600))
+}
+
+// Reloading swaps the monitored contexts, while the live SHAs are kept.
+func TestReloadKeepsState(t *testing.T) {
+	// Needed to ensure the test is correct
+	os.Clearenv()
+
+	path := filepath.Join(t.TempDir(), "pulley.yaml")
+	writeRules(t, path, "^first$")
+
+	m := fakeMetrics{
+		database: make(map[Key]float64),
+	}
+	pulley := Pulley{
+		Updates: make(chan interface{}),
+		Metrics: &m,
+	}
+
+	assert := assert.New(t)
+	assert.Equal(errNotStarted, pulley.Reload(path))
+
+	pulley.MetricsProcessor(config.Checkers{
+		Aggregate: func(repo, context string) bool { return context == "first" },
+	}, false)
+
+	handler := pulley.ReloadHandler("secret", path)
+
+	sha := test.RandSHA()
+	start := time.Now()
+
+	pulley.Updates <- events.PullUpdate{
+		Number:    1,
+		SHA:       sha,
+		Action:    events.Opened,
+		Timestamp: start,
+		Repo:      test.DefaultRepository,
+	}
+
+	writeRules(t, path, "^second$")
+	assert.Equal(http.StatusOK, reloadRequest(handler, http.MethodPost, "secret"))
+
+	// An invalid configuration is rejected, keeping the previous one
+	writeRules(t, path, "'*'")
+	assert.Equal(http.StatusBadRequest, reloadRequest(handler, http.MethodPost, "secret"))
+
+	for i, context := range []string{"first", "second"} {
+		pulley.Updates <- events.CommitUpdate{
+			Status:    events.Success,
+			Context:   context,
+			SHA:       sha,
+			Timestamp: start.Add(time.Duration(i+1) * time.Minute),
+			Repo:      test.DefaultRepository,
+		}
+	}
+
+	close(pulley.Updates)
+	pulley.WG.Wait()
+
+	assert.Equal(float64(2*60), m.database[Key{"ci_validation", "success", test.DefaultRepository}])
+	assert.Equal(float64(1), m.database[Key{"reload_failure", "", ""}])
+}
+
+// Reloading does not wait for a processor that is gone.
+func TestReloadStopped(t *testing.T) {
+	// Needed to ensure the test is correct
+	os.Clearenv()
+
+	path := filepath.Join(t.TempDir(), "pulley.yaml")
+	writeRules(t, path, "^first$")
+
+	pulley := Pulley{
+		Updates: make(chan interface{}),
+		Metrics: &fakeMetrics{database: make(map[Key]float64)},
+	}
+
+	pulley.MetricsProcessor(matchAll, false)
+
+	close(pulley.Updates)
+	pulley.WG.Wait()
+
+	assert.Equal(t, errStopped, pulley.Reload(path))
+}
+
+func TestReloadAuthenticated(t *testing.T) {
+	pulley := Pulley{
+		Updates: make(chan interface{}),
+	}
+
+	assert := assert.New(t)
+	assert.Equal(http.StatusMethodNotAllowed, reloadRequest(pulley.ReloadHandler("secret", ""), http.MethodGet, "secret"))
+	assert.Equal(http.StatusUnauthorized, reloadRequest(pulley.ReloadHandler("secret", ""), http.MethodPost, ""))
+	assert.Equal(http.StatusUnauthorized, reloadRequest(pulley.ReloadHandler("secret", ""), http.MethodPost, "guess"))
+	assert.Equal(http.StatusUnauthorized, reloadRequest(pulley.ReloadHandler("", ""), http.MethodPost, ""))
+}
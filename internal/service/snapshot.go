@@ -0,0 +1,140 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/knl/pulley/internal/events"
+)
+
+// Bump whenever the format of the snapshot changes in an incompatible way.
+const snapshotVersion = 2
+
+// snapshot is the on-disk representation of the MetricsProcessor's state. The
+// states carry their own keys, as JSON objects can only be keyed by strings.
+type snapshot struct {
+	Version  int         `json:"version"`
+	Taken    time.Time   `json:"taken"`
+	LiveSHAs []*shaState `json:"live_shas"`
+	PRs      []*prState  `json:"prs"`
+}
+
+// saveSnapshot atomically replaces the snapshot at path, so that a crash while
+// writing never leaves a truncated snapshot behind.
+func saveSnapshot(path string, live *liveState) error {
+	s := snapshot{
+		Version:  snapshotVersion,
+		Taken:    time.Now(),
+		LiveSHAs: make([]*shaState, 0, len(live.SHAs)),
+		PRs:      make([]*prState, 0, len(live.PRs)),
+	}
+
+	for _, state := range live.SHAs {
+		s.LiveSHAs = append(s.LiveSHAs, state)
+	}
+
+	for _, pr := range live.PRs {
+		s.PRs = append(s.PRs, pr)
+	}
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("could not encode the snapshot, %v", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("could not create a temporary snapshot file, %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not write the snapshot to %s, %v", tmp.Name(), err)
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not sync the snapshot to %s, %v", tmp.Name(), err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("could not close the snapshot %s, %v", tmp.Name(), err)
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// loadSnapshot reads the live SHAs and PRs from the snapshot at path. A missing
+// snapshot is not an error, as that is the case on the very first start.
+func loadSnapshot(path string) (*liveState, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return newLiveState(), nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("could not read the snapshot, %v", err)
+	}
+
+	var s snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("could not decode the snapshot, %v", err)
+	}
+
+	if s.Version != snapshotVersion {
+		return nil, fmt.Errorf("snapshot has version %d, while %d is expected", s.Version, snapshotVersion)
+	}
+
+	live := newLiveState()
+
+	for _, state := range s.LiveSHAs {
+		if state.BuildStarts == nil {
+			state.BuildStarts = make(map[string]time.Time)
+		}
+
+		if state.Finished == nil {
+			state.Finished = make(map[string]events.Status)
+		}
+
+		if state.Failed == nil {
+			state.Failed = make(map[string]bool)
+		}
+
+		if state.Pending == nil {
+			state.Pending = make(map[string]time.Time)
+		}
+
+		if state.Stuck == nil {
+			state.Stuck = make(map[string]bool)
+		}
+
+		live.SHAs[state.key()] = state
+	}
+
+	for _, pr := range s.PRs {
+		live.PRs[pr.key()] = pr
+	}
+
+	return live, nil
+}
+
+// snapshot saves the live SHAs and PRs, if persistence is enabled. Failing to
+// do so is not fatal, the next snapshot might succeed.
+func (p *Pulley) snapshot(live *liveState) {
+	if p.SnapshotPath == "" {
+		return
+	}
+
+	if err := saveSnapshot(p.SnapshotPath, live); err != nil {
+		log.Printf("Could not save the state to %s: %v", p.SnapshotPath, err)
+		return
+	}
+
+	log.Printf("Saved %d live SHAs and %d PRs to %s", len(live.SHAs), len(live.PRs), p.SnapshotPath)
+}
@@ -0,0 +1,191 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/knl/pulley/internal/events"
+)
+
+// How often to check whether there are spilled updates to pass on.
+const spoolInterval = time.Second
+
+// spool keeps the updates that did not fit into the queue in a file, one
+// encoded update per line, until there is room for them again. Updates are
+// appended to path, while the ones being passed on are moved to path.replaying.
+// Whatever is left in these files when stopping is passed on after a restart.
+type spool struct {
+	path    string
+	mu      sync.Mutex
+	pending int // Spilled updates that have not been passed on yet
+}
+
+func newSpool(path string) *spool {
+	s := &spool{path: path}
+
+	for _, p := range []string{s.replayingPath(), s.path} {
+		lines, err := readLines(p)
+		if err != nil {
+			log.Printf("Could not read the spilled updates from %s: %v", p, err)
+		}
+
+		s.pending += len(lines)
+	}
+
+	return s
+}
+
+func (s *spool) replayingPath() string {
+	return s.path + ".replaying"
+}
+
+func (s *spool) empty() bool {
+	return s.size() == 0
+}
+
+func (s *spool) size() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.pending
+}
+
+func (s *spool) write(update interface{}) error {
+	line, err := events.Encode(update)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	s.pending++
+
+	return nil
+}
+
+// take returns the spilled updates to pass on, leftovers from an interrupted
+// replay first.
+func (s *spool) take() ([][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := os.Stat(s.replayingPath()); errors.Is(err, os.ErrNotExist) {
+		if err := os.Rename(s.path, s.replayingPath()); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil, nil
+			}
+
+			return nil, err
+		}
+	}
+
+	return readLines(s.replayingPath())
+}
+
+// replay passes the spilled updates on to updates, until they are all passed
+// on, or stop is closed. In the latter case, the rest is kept for later.
+func (s *spool) replay(updates chan<- interface{}, stop <-chan struct{}) error {
+	lines, err := s.take()
+	if err != nil || len(lines) == 0 {
+		return err
+	}
+
+	for i, line := range lines {
+		update, err := events.Decode(line)
+		if err != nil {
+			log.Printf("Could not decode a spilled update, skipping: %v", err)
+		} else {
+			select {
+			case updates <- update:
+			case <-stop:
+				return s.keep(lines[i:])
+			}
+		}
+
+		s.mu.Lock()
+		s.pending--
+		s.mu.Unlock()
+	}
+
+	return os.Remove(s.replayingPath())
+}
+
+// keep stores the lines that have not been passed on yet, to replay them later.
+func (s *spool) keep(lines [][]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return os.WriteFile(s.replayingPath(), append(bytes.Join(lines, []byte{'\n'}), '\n'), 0o600)
+}
+
+func readLines(path string) ([][]byte, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines [][]byte
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		lines = append(lines, append([]byte(nil), scanner.Bytes()...))
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read %s, %v", path, err)
+	}
+
+	return lines, nil
+}
+
+// unspool periodically passes the spilled updates on to the MetricsProcessor.
+func (p *Pulley) unspool(updates chan<- interface{}) {
+	defer p.WG.Done()
+
+	ticker := time.NewTicker(spoolInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := p.spool.replay(updates, p.stop); err != nil {
+			log.Printf("Could not replay the spilled updates from %s: %v", p.spool.path, err)
+		}
+
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package service
+
+import (
+	"time"
+
+	"github.com/knl/pulley/internal/events"
+	"github.com/knl/pulley/internal/metrics"
+)
+
+// shaKey identifies a commit. The same SHA can show up in several
+// repositories, for example, in a fork and upstream.
+type shaKey struct {
+	Repo string
+	SHA  string
+}
+
+// prKey identifies a PR.
+type prKey struct {
+	Repo   string
+	Number int
+}
+
+type shaState struct {
+	Repo        string                   `json:"repo"`
+	SHA         string                   `json:"sha"`
+	PRs         []int                    `json:"prs"` // The PRs having this SHA as their head, none for a branch
+	Time        time.Time                `json:"time"`
+	LastSeen    time.Time                `json:"last_seen"`    // Time of the last update for this SHA, used for eviction
+	CheckSeen   bool                     `json:"check_seen"`   // Set to true if a status check has been received
+	CIStart     time.Time                `json:"ci_start"`     // Time when we received the first CI notification (CheckSeen == true)
+	BuildStarts map[string]time.Time     `json:"build_starts"` // when a build started
+	Finished    map[string]events.Status `json:"finished"`     // the terminal status of each build, for the required strategy
+	FailureSeen bool                     `json:"failure_seen"` // Set to true if a build failed, to time only the first failure
+	Validated   bool                     `json:"validated"`    // Set to true once the validation time is registered
+	Failed      map[string]bool          `json:"failed"`       // the builds that failed, and did not pass since, to detect flaky ones
+	Pending     map[string]time.Time     `json:"pending"`      // since when the builds not finished yet are pending
+	Stuck       map[string]bool          `json:"stuck"`        // the pending builds that are stuck
+}
+
+type prState struct {
+	Repo   string    `json:"repo"`
+	Number int       `json:"number"`
+	Opened time.Time `json:"opened"` // When the PR was opened, pushes to it do not change it
+	Base   string    `json:"base"`   // The branch the PR is to be merged into, empty if not known
+	Heads  []string  `json:"heads"`  // The SHAs the PR had as its head, the last one is the current head
+	// When the PR got its first review, request for changes, and approval,
+	// zero until then.
+	Reviewed         time.Time `json:"reviewed"`
+	ChangesRequested time.Time `json:"changes_requested"`
+	Approved         time.Time `json:"approved"`
+}
+
+// liveState is what the MetricsProcessor tracks, the live SHAs, and the open
+// PRs whose heads they are.
+type liveState struct {
+	SHAs map[shaKey]*shaState
+	PRs  map[prKey]*prState
+
+	forgotten func(state *shaState) // Called when a SHA stops being tracked, if set
+}
+
+func newLiveState() *liveState {
+	return &liveState{
+		SHAs: make(map[shaKey]*shaState),
+		PRs:  make(map[prKey]*prState),
+	}
+}
+
+func newShaState(repo, sha string, timestamp time.Time) *shaState {
+	return &shaState{
+		Repo:        repo,
+		SHA:         sha,
+		Time:        timestamp,
+		LastSeen:    timestamp,
+		CheckSeen:   false,
+		CIStart:     timestamp, // not necessarily correct
+		BuildStarts: make(map[string]time.Time),
+		Finished:    make(map[string]events.Status),
+		Failed:      make(map[string]bool),
+		Pending:     make(map[string]time.Time),
+		Stuck:       make(map[string]bool),
+	}
+}
+
+func (s *shaState) key() shaKey {
+	return shaKey{s.Repo, s.SHA}
+}
+
+func (s *shaState) seen(timestamp time.Time) {
+	if timestamp.After(s.LastSeen) {
+		s.LastSeen = timestamp
+	}
+}
+
+// exemplar points the observations about the build of the SHA to it, and to
+// the first PR it is the head of.
+func (s *shaState) exemplar(context string) metrics.Exemplar {
+	var pr int
+	if len(s.PRs) != 0 {
+		pr = s.PRs[0]
+	}
+
+	return metrics.Exemplar{PR: pr, SHA: s.SHA, Context: context}
+}
+
+func newPRState(repo string, number int, base string, opened time.Time) *prState {
+	return &prState{
+		Repo:   repo,
+		Number: number,
+		Opened: opened,
+		Base:   base,
+	}
+}
+
+func (pr *prState) key() prKey {
+	return prKey{pr.Repo, pr.Number}
+}
+
+// head returns the current head of the PR, if known.
+func (pr *prState) head() (string, bool) {
+	if len(pr.Heads) == 0 {
+		return "", false
+	}
+
+	return pr.Heads[len(pr.Heads)-1], true
+}
+
+// track starts tracking the SHA from timestamp. A SHA that is tracked already
+// keeps its builds, which are still running or might be stuck.
+func (l *liveState) track(repo, sha string, timestamp time.Time) *shaState {
+	if state, ok := l.SHAs[shaKey{repo, sha}]; ok {
+		state.seen(timestamp)
+		return state
+	}
+
+	state := newShaState(repo, sha, timestamp)
+	l.SHAs[state.key()] = state
+
+	return state
+}
+
+// setHead moves the PR to a new head, which is tracked from timestamp, unless
+// it is tracked already. The previous head is forgotten, unless it is still the
+// head of another PR.
+func (l *liveState) setHead(pr *prState, sha string, timestamp time.Time) *shaState {
+	if old, ok := pr.head(); ok && old != sha {
+		l.detach(pr, old)
+	}
+
+	key := shaKey{pr.Repo, sha}
+
+	state, ok := l.SHAs[key]
+	if !ok {
+		state = newShaState(pr.Repo, sha, timestamp)
+		l.SHAs[key] = state
+	} else {
+		state.seen(timestamp)
+	}
+
+	if !containsPR(state.PRs, pr.Number) {
+		state.PRs = append(state.PRs, pr.Number)
+	}
+
+	if old, ok := pr.head(); !ok || old != sha {
+		pr.Heads = append(pr.Heads, sha)
+	}
+
+	return state
+}
+
+// detach removes the PR from the SHA, and forgets the SHA if no PR is left.
+func (l *liveState) detach(pr *prState, sha string) {
+	key := shaKey{pr.Repo, sha}
+
+	state, ok := l.SHAs[key]
+	if !ok {
+		return
+	}
+
+	prs := state.PRs[:0]
+
+	for _, number := range state.PRs {
+		if number != pr.Number {
+			prs = append(prs, number)
+		}
+	}
+
+	state.PRs = prs
+
+	if len(state.PRs) == 0 {
+		l.forget(key)
+	}
+}
+
+// close forgets the PR, and its head.
+func (l *liveState) close(pr *prState) {
+	if head, ok := pr.head(); ok {
+		l.detach(pr, head)
+	}
+
+	delete(l.PRs, pr.key())
+}
+
+// evict forgets the SHA, and the PRs it is the head of.
+func (l *liveState) evict(key shaKey) {
+	state, ok := l.SHAs[key]
+	if !ok {
+		return
+	}
+
+	for _, number := range state.PRs {
+		delete(l.PRs, prKey{state.Repo, number})
+	}
+
+	l.forget(key)
+}
+
+// forget stops tracking the SHA.
+func (l *liveState) forget(key shaKey) {
+	state, ok := l.SHAs[key]
+	if !ok {
+		return
+	}
+
+	delete(l.SHAs, key)
+
+	if l.forgotten != nil {
+		l.forgotten(state)
+	}
+}
+
+// bases returns the branches the PRs having the SHA as their head are to be
+// merged into. A SHA that is not the head of any PR has an unknown base.
+func (l *liveState) bases(state *shaState) []string {
+	if len(state.PRs) == 0 {
+		return []string{""}
+	}
+
+	bases := make([]string, 0, len(state.PRs))
+
+	for _, number := range state.PRs {
+		var base string
+		if pr, ok := l.PRs[prKey{state.Repo, number}]; ok {
+			base = pr.Base
+		}
+
+		if !containsString(bases, base) {
+			bases = append(bases, base)
+		}
+	}
+
+	return bases
+}
+
+// repoGauges are the figures of a repository at a moment, as opposed to the
+// ones accumulated over time by the metrics.
+type repoGauges struct {
+	OpenPRs       int
+	WaitingPRs    int            // The open PRs whose head is not validated yet
+	OldestWaiting time.Duration  // Since when the longest waiting PR waits for its head to get validated
+	Builds        map[string]int // The number of builds in progress, per build
+}
+
+// gauges returns the figures of each repository with open PRs, or builds in
+// progress.
+func (l *liveState) gauges(now time.Time) map[string]*repoGauges {
+	repos := make(map[string]*repoGauges)
+
+	repo := func(name string) *repoGauges {
+		gauges, ok := repos[name]
+		if !ok {
+			gauges = &repoGauges{Builds: make(map[string]int)}
+			repos[name] = gauges
+		}
+
+		return gauges
+	}
+
+	for _, pr := range l.PRs {
+		gauges := repo(pr.Repo)
+		gauges.OpenPRs++
+
+		head, ok := pr.head()
+		if !ok {
+			continue
+		}
+
+		state, ok := l.SHAs[shaKey{pr.Repo, head}]
+		if !ok || state.Validated {
+			continue
+		}
+
+		gauges.WaitingPRs++
+
+		if waiting := now.Sub(state.Time); waiting > gauges.OldestWaiting {
+			gauges.OldestWaiting = waiting
+		}
+	}
+
+	for _, state := range l.SHAs {
+		for context := range state.Pending {
+			repo(state.Repo).Builds[context]++
+		}
+	}
+
+	return repos
+}
+
+func containsPR(prs []int, number int) bool {
+	for _, n := range prs {
+		if n == number {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,70 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/knl/pulley/internal/config"
+	"github.com/knl/pulley/internal/metrics"
+)
+
+// sweepStuck marks the builds pending for longer than their threshold as
+// stuck, and reports how many builds are stuck in each repository. If webURL is
+// set, the builds are logged once they get stuck, with links to their PRs.
+func sweepStuck(live *liveState, now time.Time, threshold config.StuckThreshold, webURL string, publisher metrics.Publisher) {
+	counts := make(map[string]int)
+
+	for _, state := range live.SHAs {
+		for context, since := range state.Pending {
+			var after time.Duration
+			if threshold != nil {
+				after = threshold(state.Repo, context)
+			}
+
+			// The threshold might have been raised by a reload
+			if after <= 0 || now.Sub(since) <= after {
+				delete(state.Stuck, context)
+				continue
+			}
+
+			counts[state.Repo]++
+
+			if state.Stuck[context] {
+				continue
+			}
+
+			state.Stuck[context] = true
+
+			if webURL != "" {
+				log.Printf("Build %s of %s in %s has been pending since %s, it is stuck: %s", context, state.SHA, state.Repo, since, strings.Join(links(webURL, state), " "))
+			}
+		}
+	}
+
+	publisher.RegisterStuckBuilds(counts)
+}
+
+// abandonStuck counts the builds of the SHA that got stuck, and will never be
+// seen finishing, as the SHA is not tracked anymore.
+func abandonStuck(state *shaState, publisher metrics.Publisher) {
+	for context := range state.Stuck {
+		publisher.RegisterAbandonedBuild(state.Repo, context)
+	}
+}
+
+// links returns the web pages of the PRs the SHA is the head of, or of the
+// commit itself for a branch.
+func links(webURL string, state *shaState) []string {
+	if len(state.PRs) == 0 {
+		return []string{fmt.Sprintf("%s%s/commit/%s", webURL, state.Repo, state.SHA)}
+	}
+
+	links := make([]string, 0, len(state.PRs))
+	for _, number := range state.PRs {
+		links = append(links, fmt.Sprintf("%s%s/pull/%d", webURL, state.Repo, number))
+	}
+
+	return links
+}
@@ -1,15 +1,22 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"log"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"github.com/knl/pulley/internal/config"
 	"github.com/knl/pulley/internal/metrics"
+	"github.com/knl/pulley/internal/protection"
 	"github.com/knl/pulley/internal/service"
 	"github.com/knl/pulley/internal/version"
 )
@@ -51,8 +58,24 @@ func newWebhookHandler(pulley *service.Pulley) http.Handler {
 		[]string{},
 	)
 
+	queueDepth := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "webhook_queue_depth",
+		Help: "The number of webhooks accepted and waiting to be processed.",
+	}, func() float64 {
+		queued, _ := pulley.QueueDepth()
+		return float64(queued)
+	})
+
+	spilledDepth := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "webhook_spilled_queue_depth",
+		Help: "The number of webhooks spilled to disk and waiting to be processed.",
+	}, func() float64 {
+		_, spilled := pulley.QueueDepth()
+		return float64(spilled)
+	})
+
 	// Register all of the metrics in the standard registry.
-	prometheus.MustRegister(inFlightGauge, counter, duration, requestSize)
+	prometheus.MustRegister(inFlightGauge, counter, duration, requestSize, queueDepth, spilledDepth)
 
 	// Instrument the handlers with all the metrics, injecting the "handler"
 	// label by currying.
@@ -65,31 +88,149 @@ func newWebhookHandler(pulley *service.Pulley) http.Handler {
 	)
 }
 
+// histograms lays out the buckets of the histograms as configured.
+func histograms(conf *config.Config) metrics.Histograms {
+	histograms := metrics.Histograms{
+		Buckets:   conf.Buckets,
+		NoClassic: !conf.HistogramType.Classic(),
+	}
+
+	if conf.HistogramType.Native() {
+		histograms.NativeFactor = conf.NativeBucketFactor
+		histograms.NativeMaxBuckets = uint32(conf.NativeMaxBuckets)
+	}
+
+	return histograms
+}
+
+// limits bounds the repository and build labels as configured.
+func limits(conf *config.Config) metrics.Limits {
+	return metrics.Limits{
+		MaxRepositories: conf.MaxRepositories,
+		MaxBuilds:       conf.MaxBuilds,
+		BuildRewrites:   conf.BuildRewrites,
+	}
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		if err := replay(os.Args[2:]); err != nil {
+			log.Fatal("Replay failed: ", err)
+		}
+
+		return
+	}
+
+	configPath := flag.String("config", os.Getenv("PULLEY_CONFIG"), "the YAML configuration file, overridden by the environment variables")
+	flag.Parse()
+
 	log.Println("server started")
 	log.Println(version.Print())
 
-	config, err := config.Setup()
+	config, err := config.Load(*configPath)
 	if err != nil {
 		log.Fatal("Configuration step failed", err)
 	}
 
 	log.Println(config.Print())
 
+	githubMetrics, err := metrics.NewGithubMetrics(histograms(config), limits(config))
+	if err != nil {
+		log.Fatal("Configuration step failed", err)
+	}
+
+	githubMetrics.WebURL = config.GithubWebURL()
+
 	pulley := service.Pulley{
-		Updates: make(chan interface{}, 100),
-		Metrics: metrics.NewGithubMetrics(),
-		Token:   config.WebhookToken,
+		Updates: make(chan interface{}, config.QueueSize),
+		Metrics: githubMetrics,
+		Tokens:  config.WebhookTokens,
+		SHATTL:  config.SHATTL,
+		MaxSHAs: config.MaxSHAs,
+
+		SnapshotPath:     config.SnapshotPath,
+		SnapshotInterval: config.SnapshotInterval,
+
+		QueuePolicy:    config.QueuePolicy,
+		QueueTimeout:   config.QueueTimeout,
+		QueueSpillPath: config.QueueSpillPath,
+
+		DedupWindow: config.DedupWindow,
+		DedupSize:   config.DedupSize,
+
+		ArchivePath:    config.ArchivePath,
+		ArchiveMaxSize: config.ArchiveMaxSize,
+
+		StuckInterval: config.StuckInterval,
+	}
+
+	if config.StuckLog {
+		pulley.StuckLinks = config.GithubWebURL()
+	}
+
+	// The client only calls GitHub's API once a protection rule asks for it,
+	// and it is kept across reloads, to keep its cache. So, a new API token or
+	// URL only takes effect after a restart.
+	client, err := protection.New(config.GithubAPIToken, config.GithubAPIURL, config.ProtectionRefresh)
+	if err != nil {
+		log.Fatal("Could not create the GitHub API client", err)
 	}
 
-	pulley.MetricsProcessor(config.DefaultContextChecker(), config.TrackBuildTimes)
+	pulley.Protection = client.RequiredContexts
+
+	pulley.MetricsProcessor(config.DefaultCheckers(pulley.Protection), config.TrackBuildTimes)
+	prometheus.MustRegister(pulley.Collector())
 
-	http.Handle("/"+config.WebhookPath, newWebhookHandler(&pulley))
-	http.Handle("/"+config.MetricsPath, promhttp.Handler())
+	mux := http.NewServeMux()
+	mux.Handle("/"+config.WebhookPath, newWebhookHandler(&pulley))
+	mux.Handle("/"+config.MetricsPath, metrics.Handler())
+
+	if config.AdminToken != "" {
+		mux.Handle("/"+config.AdminPath+"/reload", pulley.ReloadHandler(config.AdminToken, *configPath))
+	}
 
 	// Listen & Serve
 	addr := net.JoinHostPort(config.Host, config.Port)
-	log.Printf("[service] listening on %s", addr)
+	server := &http.Server{Addr: addr, Handler: mux}
+
+	go func() {
+		log.Printf("[service] listening on %s", addr)
+
+		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		for range hup {
+			log.Println("[service] received SIGHUP, reloading the configuration")
+
+			if err := pulley.Reload(*configPath); err != nil {
+				log.Printf("[service] rejected the configuration, keeping the current one: %v", err)
+			}
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	sig := <-stop
+	log.Printf("[service] received %s, shutting down", sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+
+	// First stop accepting webhooks, then process the ones already accepted
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("[service] could not stop serving in time: %v", err)
+	}
+
+	if err := pulley.Stop(ctx); err != nil {
+		log.Printf("[service] could not process all the updates in time: %v", err)
+	}
 
-	log.Fatal(http.ListenAndServe(addr, nil))
+	log.Println("server stopped")
 }
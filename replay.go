@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/knl/pulley/internal/config"
+	"github.com/knl/pulley/internal/metrics"
+	"github.com/knl/pulley/internal/protection"
+	"github.com/knl/pulley/internal/service"
+)
+
+// replay feeds archived webhooks through the MetricsProcessor, configured the
+// same way as the service, and prints the resulting metrics to stdout.
+func replay(args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	configPath := flags.String("config", os.Getenv("PULLEY_CONFIG"), "the YAML configuration file, overridden by the environment variables")
+	speed := flags.Float64("speed", 0, "how many times faster than received to replay the webhooks, 0 replays them as fast as possible")
+
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s replay [-config FILE] [-speed N] <archive file or directory>...\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return fmt.Errorf("no archive given")
+	}
+
+	config, err := config.Load(*configPath)
+	if err != nil {
+		return fmt.Errorf("configuration step failed, %v", err)
+	}
+
+	files, err := service.ArchiveFiles(flags.Args())
+	if err != nil {
+		return err
+	}
+
+	githubMetrics, err := metrics.NewGithubMetrics(histograms(config), limits(config))
+	if err != nil {
+		return fmt.Errorf("configuration step failed, %v", err)
+	}
+
+	// Nothing gets persisted or evicted, since the archive is replayed faster
+	// than the time passes
+	pulley := service.Pulley{
+		Updates: make(chan interface{}, config.QueueSize),
+		Metrics: githubMetrics,
+		MaxSHAs: config.MaxSHAs,
+	}
+
+	// The client only calls GitHub's API once a protection rule asks for it, in
+	// the background, thus the first PRs replayed into a branch might not be
+	// timed, as its required status checks are not fetched yet
+	client, err := protection.New(config.GithubAPIToken, config.GithubAPIURL, config.ProtectionRefresh)
+	if err != nil {
+		return fmt.Errorf("could not create the GitHub API client, %v", err)
+	}
+
+	pulley.Protection = client.RequiredContexts
+
+	pulley.MetricsProcessor(config.DefaultCheckers(pulley.Protection), config.TrackBuildTimes)
+
+	replayed, err := pulley.Replay(files, *speed)
+	if err != nil {
+		return err
+	}
+
+	if err := pulley.Stop(context.Background()); err != nil {
+		return err
+	}
+
+	log.Printf("[replay] replayed %d updates from %d files", replayed, len(files))
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		return err
+	}
+
+	for _, family := range families {
+		if _, err := expfmt.MetricFamilyToText(os.Stdout, family); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}